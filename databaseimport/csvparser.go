@@ -55,8 +55,22 @@ type Parser struct {
 	UserLang     string
 	Reader       *csv.Reader
 	Errors       []*ParserError
+	Progress     func(lines int)
+	Cancel       <-chan struct{}
+	// Mapping converts the columns of files which are not in the ArkeoGIS layout
+	Mapping       *Mapping
+	SourceColumns map[string]int
 }
 
+// ErrCancelled is returned by Parse when the parsing is cancelled
+var ErrCancelled = errors.New("IMPORT.CSV_FILE.T_ERROR_CANCELLED")
+
+// ErrErrorsDetected is returned by Parse when errors were added to Parser.Errors while processing the lines
+var ErrErrorsDetected = errors.New("IMPORT.CSV_FILE.T_CHECK_ERRORS_DETECTED")
+
+// ProgressStep is the number of lines between two calls of Parser.Progress
+const ProgressStep = 1000
+
 func (p *Parser) AddError(errMsg string, columns ...string) {
 	p.Errors = append(p.Errors, &ParserError{
 		Columns: columns,
@@ -89,6 +103,7 @@ func NewParser(filename string, langIsocode string, userLangIsocode string) (*Pa
 	}
 	p.Reader = csv.NewReader(f)
 	p.Reader.Comma = ';'
+	p.Reader.ReuseRecord = true
 	return p, nil
 }
 
@@ -123,6 +138,12 @@ func (p *Parser) Parse(fn func(r *Fields)) error {
 	r := reflect.ValueOf(&f)
 	p.Line = 2
 	for {
+		select {
+		case <-p.Cancel:
+			return ErrCancelled
+		default:
+		}
+
 		record, err := p.Reader.Read()
 		if err == io.EOF {
 			break
@@ -132,15 +153,23 @@ func (p *Parser) Parse(fn func(r *Fields)) error {
 
 		// Parse lines after first line
 		// Ok we assign fields vlues to struct Fields
-		for k, v := range record {
-			r.Elem().FieldByName(p.HeaderFields[k]).SetString(strings.TrimSpace(v))
+		if p.Mapping != nil {
+			p.Mapping.Apply(record, p.SourceColumns, &f)
+		} else {
+			for k, v := range record {
+				r.Elem().FieldByName(p.HeaderFields[k]).SetString(strings.TrimSpace(v))
+			}
 		}
 		// Process line
 		fn(&f)
 		p.Line++
+
+		if p.Progress != nil && (p.Line-2)%ProgressStep == 0 {
+			p.Progress(p.Line - 2)
+		}
 	}
 	if len(p.Errors) > 0 {
-		return errors.New("IMPORT.CSV_FILE.T_CHECK_ERRORS_DETECTED")
+		return ErrErrorsDetected
 	}
 	return nil
 }
@@ -149,13 +178,18 @@ func (p *Parser) Parse(fn func(r *Fields)) error {
 // If not, trigger and error and exit
 func (p *Parser) checkHeader(record []string) error {
 
-	if len(record) > 21 {
+	if p.Mapping != nil {
+		return p.checkMappedHeader(record)
+	}
+
+	if len(record) > 24 {
 		p.AddError("IMPORT.CSV_FILE.T_CHECK_HEADER_TOO_MUCH_FIELDS", strconv.Itoa(len(record)))
 		return errors.New("Too much fields detected in csv")
 	}
 	f := Fields{}
 	// Store if we found header file witch defines lvl1 for a charac like furniture, realestate, etc
 	p.HeaderFields = make(map[int]string)
+	found := map[string]bool{}
 	r := reflect.Indirect(reflect.ValueOf(&f))
 	for k, v := range record {
 		v = strings.TrimSpace(v)
@@ -166,29 +200,47 @@ func (p *Parser) checkHeader(record []string) error {
 			// Store detected header column
 			p.HeaderFields[k] = v
 			// Store if field is found in csv file
-			if val, ok := mandatoryCsvColumns[v]; ok && val == false {
-				mandatoryCsvColumns[v] = true
-			}
-			// If user wants to use geofields, check if fields are found in csv
-			if p.UserChoices.UseGeonames == true {
-				if val, ok := geonamesColumns[v]; ok && val == false {
-					geonamesColumns[v] = true
-				}
+			found[v] = true
+		}
+	}
+
+	return p.checkMandatoryFields(found)
+}
+
+// checkMappedHeader verifies the columns used by the mapping are in the csv file
+func (p *Parser) checkMappedHeader(record []string) error {
+	p.SourceColumns = make(map[string]int)
+	for k, v := range record {
+		p.SourceColumns[strings.TrimSpace(v)] = k
+	}
+
+	found := map[string]bool{}
+	for name, fm := range p.Mapping.Fields {
+		for _, c := range fm.Columns {
+			if _, ok := p.SourceColumns[strings.TrimSpace(c)]; !ok {
+				p.AddError("IMPORT.CSV_FILE.T_CHECK_MAPPING_COLUMN_NOT_FOUND", c)
 			}
 		}
+		found[name] = true
 	}
 
+	return p.checkMandatoryFields(found)
+}
+
+// checkMandatoryFields verifies all mandatory fields are found in the csv file
+func (p *Parser) checkMandatoryFields(found map[string]bool) error {
+
 	// Verify if all mandatory csv fields are found
-	for name, set := range mandatoryCsvColumns {
-		if set == false {
+	for name := range mandatoryCsvColumns {
+		if !found[name] {
 			p.AddError("IMPORT.CSVFIELD_ALL.T_CHECK_NOT_FOUND", name)
 		}
 	}
 
 	// If user choose to use geonames, verify if mandatory csv fields are found
 	if p.UserChoices.UseGeonames == true {
-		for name, set := range geonamesColumns {
-			if set == false {
+		for name := range geonamesColumns {
+			if !found[name] {
 				p.AddError("IMPORT.CSVFIELD_GEONAME.T_CHECK_MANDATORY_FIELDS_NOT_FOUND", name)
 			}
 		}
@@ -21,6 +21,7 @@
 package databaseimport
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"log"
@@ -74,6 +75,9 @@ func (e *ImportError) Error() string {
 	return fmt.Sprintf("line %d, column %s: %s", e.Line, strings.Join(e.Columns, ","), e.ErrMsg)
 }
 
+// MaxErrors is the maximum number of errors, warnings and sites with error kept by an import
+const MaxErrors = 1000
+
 // AddError structures errors to be logged or returned to client
 func (di *DatabaseImport) AddError(value string, errMsg string, columns ...string) {
 
@@ -82,29 +86,65 @@ func (di *DatabaseImport) AddError(value string, errMsg string, columns ...strin
 		line = di.Parser.Line
 	}
 
-	di.Errors = append(di.Errors, &ImportError{
-		Line:     line,
-		SiteCode: di.CurrentSite.Code,
-		Columns:  columns,
-		Value:    value,
-		ErrMsg:   translate.T(di.UserLang, errMsg),
-	})
+	di.addLineError(line, di.CurrentSite.Code, value, errMsg, columns...)
 
 	if di.CurrentSite != nil {
-		di.CurrentSite.HasError = true
-
 		// Store site as containing error
-		if di.CurrentSite.Code != "" {
-			if _, ok := di.SitesWithError[di.CurrentSite.Code]; !ok {
+		if !di.CurrentSite.HasError && di.CurrentSite.Code != "" {
+			di.NumberOfSitesWithError++
+			if len(di.SitesWithError) < MaxErrors {
 				di.SitesWithError[di.CurrentSite.Code] = true
 			}
 		}
+
+		di.CurrentSite.HasError = true
+	}
+}
+
+// addLineError records an error of a line of the csv file. Only the first errors are kept, so huge files do not fill the memory
+func (di *DatabaseImport) addLineError(line int, code string, value string, errMsg string, columns ...string) {
+	di.NumberOfErrors++
+	if len(di.Errors) < MaxErrors {
+		di.Errors = append(di.Errors, &ImportError{
+			Line:     line,
+			SiteCode: code,
+			Columns:  columns,
+			Value:    value,
+			ErrMsg:   translate.T(di.UserLang, errMsg),
+		})
 	}
 }
 
+// AddWarning structures warnings, which are reported to the client but do not prevent the site from being imported
+func (di *DatabaseImport) AddWarning(value string, errMsg string, columns ...string) {
+
+	line := 0
+	if di.Parser != nil {
+		line = di.Parser.Line
+	}
+
+	di.NumberOfWarnings++
+	if len(di.Warnings) < MaxErrors {
+		di.Warnings = append(di.Warnings, &ImportError{
+			Line:     line,
+			SiteCode: di.CurrentSite.Code,
+			Columns:  columns,
+			Value:    value,
+			ErrMsg:   translate.T(di.UserLang, errMsg),
+		})
+	}
+}
+
+// SitesChanges counts the sites of the database created, modified, left unchanged or deleted by an import
+type SitesChanges struct {
+	New       int `json:"nbNewSites"`
+	Modified  int `json:"nbModifiedSites"`
+	Unchanged int `json:"nbUnchangedSites"`
+	Deleted   int `json:"nbDeletedSites"`
+}
+
 // DatabaseImport is a meta struct which stores all the informations about a site
 type DatabaseImport struct {
-	SitesProcessed         map[string]int
 	Database               *DatabaseInfos
 	CurrentSite            *model.SiteInfos
 	CurrentSiteRange       *model.Site_range
@@ -114,12 +154,18 @@ type DatabaseImport struct {
 	Uid                    int
 	ArkeoCharacs           map[string]map[string]int
 	//ArkeoCharacsIDs  map[int][]int
-	NumberOfSites    int
-	SitesWithError   map[string]bool
-	CachedSiteRanges map[string]int
-	Errors           []*ImportError
-	Md5sum           string
-	UserLang         string
+	NumberOfSites          int
+	NumberOfSitesWithError int
+	NumberOfErrors         int
+	NumberOfWarnings       int
+	SitesWithError         map[string]bool
+	Errors                 []*ImportError
+	Warnings               []*ImportError
+	UnknownCharacs         map[string]*UnknownCharac
+	Changes                SitesChanges
+	Md5sum                 string
+	UserLang               string
+	staging                *sql.Stmt
 }
 
 // New creates a new import process
@@ -134,6 +180,7 @@ func (di *DatabaseImport) New(parser *Parser, uid int, databaseName string, lang
 	di.Parser = parser
 	di.NumberOfSites = 0
 	di.SitesWithError = map[string]bool{}
+	di.UnknownCharacs = map[string]*UnknownCharac{}
 	di.Md5sum = filehash
 
 	if parser != nil {
@@ -165,9 +212,6 @@ func (di *DatabaseImport) New(parser *Parser, uid int, databaseName string, lang
 		return err
 	}*/
 
-	// Cache site range ids
-	di.CachedSiteRanges = map[string]int{}
-
 	// Field DATABASE_SOURCE_NAME
 	if di.Database.Name == "" {
 		if databaseName != "" {
@@ -250,31 +294,11 @@ func (di *DatabaseImport) ProcessRecord(f *Fields) {
 	// Process chara infos
 	di.processCharacInfos(f)
 
-	// If no error insert site in database
-	if !di.CurrentSite.HasError {
-		if di.CurrentSite.Id == 0 {
-			err = di.CurrentSite.Create(di.Tx)
-			// Site ID
-			di.CurrentSiteRange.Site_id = di.CurrentSite.Id
-			//} else {
-			//	err = di.CurrentSite.Update(di.Tx)
-		}
-		if err == nil {
-			err = di.insertSiteRangeInfos()
-			if err == nil {
-				err = di.insertCharacInfos()
-			}
-		}
-		if err != nil {
-			log.Println(err.Error())
-			di.AddError("", err.Error(), "")
-		} else {
-			// Cache dates
-			err = di.CurrentSite.CacheDates(di.Tx)
-			if err != nil {
-				di.AddError("", "IMPORT.SITE_CACHING_DATES.T_LABEL", "SITE_SOURCE_ID")
-			}
-		}
+	// Copy the line in the staging table, lines are merged into the database when the import is saved
+	err = di.stageRecord()
+	if err != nil {
+		log.Println(err.Error())
+		di.AddError("", err.Error(), "")
 	}
 
 }
@@ -334,11 +358,7 @@ func (di *DatabaseImport) ProcessEssentialDatabaseInfos(name string, geographica
 			return err
 		}
 
-		// Delete linked sites
-		err = di.Database.DeleteSites(di.Tx)
-		if err != nil {
-			return err
-		}
+		// Sites are not deleted, they are merged on their code when the import is saved
 	} else {
 		di.setDefaultValues()
 	}
@@ -401,6 +421,23 @@ func (di *DatabaseImport) processSiteInfos(f *Fields) {
 		di.CurrentSite.Centroid = val
 	}
 
+	// GEOMETRY, a polygon or a line. Its centroid is used as the site point if coordinates are not set
+	di.CurrentSite.Geom_shape = sql.NullString{}
+	if f.GEOMETRY != "" {
+		shape, err := di.processShape(f)
+		if err == nil {
+			di.CurrentSite.Geom_shape = sql.NullString{String: shape.EWKT, Valid: true}
+			if f.LATITUDE == "" && f.LONGITUDE == "" {
+				// The point of the site is the centroid of the geometry, computed when the import is saved
+				di.CurrentSite.Point = nil
+				di.CurrentSite.Altitude = -999999
+				di.CurrentSite.Geom = ""
+			}
+		} else {
+			log.Println("databaseimport.go:", err)
+		}
+	}
+
 	// If only one of lat or lon empty
 	if (f.LATITUDE != "" && f.LONGITUDE == "") || (f.LONGITUDE != "" && f.LATITUDE == "") {
 		di.AddError(f.LONGITUDE+" "+f.LATITUDE, "IMPORT.CSVFIELD_LATITUDE_OR_LONGITUDE.T_CHECK_ONE_IS_EMPTY_OTHER_NOT", "LATITUDE", "LONGITUDE")
@@ -443,7 +480,7 @@ func (di *DatabaseImport) processSiteInfos(f *Fields) {
 			} else {
 				log.Println("databaseimport.go:", err)
 			}
-		} else {
+		} else if f.GEOMETRY == "" {
 			// User don't want to use Geonames, we are stuck
 			if !di.Parser.UserChoices.UseGeonames {
 				di.AddError(f.LONGITUDE+" "+f.LATITUDE, "IMPORT.CSVFIELD_GEO.T_CHECK_LAT_OR_LON_NOT_SET_AND_NO_GEONAMES", "LATITUDE", "LONGITUDE", "GEONAME_ID")
@@ -453,6 +490,7 @@ func (di *DatabaseImport) processSiteInfos(f *Fields) {
 				point, err := di.processGeonames(f)
 				if err == nil {
 					di.CurrentSite.Point = point
+					di.CurrentSite.EPSG = point.EPSG
 					// Has we used Geonames, site location type is "centroid"
 					di.CurrentSite.Centroid = true
 					di.CurrentSite.Geom = di.CurrentSite.Point.ToEWKT_2d()
@@ -466,6 +504,29 @@ func (di *DatabaseImport) processSiteInfos(f *Fields) {
 		}
 	}
 
+	// UNCERTAINTY, the positional uncertainty in metres
+	di.CurrentSite.Uncertainty_radius = 0
+	if f.UNCERTAINTY != "" {
+		val, err := strconv.ParseFloat(strings.Replace(f.UNCERTAINTY, ",", ".", 1), 64)
+		if err != nil || val < 0 {
+			di.AddError(f.UNCERTAINTY, "IMPORT.CSVFIELD_UNCERTAINTY.T_CHECK_INCORRECT_VALUE", "UNCERTAINTY")
+		} else {
+			di.CurrentSite.Uncertainty_radius = val
+		}
+	}
+
+	// PRECISION, sites located at their city centroid are located to the commune by default
+	if f.PRECISION != "" {
+		val, err := di.getPrecision(f.PRECISION)
+		if err == nil {
+			di.CurrentSite.Precision_class = val
+		}
+	} else if di.CurrentSite.Centroid {
+		di.CurrentSite.Precision_class = "commune"
+	} else {
+		di.CurrentSite.Precision_class = "exact"
+	}
+
 	// OCCUPATION
 	if f.OCCUPATION == "" {
 		di.AddError("", "IMPORT.CSVFIELD_ALL.T_CHECK_UNDEFINED", "OCCUPATION")
@@ -523,18 +584,37 @@ func (di *DatabaseImport) checkDifferences(f *Fields) {
 
 }
 
-// getOccupation get occupation string from field translatable in the csv file
+// getPrecision get precision class string from field translatable in the csv file
+func (di *DatabaseImport) getPrecision(precision string) (val string, err error) {
+	switch cleanAndLower(precision) {
+	case "exact", di.lowerTranslation("IMPORT.CSVFIELD_PRECISION.T_LABEL_EXACT"):
+		val = "exact"
+	case "approximate", di.lowerTranslation("IMPORT.CSVFIELD_PRECISION.T_LABEL_APPROXIMATE"):
+		val = "approximate"
+	case "commune", di.lowerTranslation("IMPORT.CSVFIELD_PRECISION.T_LABEL_COMMUNE"):
+		val = "commune"
+	case "region", di.lowerTranslation("IMPORT.CSVFIELD_PRECISION.T_LABEL_REGION"):
+		val = "region"
+	default:
+		di.AddError(precision, "IMPORT.CSVFIELD_PRECISION.T_CHECK_INVALID", "PRECISION")
+		err = errors.New("Invalid precision")
+	}
+	return
+}
+
+// getOccupation get occupation string from field translatable in the csv file, or from its value in
+// database, which is used by mapping dictionaries
 func (di *DatabaseImport) getOccupation(occupation string) (val string, err error) {
 	err = nil
 
 	switch cleanAndLower(occupation) {
-	case di.lowerTranslation("IMPORT.CSVFIELD_OCCUPATION.T_LABEL_NOT_DOCUMENTED"):
+	case "not_documented", di.lowerTranslation("IMPORT.CSVFIELD_OCCUPATION.T_LABEL_NOT_DOCUMENTED"):
 		val = "not_documented"
-	case di.lowerTranslation("IMPORT.CSVFIELD_OCCUPATION.T_LABEL_SINGLE"):
+	case "single", di.lowerTranslation("IMPORT.CSVFIELD_OCCUPATION.T_LABEL_SINGLE"):
 		val = "single"
-	case di.lowerTranslation("IMPORT.CSVFIELD_OCCUPATION.T_LABEL_CONTINUOUS"):
+	case "continuous", di.lowerTranslation("IMPORT.CSVFIELD_OCCUPATION.T_LABEL_CONTINUOUS"):
 		val = "continuous"
-	case di.lowerTranslation("IMPORT.CSVFIELD_OCCUPATION.T_LABEL_MULTIPLE"):
+	case "multiple", di.lowerTranslation("IMPORT.CSVFIELD_OCCUPATION.T_LABEL_MULTIPLE"):
 		val = "multiple"
 	default:
 		if occupation == "" {
@@ -562,13 +642,7 @@ func (di *DatabaseImport) processGeoDatas(f *Fields) (*geo.Point, error) {
 			hasError = true
 		}
 	}
-	// Test if EPSG is exists
-	var SRIDExists int
-	err = di.Tx.Get(&SRIDExists, "select count(*) from spatial_ref_sys where srid = $1", epsg)
-	if err != nil || SRIDExists != 1 {
-		di.AddError(f.PROJECTION_SYSTEM, "IMPORT.CSVFIELD_PROJECTION_SYSTEM.T_CHECK_NOT_EXISTS", "PROJECTION_SYSTEM")
-		hasError = true
-	}
+	// The existence of the EPSG, the reprojection in WGS84 and the area of use are checked when the import is saved
 	di.CurrentSite.EPSG = epsg
 
 	// Parse LONGITUDE
@@ -610,6 +684,27 @@ func (di *DatabaseImport) processGeoDatas(f *Fields) (*geo.Point, error) {
 	return point, nil
 }
 
+// processShape analyzes the GEOMETRY csv field, a WKT polygon or line in the PROJECTION_SYSTEM
+func (di *DatabaseImport) processShape(f *Fields) (*geo.Shape, error) {
+	epsg := 4326
+	if f.PROJECTION_SYSTEM != "" {
+		var err error
+		epsg, err = strconv.Atoi(f.PROJECTION_SYSTEM)
+		if err != nil {
+			di.AddError(f.PROJECTION_SYSTEM, "IMPORT.CSVFIELD_PROJECTION_SYSTEM.T_CHECK_INCORRECT_VALUE", "PROJECTION_SYSTEM")
+			return nil, err
+		}
+	}
+	// The existence of the EPSG, the validity of the geometry and its area of use are checked when the import is saved
+	shape, err := geo.NewShapeFromWKT(epsg, f.GEOMETRY)
+	if err != nil {
+		di.AddError(f.GEOMETRY, "IMPORT.CSVFIELD_GEOMETRY.T_CHECK_NOT_POLYGON_OR_LINE", "GEOMETRY")
+		return nil, err
+	}
+	di.CurrentSite.EPSG = epsg
+	return shape, nil
+}
+
 // processGeonames get the city name/lat/lon from the database and assign it TODO
 func (di *DatabaseImport) processGeonames(f *Fields) (*geo.Point, error) {
 	if f.GEONAME_ID == "" {
@@ -654,26 +749,6 @@ func (di *DatabaseImport) processSiteRangeInfos(f *Fields) {
 	}
 
 }
-func (di *DatabaseImport) insertSiteRangeInfos() error {
-
-	// If site range is not cached, create it
-	siteRangeHash := strconv.Itoa(di.CurrentSite.Id) + strconv.Itoa(di.CurrentSiteRange.Start_date1) + strconv.Itoa(di.CurrentSiteRange.Start_date2) + strconv.Itoa(di.CurrentSiteRange.End_date1) + strconv.Itoa(di.CurrentSiteRange.End_date2)
-
-	if id, ok := di.CachedSiteRanges[siteRangeHash]; !ok {
-		err := di.CurrentSiteRange.Create(di.Tx)
-		if err != nil {
-			di.AddError("", "IMPORT.PROCESS_SITE_RANGE.T_ERROR", "")
-			return err
-		}
-		di.CachedSiteRanges[siteRangeHash] = di.CurrentSiteRange.Id
-		return nil
-	} else {
-		di.CurrentSiteRange.Id = id
-	}
-
-	return nil
-}
-
 // processCharacs analyses the fields of each charac for each level
 // It verify if charac of any level exists and if true, assign it to the site range
 func (di *DatabaseImport) processCharacInfos(f *Fields) error {
@@ -707,6 +782,7 @@ func (di *DatabaseImport) processCharacInfos(f *Fields) error {
 	caracID := di.ArkeoCharacs[caracNameToLowerCase][caracNameToLowerCase+path]
 	if caracID == 0 {
 		log.Println("NOT FOUND: ", caracNameToLowerCase+path)
+		di.addUnknownCharac(caracNameToLowerCase + path)
 		di.AddError(caracNameToLowerCase+path, "IMPORT.CSVFIELD_CARACTERISATION.T_CHECK_INVALID", "CARAC_LVL"+strconv.Itoa(lvl))
 		return errors.New("invalid charac")
 	}
@@ -721,17 +797,17 @@ func (di *DatabaseImport) processCharacInfos(f *Fields) error {
 
 	//	STATE_OF_KNOWLEDGE
 	switch cleanAndLower(f.STATE_OF_KNOWLEDGE) {
-	case di.lowerTranslation("IMPORT.CSVFIELD_STATE_OF_KNOWLEDGE.T_LABEL_NOT_DOCUMENTED"):
+	case "not_documented", di.lowerTranslation("IMPORT.CSVFIELD_STATE_OF_KNOWLEDGE.T_LABEL_NOT_DOCUMENTED"):
 		di.CurrentSiteRangeCharac.Knowledge_type = "not_documented"
-	case di.lowerTranslation("IMPORT.CSVFIELD_STATE_OF_KNOWLEDGE.T_LABEL_LITERATURE"):
+	case "literature", di.lowerTranslation("IMPORT.CSVFIELD_STATE_OF_KNOWLEDGE.T_LABEL_LITERATURE"):
 		di.CurrentSiteRangeCharac.Knowledge_type = "literature"
-	case di.lowerTranslation("IMPORT.CSVFIELD_STATE_OF_KNOWLEDGE.T_LABEL_PROSPECTED_AERIAL"):
+	case "prospected_aerial", di.lowerTranslation("IMPORT.CSVFIELD_STATE_OF_KNOWLEDGE.T_LABEL_PROSPECTED_AERIAL"):
 		di.CurrentSiteRangeCharac.Knowledge_type = "prospected_aerial"
-	case di.lowerTranslation("IMPORT.CSVFIELD_STATE_OF_KNOWLEDGE.T_LABEL_PROSPECTED_PEDESTRIAN"):
+	case "prospected_pedestrian", di.lowerTranslation("IMPORT.CSVFIELD_STATE_OF_KNOWLEDGE.T_LABEL_PROSPECTED_PEDESTRIAN"):
 		di.CurrentSiteRangeCharac.Knowledge_type = "prospected_pedestrian"
-	case di.lowerTranslation("IMPORT.CSVFIELD_STATE_OF_KNOWLEDGE.T_LABEL_SURVEYED"):
+	case "surveyed", di.lowerTranslation("IMPORT.CSVFIELD_STATE_OF_KNOWLEDGE.T_LABEL_SURVEYED"):
 		di.CurrentSiteRangeCharac.Knowledge_type = "surveyed"
-	case di.lowerTranslation("IMPORT.CSVFIELD_STATE_OF_KNOWLEDGE.T_LABEL_DIG"):
+	case "dig", di.lowerTranslation("IMPORT.CSVFIELD_STATE_OF_KNOWLEDGE.T_LABEL_DIG"):
 		di.CurrentSiteRangeCharac.Knowledge_type = "dig"
 	default:
 		if f.STATE_OF_KNOWLEDGE == "" {
@@ -818,24 +894,6 @@ func (di *DatabaseImport) cacheCharacsIDs() (map[int][]int, error) {
 	return characs, nil
 }
 
-func (di *DatabaseImport) insertCharacInfos() error {
-	var err error
-	di.CurrentSiteRangeCharac.Site_range_id = di.CurrentSiteRange.Id
-	stmt, err := di.Tx.PrepareNamed("INSERT INTO \"site_range__charac\" (" + model.Site_range__charac_InsertStr + ") VALUES (" + model.Site_range__charac_InsertValuesStr + ") RETURNING id")
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-	err = stmt.Get(&di.CurrentSiteRangeCharac.Site_range__charac_id, di.CurrentSiteRangeCharac)
-	if err != nil {
-		return err
-	}
-
-	di.CurrentSiteRangeCharac.Lang_isocode = di.Database.Default_language
-	_, err = di.Tx.NamedExec("INSERT INTO \"site_range__charac_tr\" (\"site_range__charac_id\", \"lang_isocode\", \"bibliography\", \"comment\") VALUES (:site_range__charac_id, :lang_isocode, :bibliography, :comment)", di.CurrentSiteRangeCharac)
-	return err
-}
-
 // valueAsBool analyses YES/NO translatable values to bool
 func (di *DatabaseImport) valueAsBool(fieldName, val string) (choosenValue bool, err error) {
 	switch cleanAndLower(val) {
@@ -963,9 +1021,61 @@ func (di *DatabaseImport) parseDates(period string) ([2]int, error) {
 	return dates, nil
 }
 
+// Save checks and reprojects the geometries of the staged lines, merges them into the database, deletes
+// the sites which are not in the csv file anymore, caches the extent, dates and text search documents of
+// the database, and records the import with a summary of the changes
 func (di *DatabaseImport) Save(filename string) (int, error) {
 	var err error
-	i := model.Import{Database_id: di.Database.Id, User_id: di.Uid, Filename: filename, Number_of_lines: di.Parser.Line - 1, Number_of_sites: di.NumberOfSites, Md5sum: di.Md5sum}
+
+	err = di.closeStaging()
+	if err != nil {
+		return 0, err
+	}
+
+	err = di.checkStagingGeometries()
+	if err != nil {
+		return 0, err
+	}
+
+	err = di.mergeStaging()
+	if err != nil {
+		return 0, err
+	}
+
+	err = di.deleteRemovedSites()
+	if err != nil {
+		return 0, err
+	}
+
+	err = di.computeChanges()
+	if err != nil {
+		return 0, err
+	}
+
+	// Cache the extent, the dates and the text search documents of the database
+	err = di.Database.CacheGeom(di.Tx)
+	if err == nil {
+		err = di.Database.CacheDates(di.Tx)
+	}
+	if err == nil {
+		err = di.Database.CacheTextSearch(di.Tx)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	i := model.Import{
+		Database_id:               di.Database.Id,
+		User_id:                   di.Uid,
+		Filename:                  filename,
+		Number_of_lines:           di.Parser.Line - 1,
+		Number_of_sites:           di.NumberOfSites,
+		Number_of_new_sites:       di.Changes.New,
+		Number_of_modified_sites:  di.Changes.Modified,
+		Number_of_unchanged_sites: di.Changes.Unchanged,
+		Number_of_deleted_sites:   di.Changes.Deleted,
+		Md5sum:                    di.Md5sum,
+	}
 	err = i.Create(di.Tx)
 	return i.Id, err
 }
@@ -33,6 +33,9 @@ type Fields struct {
 	LONGITUDE            string
 	LATITUDE             string
 	ALTITUDE             string
+	GEOMETRY             string
+	UNCERTAINTY          string
+	PRECISION            string
 	STATE_OF_KNOWLEDGE   string
 	CITY_CENTROID        string
 	OCCUPATION           string
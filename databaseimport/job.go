@@ -0,0 +1,176 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package databaseimport
+
+import (
+	"sync"
+	"time"
+)
+
+// Status of an import job
+const (
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// JobRetention is the duration finished jobs are kept
+const JobRetention = 24 * time.Hour
+
+// JobStatus is the state of an import job returned to the client
+type JobStatus struct {
+	Id            int            `json:"id"`
+	Uid           int            `json:"user_id"`
+	Filename      string         `json:"filename"`
+	Status        string         `json:"status"`
+	Lines         int            `json:"nbLines"`
+	NumberOfSites int            `json:"nbSites"`
+	Errors        []*ImportError `json:"errors"`
+	ParserErrors  []*ParserError `json:"parserErrors"`
+	Result        interface{}    `json:"result"`
+	Created_at    time.Time      `json:"created_at"`
+	Updated_at    time.Time      `json:"updated_at"`
+}
+
+// Job is an import running in a worker goroutine
+type Job struct {
+	mu     sync.Mutex
+	status JobStatus
+	cancel chan struct{}
+}
+
+var jobs = struct {
+	sync.Mutex
+	lastId int
+	list   map[int]*Job
+}{list: map[int]*Job{}}
+
+// NewJob registers a new running import job of the user
+func NewJob(uid int, filename string) *Job {
+	jobs.Lock()
+	defer jobs.Unlock()
+
+	// Forget old finished jobs
+	for id, j := range jobs.list {
+		s := j.Status()
+		if s.Status != JobRunning && time.Since(s.Updated_at) > JobRetention {
+			delete(jobs.list, id)
+		}
+	}
+
+	jobs.lastId++
+	j := &Job{
+		status: JobStatus{
+			Id:         jobs.lastId,
+			Uid:        uid,
+			Filename:   filename,
+			Status:     JobRunning,
+			Errors:     []*ImportError{},
+			Created_at: time.Now(),
+			Updated_at: time.Now(),
+		},
+		cancel: make(chan struct{}),
+	}
+	jobs.list[j.status.Id] = j
+	return j
+}
+
+// GetJob returns the job of the user, or nil if it does not exists
+func GetJob(uid int, id int) *Job {
+	jobs.Lock()
+	defer jobs.Unlock()
+	j, ok := jobs.list[id]
+	if !ok || j.status.Uid != uid {
+		return nil
+	}
+	return j
+}
+
+// GetUserJobs returns the status of all the jobs of the user
+func GetUserJobs(uid int) []JobStatus {
+	jobs.Lock()
+	defer jobs.Unlock()
+	list := []JobStatus{}
+	for _, j := range jobs.list {
+		if s := j.Status(); s.Uid == uid {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// Status returns a copy of the state of the job
+func (j *Job) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// SetProgress records the lines and sites processed and the errors found so far by the import
+func (j *Job) SetProgress(di *DatabaseImport) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if di.Parser != nil {
+		j.status.Lines = di.Parser.Line - 1
+	}
+	j.status.NumberOfSites = di.NumberOfSites
+	j.status.Errors = append([]*ImportError{}, di.Errors...)
+	j.status.Updated_at = time.Now()
+}
+
+// Cancel asks the import to stop, it will be rolled back
+func (j *Job) Cancel() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.status.Status == JobRunning {
+		select {
+		case <-j.cancel:
+		default:
+			close(j.cancel)
+		}
+	}
+}
+
+// Cancelled returns a channel closed when the job is cancelled
+func (j *Job) Cancelled() <-chan struct{} {
+	return j.cancel
+}
+
+// Finish records the result of the job. A job cancelled too late to be rolled back is done
+func (j *Job) Finish(result interface{}, errors []*ParserError) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(errors) == 0 {
+		j.status.Status = JobDone
+	} else {
+		select {
+		case <-j.cancel:
+			j.status.Status = JobCancelled
+		default:
+			j.status.Status = JobFailed
+		}
+	}
+	j.status.Result = result
+	j.status.ParserErrors = errors
+	j.status.Updated_at = time.Now()
+}
@@ -0,0 +1,210 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package databaseimport
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Date formats of the source columns which can be converted to ArkeoGIS dates
+const (
+	DateFormatIso  = "iso"   // ISO 8601 dates or years, with astronomical years (0 is 1 BC)
+	DateFormatBcAd = "bc_ad" // years followed or preceded by an era, like "800 BC" or "50 ap. J.-C."
+	DateFormatBp   = "bp"    // years before present (1950)
+)
+
+// Mapping describes how the columns of a csv file which is not in the ArkeoGIS layout are converted
+// into Fields. It is indexed by the name of the ArkeoGIS field, fields which are not mapped are empty.
+type Mapping struct {
+	Fields map[string]*FieldMapping `json:"fields"`
+}
+
+// FieldMapping builds the value of an ArkeoGIS field. The values of Columns are converted from
+// Date_format if it is set, then concatenated with Separator. Constant is used if the result is empty,
+// and the value is finally replaced by its translation in Dictionary, if any.
+// With Range_separator, each column is a period of two dates separated by it.
+// Mandatory fields without values in the source file must be mapped without columns nor constant.
+type FieldMapping struct {
+	Columns         []string          `json:"columns"`
+	Separator       string            `json:"separator"`
+	Constant        string            `json:"constant"`
+	Dictionary      map[string]string `json:"dictionary"`
+	Date_format     string            `json:"date_format"`
+	Range_separator string            `json:"range_separator"`
+}
+
+// Check verifies the mapping is usable
+func (m *Mapping) Check() error {
+	if len(m.Fields) == 0 {
+		return errors.New("IMPORT.MAPPING.T_CHECK_EMPTY")
+	}
+	r := reflect.ValueOf(&Fields{}).Elem()
+	for name, fm := range m.Fields {
+		if fm == nil || !r.FieldByName(name).IsValid() {
+			return errors.New("IMPORT.MAPPING.T_CHECK_UNKNOWN_FIELD")
+		}
+		for _, c := range fm.Columns {
+			if strings.TrimSpace(c) == "" {
+				return errors.New("IMPORT.MAPPING.T_CHECK_EMPTY_COLUMN")
+			}
+		}
+		switch fm.Date_format {
+		case "", DateFormatIso, DateFormatBcAd, DateFormatBp:
+		default:
+			return errors.New("IMPORT.MAPPING.T_CHECK_UNKNOWN_DATE_FORMAT")
+		}
+	}
+	return nil
+}
+
+// Apply sets the fields of f from a csv record. columns are the positions of the source columns, by name
+func (m *Mapping) Apply(record []string, columns map[string]int, f *Fields) {
+	r := reflect.ValueOf(f).Elem()
+	for name, fm := range m.Fields {
+		r.FieldByName(name).SetString(fm.value(record, columns))
+	}
+}
+
+// value builds the value of the field from a csv record
+func (fm *FieldMapping) value(record []string, columns map[string]int) string {
+	values := make([]string, len(fm.Columns))
+	empty := true
+	for i, c := range fm.Columns {
+		if k, ok := columns[strings.TrimSpace(c)]; ok && k < len(record) {
+			values[i] = strings.TrimSpace(record[k])
+		}
+		if fm.Date_format != "" {
+			values[i] = convertPeriod(values[i], fm.Date_format, fm.Range_separator)
+		}
+		if values[i] != "" {
+			empty = false
+		}
+	}
+
+	value := ""
+	if !empty {
+		value = strings.Join(values, fm.Separator)
+	}
+	if value == "" {
+		value = fm.Constant
+	}
+
+	if len(fm.Dictionary) > 0 {
+		lvalue := cleanAndLower(value)
+		for from, to := range fm.Dictionary {
+			if cleanAndLower(from) == lvalue {
+				return to
+			}
+		}
+	}
+	return value
+}
+
+// convertPeriod converts a date, or a period if rangeSeparator is set, to the ArkeoGIS format.
+// The separator may also be the sign of negative years or the separator of ISO dates, like "-" in
+// "-800--500", so the period is split at the first separator leaving a date on both sides.
+func convertPeriod(value string, format string, rangeSeparator string) string {
+	if rangeSeparator != "" {
+		for i := strings.Index(value, rangeSeparator); i >= 0; {
+			start, end := strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+len(rangeSeparator):])
+			if _, ok := parseDate(start, format); ok {
+				if _, ok := parseDate(end, format); ok {
+					return convertDate(start, format) + ":" + convertDate(end, format)
+				}
+			}
+			next := strings.Index(value[i+len(rangeSeparator):], rangeSeparator)
+			if next < 0 {
+				break
+			}
+			i += len(rangeSeparator) + next
+		}
+	}
+	return convertDate(value, format)
+}
+
+var isoDateRegexp = regexp.MustCompile(`^([+-]?\d{1,6})(-\d{2}(-\d{2})?)?$`)
+var bcAdDateRegexp = regexp.MustCompile(`^(\D*?)\s*(\d+)\s*(\D*)$`)
+var bcEras = map[string]bool{"bc": true, "bce": true, "avjc": true, "avantjc": true, "vchr": true, "ac": true}
+var adEras = map[string]bool{"": true, "ad": true, "ce": true, "apjc": true, "apresjc": true, "nchr": true, "dc": true}
+
+// convertDate converts a date to a year where 1 BC is -1. Values which can't be converted are kept as is,
+// so they are reported by the import
+func convertDate(value string, format string) string {
+	year, ok := parseDate(value, format)
+	if !ok {
+		return value
+	}
+	return strconv.Itoa(year)
+}
+
+// parseDate returns the year of a date where 1 BC is -1, and false if it can't be converted
+func parseDate(value string, format string) (int, bool) {
+	if value == "" {
+		return 0, false
+	}
+	year := 0
+	switch format {
+	case DateFormatIso:
+		m := isoDateRegexp.FindStringSubmatch(value)
+		if m == nil {
+			return 0, false
+		}
+		year, _ = strconv.Atoi(m[1])
+		year = historicalYear(year)
+	case DateFormatBcAd:
+		if y, err := strconv.Atoi(value); err == nil {
+			return y, true
+		}
+		m := bcAdDateRegexp.FindStringSubmatch(value)
+		if m == nil {
+			return 0, false
+		}
+		era := strings.NewReplacer(".", "", "-", "", " ", "", "é", "e", "è", "e").Replace(strings.ToLower(m[1] + m[3]))
+		year, _ = strconv.Atoi(m[2])
+		if bcEras[era] {
+			year = -year
+		} else if !adEras[era] {
+			return 0, false
+		}
+	case DateFormatBp:
+		bp, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, false
+		}
+		year = historicalYear(1950 - bp)
+	default:
+		return 0, false
+	}
+	return year, true
+}
+
+// historicalYear converts an astronomical year to a year without year 0
+func historicalYear(year int) int {
+	if year <= 0 {
+		return year - 1
+	}
+	return year
+}
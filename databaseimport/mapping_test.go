@@ -0,0 +1,92 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package databaseimport
+
+import "testing"
+
+func TestConvertDate(t *testing.T) {
+	tests := []struct {
+		value  string
+		format string
+		want   string
+	}{
+		{"", DateFormatIso, ""},
+		{"1200", DateFormatIso, "1200"},
+		{"1200-05-01", DateFormatIso, "1200"},
+		{"+0050", DateFormatIso, "50"},
+		{"0", DateFormatIso, "-1"},
+		{"-1", DateFormatIso, "-2"},
+		{"-0800", DateFormatIso, "-801"},
+		{"-800-05", DateFormatIso, "-801"},
+		{"1200 AD", DateFormatIso, "1200 AD"},
+		{"800 BC", DateFormatBcAd, "-800"},
+		{"1 BCE", DateFormatBcAd, "-1"},
+		{"50 ap. J.-C.", DateFormatBcAd, "50"},
+		{"av. J.-C. 300", DateFormatBcAd, "-300"},
+		{"450 v. Chr.", DateFormatBcAd, "-450"},
+		{"1200 AD", DateFormatBcAd, "1200"},
+		{"1200", DateFormatBcAd, "1200"},
+		{"-800", DateFormatBcAd, "-800"},
+		{"800 xyz", DateFormatBcAd, "800 xyz"},
+		{"0", DateFormatBp, "1950"},
+		{"1950", DateFormatBp, "-1"},
+		{"2000", DateFormatBp, "-51"},
+		{"-50", DateFormatBp, "2000"},
+		{"5000 BP", DateFormatBp, "5000 BP"},
+		{"1200", "", "1200"},
+	}
+	for _, test := range tests {
+		if got := convertDate(test.value, test.format); got != test.want {
+			t.Errorf("convertDate(%q, %q) = %q, want %q", test.value, test.format, got, test.want)
+		}
+	}
+}
+
+func TestConvertPeriod(t *testing.T) {
+	tests := []struct {
+		value          string
+		format         string
+		rangeSeparator string
+		want           string
+	}{
+		{"-800", DateFormatIso, "", "-801"},
+		{"-800:-500", DateFormatIso, ":", "-801:-501"},
+		{"1200", DateFormatIso, "-", "1200"},
+		{"-800", DateFormatIso, "-", "-801"},
+		{"1200-1300", DateFormatIso, "-", "1200:1300"},
+		{"0-100", DateFormatIso, "-", "-1:100"},
+		{"-800-200", DateFormatIso, "-", "-801:200"},
+		{"-800--500", DateFormatIso, "-", "-801:-501"},
+		{"-800 - -500", DateFormatIso, "-", "-801:-501"},
+		{"1200-05-01-1300-06-01", DateFormatIso, "-", "1200:1300"},
+		{"-800-x", DateFormatIso, "-", "-800-x"},
+		{"800 BC-50", DateFormatBcAd, "-", "-800:50"},
+		{"800 av. J.-C. - 50 ap. J.-C.", DateFormatBcAd, "-", "-800:50"},
+		{"800 BC / 50 AD", DateFormatBcAd, "/", "-800:50"},
+		{"5000-4000", DateFormatBp, "-", "-3051:-2051"},
+	}
+	for _, test := range tests {
+		if got := convertPeriod(test.value, test.format, test.rangeSeparator); got != test.want {
+			t.Errorf("convertPeriod(%q, %q, %q) = %q, want %q", test.value, test.format, test.rangeSeparator, got, test.want)
+		}
+	}
+}
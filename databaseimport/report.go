@@ -0,0 +1,196 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package databaseimport
+
+import (
+	"sort"
+	"strings"
+)
+
+// ReportMessages groups errors or warnings of an import by column and by site code. Only the first
+// MaxErrors messages are grouped, Count is the total number of messages
+type ReportMessages struct {
+	Count    int                       `json:"count"`
+	ByColumn map[string][]*ImportError `json:"byColumn"`
+	BySite   map[string][]*ImportError `json:"bySite"`
+}
+
+// UnknownCharac is a charac path of the csv file which do not exists in ArkeoGIS, with the closest existing paths.
+// Lines holds the first MaxUnknownCharacLines lines where it is used
+type UnknownCharac struct {
+	Path        string   `json:"path"`
+	Count       int      `json:"count"`
+	Lines       []int    `json:"lines"`
+	Suggestions []string `json:"suggestions"`
+}
+
+// Report is the machine readable result of an import
+type Report struct {
+	Lines                  int      `json:"nbLines"`
+	NumberOfSites          int      `json:"nbSites"`
+	SitesWithError         []string `json:"sitesWithError"`
+	NumberOfSitesWithError int      `json:"nbSitesWithError"`
+	SitesChanges
+	Errors         ReportMessages   `json:"errors"`
+	Warnings       ReportMessages   `json:"warnings"`
+	UnknownCharacs []*UnknownCharac `json:"unknownCharacs"`
+	ParserErrors   []*ParserError   `json:"parserErrors"`
+	// Error is set when the import could not be completed, the report is then partial
+	Error string `json:"error,omitempty"`
+}
+
+// MaxCharacSuggestions is the number of closest charac paths proposed for an unknown charac
+const MaxCharacSuggestions = 3
+
+// MaxUnknownCharacLines is the number of lines stored for each unknown charac
+const MaxUnknownCharacLines = 10
+
+// addUnknownCharac records a charac path of the current line which do not exists
+func (di *DatabaseImport) addUnknownCharac(path string) {
+	unknown, ok := di.UnknownCharacs[path]
+	if !ok {
+		unknown = &UnknownCharac{Path: path, Lines: []int{}}
+		di.UnknownCharacs[path] = unknown
+	}
+	unknown.Count++
+	if len(unknown.Lines) < MaxUnknownCharacLines {
+		unknown.Lines = append(unknown.Lines, di.Parser.Line)
+	}
+}
+
+// Report builds the report of the import, once saved
+func (di *DatabaseImport) Report() *Report {
+	report := &Report{
+		NumberOfSites:          di.NumberOfSites,
+		NumberOfSitesWithError: di.NumberOfSitesWithError,
+		SitesChanges:           di.Changes,
+		SitesWithError:         []string{},
+		UnknownCharacs:         []*UnknownCharac{},
+		ParserErrors:           []*ParserError{},
+	}
+	if di.Parser != nil {
+		report.Lines = di.Parser.Line - 1 // Remove first line
+		report.ParserErrors = append(report.ParserErrors, di.Parser.Errors...)
+	}
+
+	for code := range di.SitesWithError {
+		report.SitesWithError = append(report.SitesWithError, code)
+	}
+	sort.Strings(report.SitesWithError)
+
+	report.Errors = groupMessages(di.Errors, di.NumberOfErrors)
+	report.Warnings = groupMessages(di.Warnings, di.NumberOfWarnings)
+
+	for _, unknown := range di.UnknownCharacs {
+		unknown.Suggestions = di.suggestCharacs(unknown.Path)
+		report.UnknownCharacs = append(report.UnknownCharacs, unknown)
+	}
+	sort.Slice(report.UnknownCharacs, func(i, j int) bool {
+		return report.UnknownCharacs[i].Lines[0] < report.UnknownCharacs[j].Lines[0]
+	})
+
+	return report
+}
+
+// groupMessages indexes messages by column and by site code
+func groupMessages(messages []*ImportError, count int) ReportMessages {
+	grouped := ReportMessages{
+		Count:    count,
+		ByColumn: map[string][]*ImportError{},
+		BySite:   map[string][]*ImportError{},
+	}
+	for _, m := range messages {
+		for _, column := range m.Columns {
+			if column != "" {
+				grouped.ByColumn[column] = append(grouped.ByColumn[column], m)
+			}
+		}
+		grouped.BySite[m.SiteCode] = append(grouped.BySite[m.SiteCode], m)
+	}
+	return grouped
+}
+
+// suggestCharacs returns the existing charac paths closest to path. If the charac name is known,
+// only the paths of this charac are compared
+func (di *DatabaseImport) suggestCharacs(path string) []string {
+	candidates := []string{}
+	name := strings.SplitN(path, "->", 2)[0]
+	if paths, ok := di.ArkeoCharacs[name]; ok {
+		for p := range paths {
+			candidates = append(candidates, p)
+		}
+	} else {
+		for _, paths := range di.ArkeoCharacs {
+			for p := range paths {
+				candidates = append(candidates, p)
+			}
+		}
+	}
+
+	distances := make(map[string]int, len(candidates))
+	for _, c := range candidates {
+		distances[c] = levenshtein(path, c)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if distances[candidates[i]] == distances[candidates[j]] {
+			return candidates[i] < candidates[j]
+		}
+		return distances[candidates[i]] < distances[candidates[j]]
+	})
+
+	if len(candidates) > MaxCharacSuggestions {
+		candidates = candidates[:MaxCharacSuggestions]
+	}
+	return candidates
+}
+
+// levenshtein computes the edit distance between two strings
+func levenshtein(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
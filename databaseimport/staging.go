@@ -0,0 +1,365 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package databaseimport
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/croll/arkeogis-server/geo"
+	"github.com/croll/arkeogis-server/model"
+	"github.com/croll/arkeogis-server/translate"
+	"github.com/lib/pq"
+)
+
+// stagingColumns are the columns of the temporary table in which each line of the csv file is copied.
+// The staged lines are merged into the database when the import is saved.
+var stagingColumns = []string{"line", "code", "name", "city_name", "city_geonameid", "epsg", "geom", "geom_3d", "geom_shape", "altitude", "centroid", "uncertainty_radius", "precision_class", "occupation", "start_date1", "start_date2", "end_date1", "end_date2", "charac_id", "exceptional", "knowledge_type", "bibliography", "comment", "has_error"}
+
+// openStaging creates the staging table and starts copying lines into it.
+// No other query can be run in the transaction until closeStaging is called.
+func (di *DatabaseImport) openStaging() (err error) {
+	_, err = di.Tx.Exec(`CREATE TEMPORARY TABLE import_staging (
+		line integer, code text, name text, city_name text, city_geonameid integer,
+		epsg integer, geom text, geom_3d text, geom_shape text, altitude double precision, centroid boolean,
+		uncertainty_radius double precision, precision_class site_precision_class, occupation site_occupation,
+		start_date1 integer, start_date2 integer, end_date1 integer, end_date2 integer,
+		charac_id integer, exceptional boolean, knowledge_type site_range__charac_knowledge_type,
+		bibliography text, comment text, has_error boolean,
+		g geometry, g_3d geometry, g_shape geometry, geo_error text, geo_columns text, geo_value text
+	) ON COMMIT DROP`)
+	if err != nil {
+		return errors.New("databaseimport::openStaging: " + err.Error())
+	}
+	di.staging, err = di.Tx.Prepare(pq.CopyIn("import_staging", stagingColumns...))
+	if err != nil {
+		return errors.New("databaseimport::openStaging: " + err.Error())
+	}
+	return nil
+}
+
+// stageRecord copies the current line into the staging table. Lines of sites with errors are
+// copied too, they are used to keep these sites untouched.
+func (di *DatabaseImport) stageRecord() error {
+	if di.staging == nil {
+		if err := di.openStaging(); err != nil {
+			return err
+		}
+	}
+
+	site := di.CurrentSite
+	if !site.HasError && site.Geom == "" && !site.Geom_shape.Valid {
+		di.AddError("", "IMPORT.CSVFIELD_GEO.T_CHECK_LAT_OR_LON_NOT_SET_AND_NO_GEONAMES", "LATITUDE", "LONGITUDE")
+	}
+
+	_, err := di.staging.Exec(di.stagingValues()...)
+	if err != nil {
+		return errors.New("databaseimport::stageRecord: " + err.Error())
+	}
+	return nil
+}
+
+// stagingValues returns the values of the current line copied into the staging table, in the order of stagingColumns
+func (di *DatabaseImport) stagingValues() []interface{} {
+	site := di.CurrentSite
+
+	// Values of enum columns must be valid even for lines with errors
+	precision, occupation, knowledgeType := site.Precision_class, site.Occupation, di.CurrentSiteRangeCharac.Knowledge_type
+	if site.HasError {
+		precision, occupation, knowledgeType = "exact", "not_documented", "not_documented"
+	}
+
+	// Missing geometries are NULL, a site may only have a polygon or a line
+	var geom, geom3d, geomShape interface{}
+	if site.Geom != "" {
+		geom = site.Geom
+	}
+	if site.Geom_3d != "" {
+		geom3d = site.Geom_3d
+	}
+	if site.Geom_shape.Valid {
+		geomShape = site.Geom_shape.String
+	}
+
+	return []interface{}{di.Parser.Line, site.Code, site.Name, site.City_name, site.City_geonameid,
+		site.EPSG, geom, geom3d, geomShape, site.Altitude, site.Centroid,
+		site.Uncertainty_radius, precision, occupation,
+		di.CurrentSiteRange.Start_date1, di.CurrentSiteRange.Start_date2, di.CurrentSiteRange.End_date1, di.CurrentSiteRange.End_date2,
+		di.CurrentSiteRangeCharac.Charac_id, di.CurrentSiteRangeCharac.Exceptional, knowledgeType,
+		di.CurrentSiteRangeCharac.Bibliography, di.CurrentSiteRangeCharac.Comment, site.HasError}
+}
+
+// closeStaging flushes the lines copied into the staging table
+func (di *DatabaseImport) closeStaging() error {
+	if di.staging == nil {
+		if err := di.openStaging(); err != nil {
+			return err
+		}
+	}
+	_, err := di.staging.Exec()
+	if err == nil {
+		err = di.staging.Close()
+	}
+	di.staging = nil
+	if err != nil {
+		return errors.New("databaseimport::closeStaging: " + err.Error())
+	}
+	return nil
+}
+
+// importGeometryFunction parses an EWKT geometry, reprojected in srid if it is not NULL. It returns
+// NULL instead of failing, so the errors are reported line by line without aborting the transaction.
+const importGeometryFunction = `CREATE OR REPLACE FUNCTION pg_temp.import_geometry(ewkt text, srid integer) RETURNS geometry AS $f$
+BEGIN
+	IF srid IS NULL THEN
+		RETURN ST_GeomFromEWKT(ewkt);
+	END IF;
+	RETURN ST_Transform(ST_GeomFromEWKT(ewkt), srid);
+EXCEPTION WHEN others THEN
+	RETURN NULL;
+END
+$f$ LANGUAGE plpgsql`
+
+// checkStagingGeometries reprojects the staged geometries in WGS84. Lines which spatial reference is unknown,
+// which geometry can't be parsed, reprojected or is invalid, or which are out of the area of use of their
+// spatial reference are reported as errors, and their sites are left untouched by the merge.
+// It is run once the copy is closed, as no other query can be run in the transaction while copying.
+func (di *DatabaseImport) checkStagingGeometries() error {
+	epsgs := []int{}
+	err := di.Tx.Select(&epsgs, `SELECT DISTINCT epsg FROM import_staging WHERE NOT has_error AND epsg IS NOT NULL`)
+	if err != nil {
+		return errors.New("databaseimport::checkStagingGeometries: " + err.Error())
+	}
+
+	// Area in which the coordinates of each spatial reference are accepted, NULL if the spatial reference is unknown
+	_, err = di.Tx.Exec(`CREATE TEMPORARY TABLE import_srs (epsg integer, domain geometry) ON COMMIT DROP`)
+	for _, epsg := range epsgs {
+		if err != nil {
+			break
+		}
+		var srs *geo.SpatialRef
+		srs, err = geo.GetSpatialRef(di.Tx, epsg)
+		if err == geo.ErrUnknownEPSG {
+			_, err = di.Tx.Exec(`INSERT INTO import_srs (epsg) VALUES ($1)`, epsg)
+		} else if err == nil {
+			var west, south, east, north []float64
+			for _, b := range srs.AcceptedBounds() {
+				west, south, east, north = append(west, b.West), append(south, b.South), append(east, b.East), append(north, b.North)
+			}
+			_, err = di.Tx.Exec(`INSERT INTO import_srs (epsg, domain) SELECT $1, ST_Union(ST_MakeEnvelope(w, s, e, n, 4326)) FROM unnest($2::float8[], $3::float8[], $4::float8[], $5::float8[]) AS b(w, s, e, n)`,
+				epsg, pq.Array(west), pq.Array(south), pq.Array(east), pq.Array(north))
+		}
+	}
+	if err != nil {
+		return errors.New("databaseimport::checkStagingGeometries: " + err.Error())
+	}
+
+	// Each check only sets the error of the lines without error yet
+	const unchecked = ` AND NOT st.has_error AND st.geo_error IS NULL`
+	const pointError = `geo_error = $1, geo_columns = 'EPSG,LATITUDE,LONGITUDE', geo_value = st.geom`
+	const shapeError = `geo_error = $1, geo_columns = 'EPSG,GEOMETRY', geo_value = st.geom_shape`
+	queries := []struct {
+		q    string
+		args []interface{}
+	}{
+		{q: importGeometryFunction},
+		{q: `UPDATE import_staging st SET geo_error = $1, geo_columns = 'PROJECTION_SYSTEM', geo_value = st.epsg::text FROM import_srs srs WHERE srs.epsg = st.epsg AND srs.domain IS NULL` + unchecked, args: []interface{}{"IMPORT.CSVFIELD_PROJECTION_SYSTEM.T_CHECK_NOT_EXISTS"}},
+		{q: `UPDATE import_staging st SET geo_error = $1, geo_columns = 'GEOMETRY', geo_value = st.geom_shape WHERE st.geom_shape IS NOT NULL AND pg_temp.import_geometry(st.geom_shape, NULL) IS NULL` + unchecked, args: []interface{}{"IMPORT.CSVFIELD_GEOMETRY.T_CHECK_INCORRECT_VALUE"}},
+		{q: `UPDATE import_staging st SET g = pg_temp.import_geometry(st.geom, 4326), g_3d = pg_temp.import_geometry(st.geom_3d, 4326), g_shape = pg_temp.import_geometry(st.geom_shape, 4326) WHERE TRUE` + unchecked},
+		{q: `UPDATE import_staging st SET ` + pointError + ` WHERE (st.geom IS NOT NULL AND st.g IS NULL OR st.geom_3d IS NOT NULL AND st.g_3d IS NULL)` + unchecked, args: []interface{}{"IMPORT.CSVFIELD_GEO.T_ERROR_UNABLE_TO_TRANSFORM"}},
+		{q: `UPDATE import_staging st SET ` + shapeError + ` WHERE st.geom_shape IS NOT NULL AND st.g_shape IS NULL` + unchecked, args: []interface{}{"IMPORT.CSVFIELD_GEO.T_ERROR_UNABLE_TO_TRANSFORM"}},
+		{q: `UPDATE import_staging st SET geo_error = $1, geo_columns = 'GEOMETRY', geo_value = st.geom_shape WHERE NOT ST_IsValid(st.g_shape)` + unchecked, args: []interface{}{"IMPORT.CSVFIELD_GEOMETRY.T_CHECK_INVALID"}},
+		{q: `UPDATE import_staging st SET ` + pointError + ` FROM import_srs srs WHERE srs.epsg = st.epsg AND NOT ST_Covers(srs.domain, st.g)` + unchecked, args: []interface{}{"IMPORT.CSVFIELD_GEO.T_CHECK_OUT_OF_DOMAIN"}},
+		{q: `UPDATE import_staging st SET ` + shapeError + ` FROM import_srs srs WHERE srs.epsg = st.epsg AND NOT ST_Covers(srs.domain, ST_Centroid(st.g_shape))` + unchecked, args: []interface{}{"IMPORT.CSVFIELD_GEO.T_CHECK_OUT_OF_DOMAIN"}},
+	}
+	for _, query := range queries {
+		if _, err = di.Tx.Exec(query.q, query.args...); err != nil {
+			return errors.New("databaseimport::checkStagingGeometries: " + err.Error())
+		}
+	}
+
+	if err = di.reportStagingGeometriesErrors(); err != nil {
+		return err
+	}
+
+	_, err = di.Tx.Exec(`UPDATE import_staging SET has_error = true WHERE geo_error IS NOT NULL`)
+	if err == nil {
+		// The point of a site without coordinates is the centroid of its geometry
+		_, err = di.Tx.Exec(`UPDATE import_staging SET geom = ST_AsEWKT(COALESCE(g, ST_Centroid(g_shape))), geom_3d = ST_AsEWKT(g_3d), geom_shape = ST_AsEWKT(g_shape) WHERE NOT has_error`)
+	}
+	if err != nil {
+		return errors.New("databaseimport::checkStagingGeometries: " + err.Error())
+	}
+	return nil
+}
+
+// reportStagingGeometriesErrors adds the errors found by checkStagingGeometries to the errors of the import
+func (di *DatabaseImport) reportStagingGeometriesErrors() error {
+	rows, err := di.Tx.Queryx(`SELECT st.line, st.code, st.geo_error, st.geo_columns, COALESCE(st.geo_value, ''),
+		EXISTS (SELECT 1 FROM import_staging e WHERE e.code = st.code AND e.has_error)
+		FROM import_staging st WHERE st.geo_error IS NOT NULL ORDER BY st.line`)
+	if err != nil {
+		return errors.New("databaseimport::reportStagingGeometriesErrors: " + err.Error())
+	}
+	defer rows.Close()
+	counted := map[string]bool{}
+	for rows.Next() {
+		var line int
+		var code, errMsg, columns, value string
+		var siteHasError bool
+		if err = rows.Scan(&line, &code, &errMsg, &columns, &value, &siteHasError); err != nil {
+			return errors.New("databaseimport::reportStagingGeometriesErrors: " + err.Error())
+		}
+		di.addLineError(line, code, value, errMsg, strings.Split(columns, ",")...)
+		if !siteHasError && !counted[code] {
+			counted[code] = true
+			di.NumberOfSitesWithError++
+			if len(di.SitesWithError) < MaxErrors {
+				di.SitesWithError[code] = true
+			}
+		}
+	}
+	return rows.Err()
+}
+
+// siteColumns are the columns of the sites set by an import, and their value from the staging
+// table "ss". Both the update of the existing sites and the insert of the new ones use them.
+var siteColumns = []struct {
+	name  string
+	value string
+}{
+	{"name", "ss.name"},
+	{"city_name", "ss.city_name"},
+	{"city_geonameid", "ss.city_geonameid"},
+	{"geom", "ST_GeographyFromText(ss.geom)"},
+	{"geom_3d", "ST_GeographyFromText(ss.geom_3d)"},
+	{"geom_shape", "ST_GeographyFromText(ss.geom_shape)"},
+	{"altitude", "ss.altitude"},
+	{"centroid", "ss.centroid"},
+	{"uncertainty_radius", "ss.uncertainty_radius"},
+	{"precision_class", "ss.precision_class"},
+	{"occupation", "ss.occupation"},
+}
+
+// siteColumnsUpdate returns the SET list of the update of the sites from the staging table
+func siteColumnsUpdate() string {
+	set := []string{}
+	for _, c := range siteColumns {
+		set = append(set, c.name+" = "+c.value)
+	}
+	return strings.Join(set, ", ")
+}
+
+// siteColumnsInsert returns the columns and the values of the insert of the sites from the staging table
+func siteColumnsInsert() (string, string) {
+	names, values := []string{}, []string{}
+	for _, c := range siteColumns {
+		names = append(names, c.name)
+		values = append(values, c.value)
+	}
+	return strings.Join(names, ", "), strings.Join(values, ", ")
+}
+
+// stagedSiteFingerprint is the fingerprint of the staged site "ss", computed as model.SitesFingerprintsQuery
+// computes it once the site is saved, so both are equal if the import does not modify the site
+const stagedSiteFingerprint = "md5(concat_ws('|', ss.name, ss.city_name, ss.city_geonameid, ST_AsText(ST_GeographyFromText(ss.geom)), ST_AsText(ST_GeographyFromText(ss.geom_3d)), ST_AsText(ST_GeographyFromText(ss.geom_shape)), ss.centroid, ss.occupation, ss.uncertainty_radius, ss.precision_class, " +
+	"(SELECT string_agg(r.content, ';' ORDER BY r.content) FROM (SELECT concat_ws('|', st.start_date1, st.start_date2, st.end_date1, st.end_date2, st.charac_id, st.knowledge_type, st.exceptional, st.bibliography, st.comment) AS content FROM import_staging st WHERE st.code = ss.code) AS r)))"
+
+// mergeStaging merges the staged lines into the database. Sites are matched on their code, so sites
+// already in the database keep their id. Sites with errors or without changes are left untouched, and
+// sites which are not in the csv file anymore are deleted.
+func (di *DatabaseImport) mergeStaging() error {
+	insertColumns, insertValues := siteColumnsInsert()
+	queries := []struct {
+		q    string
+		args []interface{}
+	}{
+		{q: `CREATE INDEX ON import_staging (code)`},
+		{q: `ANALYZE import_staging`},
+		// State of the sites before the import, to count the changes
+		{q: `CREATE TEMPORARY TABLE import_site_fingerprint (code text, fingerprint text) ON COMMIT DROP`},
+		{q: `INSERT INTO import_site_fingerprint ` + model.SitesFingerprintsQuery, args: []interface{}{di.Database.Id}},
+		// First line of each site without error
+		{q: `CREATE TEMPORARY TABLE import_staging_site ON COMMIT DROP AS SELECT DISTINCT ON (code) * FROM import_staging st WHERE NOT EXISTS (SELECT 1 FROM import_staging e WHERE e.code = st.code AND e.has_error) ORDER BY code, line`},
+		{q: `CREATE INDEX ON import_staging_site (code)`},
+		// Unchanged sites are left untouched
+		{q: `DELETE FROM import_staging_site ss USING import_site_fingerprint f WHERE f.code = ss.code AND f.fingerprint = ` + stagedSiteFingerprint},
+		{q: `UPDATE site s SET ` + siteColumnsUpdate() + `, updated_at = now() FROM import_staging_site ss WHERE s.database_id = $1 AND s.code = ss.code`, args: []interface{}{di.Database.Id}},
+		{q: `INSERT INTO site (code, ` + insertColumns + `, database_id, created_at, updated_at) SELECT ss.code, ` + insertValues + `, $1::integer, now(), now() FROM import_staging_site ss WHERE NOT EXISTS (SELECT 1 FROM site s WHERE s.database_id = $1 AND s.code = ss.code) ORDER BY ss.line`, args: []interface{}{di.Database.Id}},
+		// Site ranges and characs of the imported sites are replaced
+		{q: `DELETE FROM site_range WHERE site_id IN (SELECT s.id FROM site s JOIN import_staging_site ss ON ss.code = s.code WHERE s.database_id = $1)`, args: []interface{}{di.Database.Id}},
+		{q: `INSERT INTO site_range (site_id, start_date1, start_date2, end_date1, end_date2, created_at, updated_at) SELECT DISTINCT s.id, st.start_date1, st.start_date2, st.end_date1, st.end_date2, now(), now() FROM import_staging st JOIN import_staging_site ss ON ss.code = st.code JOIN site s ON s.database_id = $1 AND s.code = st.code`, args: []interface{}{di.Database.Id}},
+		{q: `CREATE TEMPORARY TABLE import_staging_charac (id integer, site_range_id integer, charac_id integer, exceptional boolean, knowledge_type site_range__charac_knowledge_type, bibliography text, comment text) ON COMMIT DROP`},
+		{q: `INSERT INTO import_staging_charac SELECT nextval('site_range__charac_id_seq'), sr.id, st.charac_id, st.exceptional, st.knowledge_type, st.bibliography, st.comment FROM import_staging st JOIN import_staging_site ss ON ss.code = st.code JOIN site s ON s.database_id = $1 AND s.code = st.code JOIN site_range sr ON sr.site_id = s.id AND sr.start_date1 = st.start_date1 AND sr.start_date2 = st.start_date2 AND sr.end_date1 = st.end_date1 AND sr.end_date2 = st.end_date2 ORDER BY st.line`, args: []interface{}{di.Database.Id}},
+		{q: `INSERT INTO site_range__charac (id, site_range_id, charac_id, exceptional, knowledge_type) SELECT id, site_range_id, charac_id, exceptional, knowledge_type FROM import_staging_charac`},
+		{q: `INSERT INTO site_range__charac_tr (site_range__charac_id, lang_isocode, bibliography, comment) SELECT id, $1::char(2), bibliography, comment FROM import_staging_charac`, args: []interface{}{di.Database.Default_language}},
+		// Cache dates of the imported sites
+		{q: `UPDATE site s SET (start_date1, start_date2, end_date1, end_date2) = (SELECT min(start_date1), min(start_date2), max(end_date1), max(end_date2) FROM site_range WHERE site_id = s.id) FROM import_staging_site ss WHERE s.database_id = $1 AND s.code = ss.code`, args: []interface{}{di.Database.Id}},
+	}
+
+	for _, query := range queries {
+		if _, err := di.Tx.Exec(query.q, query.args...); err != nil {
+			return errors.New("databaseimport::mergeStaging: " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// deleteRemovedSites deletes the sites of the database which codes are not in the csv file
+func (di *DatabaseImport) deleteRemovedSites() error {
+	rows, err := di.Tx.Queryx(`DELETE FROM site s WHERE s.database_id = $1 AND NOT EXISTS (SELECT 1 FROM import_staging st WHERE st.code = s.code) RETURNING s.code`, di.Database.Id)
+	if err != nil {
+		return errors.New("databaseimport::deleteRemovedSites: " + err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var code string
+		if err = rows.Scan(&code); err != nil {
+			return errors.New("databaseimport::deleteRemovedSites: " + err.Error())
+		}
+		di.Changes.Deleted++
+		di.NumberOfWarnings++
+		if len(di.Warnings) < MaxErrors {
+			di.Warnings = append(di.Warnings, &ImportError{
+				SiteCode: code,
+				Columns:  []string{"SITE_SOURCE_ID"},
+				Value:    code,
+				ErrMsg:   translate.T(di.UserLang, "IMPORT.CSVFIELD_SITE_SOURCE_ID.T_WARNING_SITE_REMOVED"),
+			})
+		}
+	}
+	return rows.Err()
+}
+
+// computeChanges compares the sites of the database with their state before the import
+func (di *DatabaseImport) computeChanges() error {
+	err := di.Tx.QueryRowx(`SELECT
+		COALESCE(SUM(CASE WHEN b.code IS NULL THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN b.fingerprint != a.fingerprint THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN b.fingerprint = a.fingerprint THEN 1 ELSE 0 END), 0)
+		FROM (`+model.SitesFingerprintsQuery+`) a LEFT JOIN import_site_fingerprint b ON b.code = a.code`, di.Database.Id).Scan(&di.Changes.New, &di.Changes.Modified, &di.Changes.Unchanged)
+	if err != nil {
+		return errors.New("databaseimport::computeChanges: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package databaseimport
+
+import (
+	"testing"
+
+	"github.com/croll/arkeogis-server/model"
+	"github.com/croll/arkeogis-server/translate"
+)
+
+func TestStagingValuesGeometryOnlySite(t *testing.T) {
+	di := &DatabaseImport{
+		Parser:                 &Parser{Line: 2, Lang: "fr"},
+		CurrentSite:            &model.SiteInfos{},
+		CurrentSiteRange:       &model.Site_range{},
+		CurrentSiteRangeCharac: &SiteRangeCharacInfos{},
+		SitesWithError:         map[string]bool{},
+	}
+	di.CurrentSite.Code = "S1"
+
+	di.processSiteInfos(&Fields{
+		GEOMETRY:      "POLYGON((1 1,2 1,2 2,1 2,1 1))",
+		CITY_CENTROID: translate.T("fr", "IMPORT.CSVFIELD_ALL.T_LABEL_NO"),
+		OCCUPATION:    translate.T("fr", "IMPORT.CSVFIELD_OCCUPATION.T_LABEL_SINGLE"),
+	})
+	if len(di.Errors) > 0 {
+		t.Fatalf("unexpected error %s on %v", di.Errors[0].ErrMsg, di.Errors[0].Columns)
+	}
+
+	values := di.stagingValues()
+	if len(values) != len(stagingColumns) {
+		t.Fatalf("got %d values for %d columns", len(values), len(stagingColumns))
+	}
+	staged := map[string]interface{}{}
+	for i, column := range stagingColumns {
+		staged[column] = values[i]
+	}
+
+	// The point is computed from the shape when the import is saved, it must not be staged as an empty string
+	if staged["geom"] != nil {
+		t.Errorf("geom: got %#v, want nil", staged["geom"])
+	}
+	if staged["geom_3d"] != nil {
+		t.Errorf("geom_3d: got %#v, want nil", staged["geom_3d"])
+	}
+	if want := "SRID=4326;POLYGON((1 1,2 1,2 2,1 2,1 1))"; staged["geom_shape"] != want {
+		t.Errorf("geom_shape: got %#v, want %q", staged["geom_shape"], want)
+	}
+	if staged["epsg"] != 4326 {
+		t.Errorf("epsg: got %#v, want 4326", staged["epsg"])
+	}
+	if staged["has_error"] != false {
+		t.Errorf("has_error: got %#v, want false", staged["has_error"])
+	}
+}
@@ -111,6 +111,7 @@ func InteroperableExportXml(tx *sqlx.Tx, w io.Writer, databaseId int, lang strin
 		Xmlnsdc				string			`xml:"xmlns:dc,attr"`
 		Xmlnsdcterms		string			`xml:"xmlns:dcterms,attr"`
 		Xmlnsdcx		    string			`xml:"xmlns:dcx,attr"`
+		Xmlnsgeo		    string			`xml:"xmlns:geo,attr"`
 
 		DcTitle			    string			`xml:"dc:title"`
 		DcCreator			[]string		`xml:"dc:creator"`
@@ -130,7 +131,7 @@ func InteroperableExportXml(tx *sqlx.Tx, w io.Writer, databaseId int, lang strin
 		DcLanguage			XsiTyped		`xml:"dc:language"`
 		DcTermsConformsTo   []XsiTyped	    `xml:"dcterms:conformsTo"` // @TODO: check if this is ok
 		DcCoverage			[]XsiTyped		`xml:"dc:coverage"`
-		DcTermsSpatial		XsiTyped		`xml:"dcterms:spatial,omitempty"`
+		DcTermsSpatial		[]XsiTyped		`xml:"dcterms:spatial,omitempty"`
 		DcTermsTemporal		XsiTyped		`xml:"dcterms:temporal"`
 		DcRights			string			`xml:"dc:rights"`
 		DcTermsLicense		XsiTyped		`xml:"dcterms:license"`
@@ -159,6 +160,7 @@ func InteroperableExportXml(tx *sqlx.Tx, w io.Writer, databaseId int, lang strin
 	v.Xmlnsdc = "http://purl.org/dc/elements/1.1/"
 	v.Xmlnsdcterms = "http://purl.org/dc/terms/"
 	v.Xmlnsdcx = "http://purl.org/dc/xml/"
+	v.Xmlnsgeo = "http://www.opengis.net/ont/geosparql#"
 
 	v.DcTitle = dbInfos.Name
 	v.DcCreator = dbInfos.GetAuthorsStrings()
@@ -246,7 +248,16 @@ func InteroperableExportXml(tx *sqlx.Tx, w io.Writer, databaseId int, lang strin
 		eastlimit := fmt.Sprintf("%f", east)
 		southlimit := fmt.Sprintf("%f", south)
 		westlimit := fmt.Sprintf("%f", west)
-		v.DcTermsSpatial = XsiTyped{"northlimit="+northlimit+";eastlimit="+eastlimit+";southlimit="+southlimit+";westlimit="+westlimit+";projection=EPSG4326;", "dcterms:Box", ""}
+		v.DcTermsSpatial = append(v.DcTermsSpatial, XsiTyped{"northlimit="+northlimit+";eastlimit="+eastlimit+";southlimit="+southlimit+";westlimit="+westlimit+";projection=EPSG4326;", "dcterms:Box", ""})
+
+		// the same extent as WKT, sites may be polygons or lines
+		var wkt string
+		err = tx.Get(&wkt, "SELECT ST_AsText(geographical_extent_geom) FROM database WHERE id = $1", databaseId)
+		if err != nil {
+			log.Println("Error getting database extent as wkt", err)
+			return nil, err
+		}
+		v.DcTermsSpatial = append(v.DcTermsSpatial, XsiTyped{wkt, "geo:wktLiteral", ""})
 	}
 
 	v.DcTermsTemporal = XsiTyped{"start="+dcYear(dbInfos.Start_date)+";end="+dcYear(dbInfos.End_date)+";", "dcterms:Period", ""}
@@ -64,6 +64,7 @@ type MySite struct {
 	St_longitude3d float64					`json:"st_longitude3d"`
 	St_altitude    float64					`json:"st_altitude"`
 	St_altitude3d  float64					`json:"st_altitude3d"`
+	St_wkt         string					`json:"st_wkt"`
 }
 
 type MyDatabase struct {
@@ -300,6 +301,7 @@ func SitesAsOmeka(databaseId int, chronoId int, isoCode string, tx *sqlx.Tx) (si
 		"geolocation:zoom_level",
 		"geolocation:map_type",
 		"geolocation:address",
+		"Geometrie WKT",
 	})	
 
 	if err != nil {
@@ -338,6 +340,7 @@ func SitesAsOmeka(databaseId int, chronoId int, isoCode string, tx *sqlx.Tx) (si
 		"geolocation:zoom_level",
 		"geolocation:map_type",
 		"geolocation:address",
+		"Geometrie WKT",
 	})
 
 
@@ -351,9 +354,9 @@ func SitesAsOmeka(databaseId int, chronoId int, isoCode string, tx *sqlx.Tx) (si
 	FROM (
 	  SELECT *, 
 	  (
-		SELECT json_agg(items)
+		SELECT json_agg(to_jsonb(items) - 'search_tsv' - 'geom_shape')
 		FROM (
-		  SELECT s.*, ST_X(s.geom::geometry) as st_longitude, ST_Y(s.geom::geometry) as st_latitude, ST_X(s.geom_3d::geometry) as st_longitude3d, ST_Y(s.geom_3d::geometry) as st_latitude3d, ST_Z(s.geom_3d::geometry) as st_altitude3d, 
+		  SELECT s.*, ST_X(s.geom::geometry) as st_longitude, ST_Y(s.geom::geometry) as st_latitude, ST_X(s.geom_3d::geometry) as st_longitude3d, ST_Y(s.geom_3d::geometry) as st_latitude3d, ST_Z(s.geom_3d::geometry) as st_altitude3d, COALESCE(ST_AsText(s.geom_shape), '') as st_wkt, 
 		(
 		  SELECT json_agg(items)
 		  FROM (
@@ -917,6 +920,11 @@ func SitesAsOmeka(databaseId int, chronoId int, isoCode string, tx *sqlx.Tx) (si
 				// geolocation:address
 				//à créer mais laisser vide cf geolocation	
 				"",
+
+				// Geometrie WKT
+				// champs : GEOMETRY
+				// note : polygone ou ligne du site, export WGS84
+				site.St_wkt,
 			}
 			
 			err := wSites.Write(lineSite)
@@ -1102,6 +1110,11 @@ func SitesAsOmeka(databaseId int, chronoId int, isoCode string, tx *sqlx.Tx) (si
 						// geolocation:address
 						//à créer mais laisser vide cf geolocation	
 						"",
+
+						// Geometrie WKT
+						// champs : GEOMETRY
+						// note : polygone ou ligne du site, export WGS84
+						site.St_wkt,
 					}
 					
 					err := wCaracs.Write(lineCarac)
@@ -25,8 +25,10 @@ import (
 	"database/sql"
 	"errors"
 	"strconv"
+	"strings"
 
 	db "github.com/croll/arkeogis-server/db"
+	"github.com/jmoiron/sqlx"
 	// "github.com/lukeroth/gdal"
 )
 
@@ -95,3 +97,40 @@ func NewPointByGeonameID(geonameID int) (*Point, error) {
 
 	return point, nil
 }
+
+// TransformWKT returns the WKT geometry reprojected from the spatial reference from to the spatial reference to
+func TransformWKT(tx *sqlx.Tx, wkt string, from int, to int) (string, error) {
+	var res string
+	err := tx.Get(&res, "SELECT ST_AsText(ST_Transform(ST_GeomFromText($1, $2::integer), $3::integer))", wkt, from, to)
+	return res, err
+}
+
+// ErrShapeType is returned when a site geometry is not a polygon or a line
+var ErrShapeType = errors.New("Geometry must be a polygon or a line")
+
+// shapeTypes are the WKT types of the site geometries
+var shapeTypes = []string{"MULTIPOLYGON", "POLYGON", "MULTILINESTRING", "LINESTRING"}
+
+// Shape is a polygon or line geometry of a site
+type Shape struct {
+	EWKT string
+	Type string
+	EPSG int
+}
+
+// NewShapeFromWKT returns a Shape from a WKT polygon or line in the spatial reference epsg.
+// Only the type of the geometry is checked, its syntax and validity are checked by PostGIS.
+func NewShapeFromWKT(epsg int, wkt string) (*Shape, error) {
+	wkt = strings.TrimSpace(wkt)
+	upper := strings.ToUpper(wkt)
+	for _, t := range shapeTypes {
+		if strings.HasPrefix(upper, t) {
+			return &Shape{
+				EWKT: "SRID=" + strconv.Itoa(epsg) + ";" + wkt,
+				Type: t,
+				EPSG: epsg,
+			}, nil
+		}
+	}
+	return nil, ErrShapeType
+}
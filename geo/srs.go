@@ -0,0 +1,212 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Christophe Beveraggi <beve@croll.fr>
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package geo
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrUnknownEPSG is returned when an EPSG code is not in spatial_ref_sys
+var ErrUnknownEPSG = errors.New("Unknown EPSG")
+
+// DomainMargin is the margin, in degrees, around the area of use of a
+// projection in which coordinates are still accepted. Projections are
+// commonly used a bit outside of their official area.
+const DomainMargin = 1.0
+
+// Bounds is an area in WGS84 degrees
+type Bounds struct {
+	West  float64 `json:"west"`
+	South float64 `json:"south"`
+	East  float64 `json:"east"`
+	North float64 `json:"north"`
+}
+
+// SpatialRef is a spatial reference system of spatial_ref_sys
+type SpatialRef struct {
+	EPSG       int    `json:"epsg"`
+	Name       string `json:"name"`
+	Proj4      string `json:"proj4"`
+	Geographic bool   `json:"geographic"`
+	// Domain is the area of use, nil if unknown. There is no accuracy: it is
+	// a property of the transformations between datums, not of the spatial
+	// reference, and neither spatial_ref_sys nor postgis_srs give one.
+	Domain *Bounds `json:"domain"`
+}
+
+// AcceptedBounds returns the areas in which WGS84 coordinates are accepted for the spatial reference:
+// its area of use extended by DomainMargin, or the whole world when it is unknown. An area of use
+// crossing the antimeridian, which west is greater than its east, is split in two areas.
+func (s *SpatialRef) AcceptedBounds() []Bounds {
+	if s.Domain == nil {
+		return []Bounds{{-180, -90, 180, 90}}
+	}
+	south := math.Max(-90, s.Domain.South-DomainMargin)
+	north := math.Min(90, s.Domain.North+DomainMargin)
+	west := s.Domain.West - DomainMargin
+	east := s.Domain.East + DomainMargin
+	if s.Domain.West > s.Domain.East {
+		if west <= east {
+			// The margins join both sides of the antimeridian
+			return []Bounds{{-180, south, 180, north}}
+		}
+		return []Bounds{
+			{math.Max(-180, west), south, 180, north},
+			{-180, south, math.Min(180, east), north},
+		}
+	}
+	return []Bounds{{math.Max(-180, west), south, math.Min(180, east), north}}
+}
+
+var (
+	spatialRefs      = map[int]*SpatialRef{}
+	spatialRefsMutex sync.Mutex
+	srtextNameRegexp = regexp.MustCompile(`^[A-Z_]+\["([^"]*)"`)
+)
+
+// GetSpatialRef returns the spatial reference of an EPSG code, or
+// ErrUnknownEPSG if it is not in spatial_ref_sys
+func GetSpatialRef(tx *sqlx.Tx, epsg int) (*SpatialRef, error) {
+	spatialRefsMutex.Lock()
+	s, ok := spatialRefs[epsg]
+	spatialRefsMutex.Unlock()
+	if ok {
+		return s, nil
+	}
+
+	row := struct {
+		Srtext    string
+		Proj4text string
+	}{}
+	err := tx.Get(&row, "SELECT COALESCE(srtext, '') AS srtext, COALESCE(proj4text, '') AS proj4text FROM spatial_ref_sys WHERE srid = $1", epsg)
+	if err == sql.ErrNoRows {
+		return nil, ErrUnknownEPSG
+	} else if err != nil {
+		return nil, err
+	}
+
+	s = &SpatialRef{
+		EPSG:       epsg,
+		Proj4:      strings.TrimSpace(row.Proj4text),
+		Geographic: strings.HasPrefix(row.Srtext, "GEOGCS") || strings.Contains(row.Proj4text, "+proj=longlat"),
+	}
+	if m := srtextNameRegexp.FindStringSubmatch(row.Srtext); m != nil {
+		s.Name = m[1]
+	}
+
+	// The area of use is read from the PROJ database with postgis_srs, which is only available since PostGIS 3.4.
+	// Without it, the areas of use of the common spatial references are known from fallbackDomain
+	var hasSrs bool
+	err = tx.Get(&hasSrs, "SELECT to_regprocedure('postgis_srs(text, text)') IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	if hasSrs {
+		var b Bounds
+		err = tx.Get(&b, "SELECT ST_X(point_sw) AS west, ST_Y(point_sw) AS south, ST_X(point_ne) AS east, ST_Y(point_ne) AS north FROM postgis_srs('EPSG', $1::text) WHERE point_sw IS NOT NULL", epsg)
+		if err == nil {
+			s.Domain = &b
+		} else if err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+	if s.Domain == nil {
+		if b, ok := fallbackDomain(epsg); ok {
+			s.Domain = &b
+		}
+	}
+
+	spatialRefsMutex.Lock()
+	spatialRefs[epsg] = s
+	spatialRefsMutex.Unlock()
+	return s, nil
+}
+
+var (
+	boundsEurope = Bounds{-16.1, 32.88, 40.18, 84.73}
+	boundsFrance = Bounds{-9.86, 41.15, 10.38, 51.56}
+)
+
+// fallbackDomains are the areas of use of the spatial references commonly
+// used in archaeological inventories, from the EPSG registry (epsg.org)
+var fallbackDomains = map[int]Bounds{
+	4326:  {-180, -90, 180, 90},
+	3857:  {-180, -85.06, 180, 85.06},
+	4258:  boundsEurope,
+	3034:  boundsEurope,
+	3035:  boundsEurope,
+	4171:  boundsFrance,
+	2154:  boundsFrance,
+	27571: {-4.87, 48.15, 8.23, 51.14},
+	27572: {-4.87, 41.31, 9.63, 51.14},
+	27573: {-4.87, 42.33, 7.63, 46.17},
+	27574: {8.5, 41.31, 9.63, 43.07},
+	27561: {-4.87, 48.15, 8.23, 51.14},
+	27562: {-4.87, 45.44, 7.63, 48.15},
+	27563: {-4.87, 42.33, 7.63, 46.17},
+	27564: {8.5, 41.31, 9.63, 43.07},
+	27700: {-9.01, 49.75, 2.01, 61.01},
+	29902: {-10.56, 51.39, -5.34, 55.43},
+	2157:  {-10.56, 51.39, -5.34, 55.43},
+	2056:  {5.96, 45.82, 10.49, 47.81},
+	21781: {5.96, 45.82, 10.49, 47.81},
+	31466: {5.87, 49.1, 7.5, 53.75},
+	31467: {7.5, 47.27, 10.5, 55.09},
+	31468: {10.5, 47.27, 13.5, 55.09},
+	31469: {13.5, 46.0, 16.5, 54.74},
+	28992: {3.2, 50.75, 7.22, 53.7},
+	31370: {2.5, 49.5, 6.4, 51.51},
+	3812:  {2.5, 49.5, 6.4, 51.51},
+	3003:  {6.62, 36.59, 12.0, 47.1},
+	3004:  {12.0, 36.59, 18.99, 47.1},
+	2100:  {19.57, 34.88, 28.3, 41.75},
+}
+
+// fallbackDomain returns the area of use of an EPSG code when postgis_srs
+// does not give it, from fallbackDomains, or computed for the UTM zones
+func fallbackDomain(epsg int) (Bounds, bool) {
+	if b, ok := fallbackDomains[epsg]; ok {
+		return b, true
+	}
+	utm := func(zone int, south, north float64) Bounds {
+		west := float64(-180 + 6*(zone-1))
+		return Bounds{west, south, west + 6, north}
+	}
+	switch {
+	case epsg >= 32601 && epsg <= 32660: // WGS 84 / UTM north
+		return utm(epsg-32600, 0, 84), true
+	case epsg >= 32701 && epsg <= 32760: // WGS 84 / UTM south
+		return utm(epsg-32700, -80, 0), true
+	case epsg >= 25828 && epsg <= 25838: // ETRS89 / UTM
+		return utm(epsg-25800, 34, 84), true
+	case epsg >= 23028 && epsg <= 23038: // ED50 / UTM
+		return utm(epsg-23000, 34, 84), true
+	}
+	return Bounds{}, false
+}
@@ -0,0 +1,47 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package geo
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAcceptedBounds(t *testing.T) {
+	tests := []struct {
+		name   string
+		domain *Bounds
+		want   []Bounds
+	}{
+		{"unknown", nil, []Bounds{{-180, -90, 180, 90}}},
+		{"france", &Bounds{-9.86, 41.15, 10.38, 51.56}, []Bounds{{-10.86, 40.15, 11.38, 52.56}}},
+		{"clipped to the world", &Bounds{-180, -90, 180, 90}, []Bounds{{-180, -90, 180, 90}}},
+		{"antimeridian", &Bounds{160, -60, -150, 10}, []Bounds{{159, -61, 180, 11}, {-180, -61, -149, 11}}},
+		{"antimeridian joined by the margins", &Bounds{-178.5, -10, -179.5, 10}, []Bounds{{-180, -11, 180, 11}}},
+	}
+	for _, test := range tests {
+		s := SpatialRef{Domain: test.domain}
+		if got := s.AcceptedBounds(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
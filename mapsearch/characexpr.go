@@ -0,0 +1,137 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mapsearch
+
+import (
+	"strconv"
+
+	"github.com/croll/arkeogis-server/webserver/sanitizer"
+)
+
+// Maximum nesting of a charac expression
+const characExprMaxDepth = 8
+
+// ParamsCharacExpr is a node of a boolean expression on characs.
+// Op "charac" is a leaf matching sites having the charac CharacId, "and", "or"
+// and "not" are groups of Children ("not" negates the AND of its children).
+// When SameSiteRange is set on a group, all the characs of the group must be
+// found in the same site_range.
+type ParamsCharacExpr struct {
+	Op            string             `json:"op" enum:",and,or,not,charac" error:"MAP.FIELD_CHARACS_EXPR_OP.T_CHECK_INCORRECT"`
+	Children      []ParamsCharacExpr `json:"children"`
+	CharacId      int                `json:"charac_id"`
+	Exceptional   bool               `json:"exceptional"`
+	SameSiteRange bool               `json:"same_site_range"`
+}
+
+// characExprCompiler keeps the state of the compilation of a charac expression
+type characExprCompiler struct {
+	args    []interface{}
+	errors  []sanitizer.FieldError
+	nbAlias int
+}
+
+func (c *characExprCompiler) alias(prefix string) string {
+	c.nbAlias++
+	return prefix + "_" + strconv.Itoa(c.nbAlias)
+}
+
+func (c *characExprCompiler) error(path string, name string, errorstring string) string {
+	c.errors = append(c.errors, sanitizer.FieldError{
+		FieldPath:   path,
+		FieldName:   name,
+		ErrorString: errorstring,
+	})
+	return "false"
+}
+
+// compile returns the sql condition of the node e. rangeas is the alias of
+// the site_range the node is scoped to, or empty if it is not scoped.
+func (c *characExprCompiler) compile(e *ParamsCharacExpr, rangeas string, path string, depth int) string {
+	if depth > characExprMaxDepth {
+		return c.error(path, "children", "MAP.FIELD_CHARACS_EXPR.T_CHECK_TOO_DEEP")
+	}
+
+	if e.Op == "charac" {
+		if e.CharacId <= 0 {
+			return c.error(path+".charac_id", "charac_id", "MAP.FIELD_CHARACS_EXPR_CHARAC_ID.T_CHECK_INCORRECT")
+		}
+		c.args = append(c.args, e.CharacId)
+		src := c.alias("src")
+		cond := src + ".charac_id = $$"
+		if e.Exceptional {
+			cond += " AND " + src + ".exceptional = true"
+		}
+		if rangeas != "" {
+			return `EXISTS (SELECT 1 FROM site_range__charac ` + src + ` WHERE ` + src + `.site_range_id = ` + rangeas + `.id AND ` + cond + `)`
+		}
+		sr := c.alias("sr")
+		return `EXISTS (SELECT 1 FROM site_range ` + sr + ` JOIN site_range__charac ` + src + ` ON ` + src + `.site_range_id = ` + sr + `.id WHERE ` + sr + `.site_id = "site".id AND ` + cond + `)`
+	}
+
+	if e.Op != "and" && e.Op != "or" && e.Op != "not" {
+		return c.error(path+".op", "op", "MAP.FIELD_CHARACS_EXPR_OP.T_CHECK_INCORRECT")
+	}
+	if len(e.Children) == 0 {
+		return c.error(path+".children", "children", "MAP.FIELD_CHARACS_EXPR_CHILDREN.T_CHECK_MANDATORY")
+	}
+
+	// a scoped group is tested against each site_range of the site
+	scoped := e.SameSiteRange && rangeas == ""
+	if scoped {
+		rangeas = c.alias("sr")
+	}
+
+	sep := " AND "
+	if e.Op == "or" {
+		sep = " OR "
+	}
+	q := ""
+	for i := range e.Children {
+		if i > 0 {
+			q += sep
+		}
+		q += "(" + c.compile(&e.Children[i], rangeas, path+".children[]", depth+1) + ")"
+	}
+	if e.Op == "not" {
+		q = "NOT (" + q + ")"
+	}
+
+	if scoped {
+		q = `EXISTS (SELECT 1 FROM site_range ` + rangeas + ` WHERE ` + rangeas + `.site_id = "site".id AND ` + q + `)`
+	}
+	return q
+}
+
+// compileCharacExpr add the filter of the charac expression, if any
+func compileCharacExpr(filters *MapSqlQuery, params *Params) []sanitizer.FieldError {
+	if params.CharacsExpr.Op == "" {
+		return nil
+	}
+	c := characExprCompiler{}
+	q := c.compile(&params.CharacsExpr, "", "json.characs_expr", 0)
+	if len(c.errors) > 0 {
+		return c.errors
+	}
+	filters.AddFilter("site", q, c.args...)
+	return nil
+}
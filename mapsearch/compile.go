@@ -0,0 +1,422 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mapsearch
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/croll/arkeogis-server/webserver/sanitizer"
+)
+
+// Values accepted in the "others" filters
+var (
+	knowledgeTypes = []string{"literature", "surveyed", "dig", "not_documented", "prospected_aerial", "prospected_pedestrian"}
+	occupations    = []string{"not_documented", "single", "continuous", "multiple"}
+	textSearchIns  = []string{"site_name", "city_name", "bibliography", "comment"}
+	precisions     = []string{"exact", "approximate", "commune", "region"}
+)
+
+// Compile build the sql query filters of a map search. Every value coming from
+// the params is given as a query argument or is an integer. If params are
+// invalid, the errors are returned and the query is nil.
+func Compile(params *Params) (*MapSqlQuery, []sanitizer.FieldError) {
+	errors := sanitizer.SanitizeStruct(params, "json")
+	errors = append(errors, checkSet(params.Others.Knowledges, knowledgeTypes, "json.others.knowledges", "knowledges", "MAP.FIELD_KNOWLEDGES.T_CHECK_INCORRECT")...)
+	errors = append(errors, checkSet(params.Others.Occupation, occupations, "json.others.occupation", "occupation", "MAP.FIELD_OCCUPATION.T_CHECK_INCORRECT")...)
+	errors = append(errors, checkSet(params.Others.TextSearchIn, textSearchIns, "json.others.text_search_in", "text_search_in", "MAP.FIELD_TEXT_SEARCH_IN.T_CHECK_INCORRECT")...)
+	errors = append(errors, checkSet(params.Others.Precisions, precisions, "json.others.precisions", "precisions", "MAP.FIELD_PRECISIONS.T_CHECK_INCORRECT")...)
+	if params.Area.Type == "buffer" && params.Area.ShapefileFeatureId == 0 && len(params.Area.Geojson.Geometry) == 0 {
+		errors = append(errors, sanitizer.FieldError{
+			FieldPath:   "json.area.geojson",
+			FieldName:   "geojson",
+			ErrorString: "MAP.FIELD_AREA_GEOJSON.T_CHECK_MANDATORY",
+		})
+	}
+	if len(errors) > 0 {
+		return nil, errors
+	}
+
+	filters := MapSqlQuery{}
+	filters.Init()
+
+	// custom hard coded / mandatory filters
+	filters.AddTable(&MapSqlDefSite, "site", false)
+	filters.AddTable(&MapSqlDefDatabase, "database", false)
+	filters.AddFilter("database", `"database".published = true`)
+
+	// add database filter
+	filters.AddFilter("database", `"site".database_id IN (`+intJoin(params.Database)+`)`)
+
+	compileArea(&filters, params)
+	compileOthers(&filters, params)
+	compileCharacs(&filters, params)
+	compileChronologies(&filters, params)
+
+	errors = compileCharacExpr(&filters, params)
+	if len(errors) > 0 {
+		return nil, errors
+	}
+
+	return &filters, nil
+}
+
+// checkSet returns an error if one of the values is not in the allowed list
+func checkSet(values []string, allowed []string, path string, name string, errorstring string) []sanitizer.FieldError {
+	for _, value := range values {
+		if !inSet(value, allowed) {
+			return []sanitizer.FieldError{{
+				FieldPath:   path,
+				FieldName:   name,
+				ErrorString: errorstring,
+			}}
+		}
+	}
+	return nil
+}
+
+func inSet(value string, set []string) bool {
+	for _, v := range set {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// intJoin returns the comma separated list of ids, or -1 if there is none.
+// It is model.IntJoin, mapsearch doesn't import model so it can be used
+// without a database connection.
+func intJoin(ids []int) string {
+	if len(ids) == 0 {
+		return "-1"
+	}
+	str := ""
+	for i, id := range ids {
+		if i > 0 {
+			str += ","
+		}
+		str += strconv.Itoa(id)
+	}
+	return str
+}
+
+// placeholders returns one $$ placeholder per value, and the values as query arguments
+func placeholders(values []string) (string, []interface{}) {
+	str := ""
+	args := []interface{}{}
+	for i, value := range values {
+		if i > 0 {
+			str += ","
+		}
+		str += "$$"
+		args = append(args, value)
+	}
+	return str, args
+}
+
+func compileArea(filters *MapSqlQuery, params *Params) {
+	if params.Area.Type == "disc" || params.Area.Type == "custom" {
+		compileAreaDistance(filters, params, `Geography(ST_MakePoint($$, $$))`,
+			[]interface{}{params.Area.Lng, params.Area.Lat}, params.Area.Radius)
+	} else if params.Area.Type == "buffer" && params.Area.ShapefileFeatureId > 0 {
+		compileAreaDistance(filters, params, `(SELECT f.geom FROM shapefile_feature f JOIN shapefile sh ON sh.id = f.shapefile_id WHERE f.id = $$ AND sh.published = true)`,
+			[]interface{}{params.Area.ShapefileFeatureId}, params.Area.Buffer)
+	} else if params.Area.Type == "buffer" {
+		compileAreaDistance(filters, params, `ST_SetSRID(ST_GeomFromGeoJSON($$),4326)::geography`,
+			[]interface{}{params.Area.Geojson.Geometry}, params.Area.Buffer)
+	} else {
+		switch params.Area.Uncertainty {
+		case "potentially":
+			filters.AddFilter("site", `ST_DWithin("site".geom, ST_SetSRID(ST_GeomFromGeoJSON($$),4326)::geography, "site".uncertainty_radius)`,
+				params.Area.Geojson.Geometry)
+		case "certainly":
+			filters.AddFilter("site", `ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($$),4326)) AND NOT ST_DWithin("site".geom, ST_Boundary(ST_SetSRID(ST_GeomFromGeoJSON($$),4326))::geography, "site".uncertainty_radius)`,
+				params.Area.Geojson.Geometry, params.Area.Geojson.Geometry)
+		default:
+			filters.AddFilter("site", `ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($$),4326))`,
+				params.Area.Geojson.Geometry)
+		}
+	}
+}
+
+// compileAreaDistance add a filter on sites within distance metres of the
+// area, and on their uncertainty radius
+func compileAreaDistance(filters *MapSqlQuery, params *Params, area string, areaArgs []interface{}, distance float32) {
+	switch params.Area.Uncertainty {
+	case "potentially":
+		args := append(areaArgs, distance)
+		filters.AddFilter("site", `ST_DWithin("site".geom, `+area+`, $$ + "site".uncertainty_radius)`, args...)
+	case "certainly":
+		args := append([]interface{}{distance}, areaArgs...)
+		args = append(args, distance)
+		filters.AddFilter("site", `"site".uncertainty_radius <= $$ AND ST_DWithin("site".geom, `+area+`, $$ - "site".uncertainty_radius)`, args...)
+	default:
+		args := append(areaArgs, distance)
+		filters.AddFilter("site", `ST_DWithin("site".geom, `+area+`, $$)`, args...)
+	}
+}
+
+func compileOthers(filters *MapSqlQuery, params *Params) {
+	// add centroid filter
+	switch params.Others.Centroid {
+	case "with":
+		filters.AddFilter("site", `"site".centroid = true`)
+	case "without":
+		filters.AddFilter("site", `"site".centroid = false`)
+	case "":
+		// do not filter
+	}
+
+	// add knowledge filter
+	if len(params.Others.Knowledges) > 0 {
+		str, args := placeholders(params.Others.Knowledges)
+		filters.AddTable(&MapSqlDefSiteRange, `site_range`, false)
+		filters.AddTable(&MapSqlDefSiteRangeCharac, `site_range__charac`, false)
+		filters.AddFilter("site_range__charac", `"site_range__charac".knowledge_type IN (`+str+`)`, args...)
+	}
+
+	// add occupation filter
+	if len(params.Others.Occupation) > 0 {
+		str, args := placeholders(params.Others.Occupation)
+		filters.AddFilter("site", `"site".occupation IN (`+str+`)`, args...)
+	}
+
+	// add precision filters
+	if len(params.Others.Precisions) > 0 {
+		str, args := placeholders(params.Others.Precisions)
+		filters.AddFilter("site", `"site".precision_class IN (`+str+`)`, args...)
+	}
+	if params.Others.MaxUncertainty > 0 {
+		filters.AddFilter("site", `"site".uncertainty_radius <= $$`, params.Others.MaxUncertainty)
+	}
+
+	// text filter
+	if params.Others.TextSearch != "" && params.Others.TextSearchMode != "" {
+		compileFullText(filters, params)
+	} else if params.Others.TextSearch != "" {
+		str := "1=0"
+		args := []interface{}{}
+		for _, textSearchIn := range params.Others.TextSearchIn {
+			switch textSearchIn {
+			case "site_name":
+				args = append(args, "%"+params.Others.TextSearch+"%")
+				str += ` OR "site".name ILIKE $$`
+			case "city_name":
+				args = append(args, "%"+params.Others.TextSearch+"%")
+				str += ` OR "site".city_name ILIKE $$`
+			case "bibliography":
+				args = append(args, "%"+params.Others.TextSearch+"%")
+				filters.AddTable(&MapSqlDefSiteRange, `site_range`, false)
+				filters.AddTable(&MapSqlDefSiteRangeCharac, `site_range__charac`, false)
+				filters.AddTable(&MapSqlDefSiteRangeCharacTr, `site_range__charac_tr`, false)
+				str += ` OR "site_range__charac_tr".bibliography ILIKE $$`
+			case "comment":
+				args = append(args, "%"+params.Others.TextSearch+"%")
+				filters.AddTable(&MapSqlDefSiteRange, `site_range`, false)
+				filters.AddTable(&MapSqlDefSiteRangeCharac, `site_range__charac`, false)
+				filters.AddTable(&MapSqlDefSiteRangeCharacTr, `site_range__charac_tr`, false)
+				str += ` OR "site_range__charac_tr".comment ILIKE $$`
+			}
+		}
+		if str != "1=0" {
+			filters.AddFilter("site", str, args...)
+		}
+	}
+}
+
+// sortedKeys returns the keys of a map of charac ids, sorted, so generated sql is always the same
+func sortedKeys(m map[int][]int) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+func compileCharacs(filters *MapSqlQuery, params *Params) {
+	includes := make(map[int][]int, 0)
+	excludes := make(map[int][]int, 0)
+	exceptionals := make(map[int][]int, 0)
+
+	characids := make([]int, 0, len(params.Characs))
+	for characid := range params.Characs {
+		characids = append(characids, characid)
+	}
+	sort.Ints(characids)
+
+	for _, characid := range characids {
+		sel := params.Characs[characid]
+		if sel.Include && !sel.Exceptional {
+			includes[sel.RootId] = append(includes[sel.RootId], characid)
+		} else if sel.Include && sel.Exceptional {
+			exceptionals[sel.RootId] = append(exceptionals[sel.RootId], characid)
+		} else if !sel.Include {
+			excludes[sel.RootId] = append(excludes[sel.RootId], characid)
+		}
+	}
+
+	if params.Others.CharacsLinked == "all" {
+		for _, rootid := range sortedKeys(includes) {
+			tableas := "site_range__charac_" + strconv.Itoa(rootid)
+			filters.AddTable(&MapSqlDefSiteRange, "site_range", false)
+			filters.AddTable(&MapSqlDefSiteRangeCharac, tableas, false)
+			filters.AddFilter(tableas, tableas+`.charac_id IN (`+intJoin(includes[rootid])+`)`)
+		}
+
+		for _, rootid := range sortedKeys(exceptionals) {
+			tableas := "site_range__charac_" + strconv.Itoa(rootid)
+			filters.AddTable(&MapSqlDefSiteRange, "site_range", false)
+			filters.AddTable(&MapSqlDefSiteRangeCharac, tableas, false)
+
+			q := "1=0"
+			for _, characid := range exceptionals[rootid] {
+				q += " OR " + tableas + ".charac_id = " + strconv.Itoa(characid) + " AND " + tableas + ".exceptional = true"
+			}
+
+			filters.AddFilter(tableas, q)
+		}
+
+		for _, rootid := range sortedKeys(excludes) {
+			tableas := "x_site_range__charac_" + strconv.Itoa(rootid)
+			filters.AddTable(&MapSqlDefSiteRange, "site_range", false)
+			filters.AddTable(&MapSqlDefSiteRangeCharac, tableas, true)
+			filters.AddFilter(tableas, tableas+".charac_id IN ("+intJoin(excludes[rootid])+")")
+		}
+
+	} else if params.Others.CharacsLinked == "at-least-one" { // default
+		s_includes := []int{}
+		s_excludes := []int{}
+		s_exceptionals := []int{}
+
+		for _, rootid := range sortedKeys(includes) {
+			s_includes = append(s_includes, includes[rootid]...)
+		}
+		for _, rootid := range sortedKeys(excludes) {
+			s_excludes = append(s_excludes, excludes[rootid]...)
+		}
+		for _, rootid := range sortedKeys(exceptionals) {
+			s_exceptionals = append(s_exceptionals, exceptionals[rootid]...)
+		}
+
+		if len(s_includes) > 0 {
+			filters.AddTable(&MapSqlDefSiteRange, "site_range", false)
+			filters.AddTable(&MapSqlDefSiteRangeCharac, "site_range__charac", false)
+			filters.AddFilter("site_range__charac", `site_range__charac.charac_id IN (`+intJoin(s_includes)+`)`)
+		}
+
+		if len(s_excludes) > 0 {
+			filters.AddTable(&MapSqlDefSiteRange, "site_range", false)
+			filters.AddTable(&MapSqlDefSiteRangeCharac, "x_site_range__charac", true)
+			filters.AddFilter("x_site_range__charac", `x_site_range__charac.charac_id IN (`+intJoin(s_excludes)+`)`)
+		}
+
+		if len(s_exceptionals) > 0 {
+			filters.AddTable(&MapSqlDefSiteRange, "site_range", false)
+			filters.AddTable(&MapSqlDefSiteRangeCharac, "site_range__charac", false)
+			q := "1=0"
+			for _, characid := range s_exceptionals {
+				q += " OR site_range__charac.charac_id = " + strconv.Itoa(characid) + " AND site_range__charac.exceptional = true"
+			}
+			filters.AddFilter("site_range__charac", q)
+		}
+	}
+}
+
+func compileChronologies(filters *MapSqlQuery, params *Params) {
+	for _, chronology := range params.Chronologies {
+
+		q := "1=1"
+		args := []interface{}{}
+
+		// each call add the date as a query argument
+		start_date := func() string {
+			args = append(args, chronology.StartDate)
+			return "$$"
+		}
+		end_date := func() string {
+			args = append(args, chronology.EndDate)
+			return "$$"
+		}
+
+		tblname := "site"
+		if chronology.ExistenceInsideInclude == "-" {
+			tblname = "x_site"
+		}
+
+		switch chronology.ExistenceInsideSureness {
+		case "potentially":
+			q += " AND " + tblname + ".start_date1 <= " + end_date() + " AND " + tblname + ".end_date2 >= " + start_date()
+			if chronology.ExistenceInsidePart == "full" {
+				q += " AND " + tblname + ".start_date1 >= " + start_date() + " AND " + tblname + ".end_date2 <= " + end_date()
+			}
+		case "certainly":
+			q += " AND " + tblname + ".start_date2 <= " + end_date() + " AND " + tblname + ".end_date1 >= " + start_date()
+			if chronology.ExistenceInsidePart == "full" {
+				q += " AND " + tblname + ".start_date2 >= " + start_date() + " AND " + tblname + ".end_date1 <= " + end_date()
+			}
+		case "potentially-only":
+			q += " AND " + tblname + ".start_date1 <= " + end_date() + " AND " + tblname + ".end_date2 >= " + start_date()
+			q += " AND " + tblname + ".start_date2 > " + end_date() + " AND " + tblname + ".end_date1 < " + start_date()
+
+			if chronology.ExistenceInsidePart == "full" {
+				q += " AND " + tblname + ".start_date1 >= " + start_date() + " AND " + tblname + ".end_date2 <= " + end_date()
+			}
+		}
+
+		switch chronology.ExistenceOutsideInclude {
+		case "": // it can
+			// do nothing
+		case "+": // it must
+			switch chronology.ExistenceOutsideSureness {
+			case "potentially":
+				q += " AND (" + tblname + ".start_date2 < " + start_date() + " OR " + tblname + ".end_date1 >= " + end_date() + ")"
+			case "certainly":
+				q += " AND (" + tblname + ".start_date1 < " + start_date() + " OR " + tblname + ".end_date1 >= " + end_date() + ")"
+			case "potentially-only":
+				q += " AND (" + tblname + ".start_date2 < " + start_date() + " AND " + tblname + ".start_date1 >= " + start_date()
+				q += " OR " + tblname + ".end_date1 > " + end_date() + " AND " + tblname + ".end_date2 <= " + end_date() + ")"
+			}
+
+		case "-": // it must not
+			switch chronology.ExistenceOutsideSureness {
+			case "potentially":
+				q += " AND NOT (" + tblname + ".start_date2 < " + start_date() + " OR " + tblname + ".end_date1 >= " + end_date() + ")"
+			case "certainly":
+				q += " AND NOT (" + tblname + ".start_date1 < " + start_date() + " OR " + tblname + ".end_date1 >= " + end_date() + ")"
+			case "potentially-only":
+				q += " AND NOT (" + tblname + ".start_date2 < " + start_date() + " AND " + tblname + ".start_date1 >= " + start_date()
+				q += " OR " + tblname + ".end_date1 > " + end_date() + " AND " + tblname + ".end_date2 <= " + end_date() + ")"
+			}
+		}
+
+		if q != "1=1" {
+			if chronology.ExistenceInsideInclude == "+" {
+				filters.AddFilter("site", q, args...)
+			} else if chronology.ExistenceInsideInclude == "-" {
+				filters.AddTable(&MapSqlDefXSite, "x_site", true)
+				filters.AddFilter("x_site", q, args...)
+			}
+		}
+	}
+}
@@ -0,0 +1,292 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mapsearch
+
+import (
+	"reflect"
+	"testing"
+
+	sqlx_types "github.com/jmoiron/sqlx/types"
+)
+
+var polygon = sqlx_types.JSONText(`{"type":"Polygon","coordinates":[[[7,48],[8,48],[8,49],[7,48]]]}`)
+
+// compileTests are the golden sql queries generated for each filter, and
+// for a combination of them
+var compileTests = []struct {
+	name   string
+	params Params
+	sql    string
+	args   []interface{}
+}{
+	{
+		name:   "databases",
+		params: Params{Database: []int{1, 2}},
+		sql:    `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" WHERE 1=1 AND (ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($1),4326))) AND ("database".published = true) AND ("site".database_id IN (1,2)) GROUP BY site.id`,
+		args:   []interface{}{sqlx_types.JSONText(nil)},
+	},
+	{
+		name:   "no database",
+		params: Params{},
+		sql:    `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" WHERE 1=1 AND (ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($1),4326))) AND ("database".published = true) AND ("site".database_id IN (-1)) GROUP BY site.id`,
+		args:   []interface{}{sqlx_types.JSONText(nil)},
+	},
+	{
+		name:   "area disc",
+		params: Params{Database: []int{1}, Area: ParamsArea{Type: "disc", Lng: 7.5, Lat: 48.25, Radius: 1000}},
+		sql:    `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" WHERE 1=1 AND (ST_DWithin("site".geom, Geography(ST_MakePoint($1, $2)), $3)) AND ("database".published = true) AND ("site".database_id IN (1)) GROUP BY site.id`,
+		args:   []interface{}{float32(7.5), float32(48.25), float32(1000)},
+	},
+	{
+		name:   "area polygon",
+		params: Params{Database: []int{1}, Area: ParamsArea{Type: "polygon", Geojson: ParamsAreaGeometry{Geometry: polygon}}},
+		sql:    `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" WHERE 1=1 AND (ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($1),4326))) AND ("database".published = true) AND ("site".database_id IN (1)) GROUP BY site.id`,
+		args:   []interface{}{polygon},
+	},
+	{
+		name:   "area polygon certainly",
+		params: Params{Database: []int{1}, Area: ParamsArea{Type: "polygon", Geojson: ParamsAreaGeometry{Geometry: polygon}, Uncertainty: "certainly"}},
+		sql:    `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" WHERE 1=1 AND (ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($1),4326)) AND NOT ST_DWithin("site".geom, ST_Boundary(ST_SetSRID(ST_GeomFromGeoJSON($2),4326))::geography, "site".uncertainty_radius)) AND ("database".published = true) AND ("site".database_id IN (1)) GROUP BY site.id`,
+		args:   []interface{}{polygon, polygon},
+	},
+	{
+		name:   "area buffer potentially",
+		params: Params{Database: []int{1}, Area: ParamsArea{Type: "buffer", Geojson: ParamsAreaGeometry{Geometry: polygon}, Buffer: 500, Uncertainty: "potentially"}},
+		sql:    `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" WHERE 1=1 AND (ST_DWithin("site".geom, ST_SetSRID(ST_GeomFromGeoJSON($1),4326)::geography, $2 + "site".uncertainty_radius)) AND ("database".published = true) AND ("site".database_id IN (1)) GROUP BY site.id`,
+		args:   []interface{}{polygon, float32(500)},
+	},
+	{
+		name:   "area buffer shapefile feature",
+		params: Params{Database: []int{1}, Area: ParamsArea{Type: "buffer", ShapefileFeatureId: 12, Buffer: 500}},
+		sql:    `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" WHERE 1=1 AND (ST_DWithin("site".geom, (SELECT f.geom FROM shapefile_feature f JOIN shapefile sh ON sh.id = f.shapefile_id WHERE f.id = $1 AND sh.published = true), $2)) AND ("database".published = true) AND ("site".database_id IN (1)) GROUP BY site.id`,
+		args:   []interface{}{12, float32(500)},
+	},
+	{
+		name:   "centroid with",
+		params: Params{Database: []int{1}, Others: ParamsOthers{Centroid: "with"}},
+		sql:    `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" WHERE 1=1 AND (ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($1),4326))) AND ("site".centroid = true) AND ("database".published = true) AND ("site".database_id IN (1)) GROUP BY site.id`,
+		args:   []interface{}{sqlx_types.JSONText(nil)},
+	},
+	{
+		name:   "centroid without",
+		params: Params{Database: []int{1}, Others: ParamsOthers{Centroid: "without"}},
+		sql:    `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" WHERE 1=1 AND (ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($1),4326))) AND ("site".centroid = false) AND ("database".published = true) AND ("site".database_id IN (1)) GROUP BY site.id`,
+		args:   []interface{}{sqlx_types.JSONText(nil)},
+	},
+	{
+		name:   "knowledges",
+		params: Params{Database: []int{1}, Others: ParamsOthers{Knowledges: []string{"dig", "surveyed"}}},
+		sql:    `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" LEFT JOIN "site_range" AS "site_range" ON "site"."id" = "site_range"."site_id" LEFT JOIN "site_range__charac" AS "site_range__charac" ON "site_range"."id" = "site_range__charac"."site_range_id" WHERE 1=1 AND (ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($1),4326))) AND ("database".published = true) AND ("site".database_id IN (1)) AND ("site_range__charac".knowledge_type IN ($2,$3)) GROUP BY site.id`,
+		args:   []interface{}{sqlx_types.JSONText(nil), "dig", "surveyed"},
+	},
+	{
+		name:   "occupation",
+		params: Params{Database: []int{1}, Others: ParamsOthers{Occupation: []string{"single", "multiple"}}},
+		sql:    `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" WHERE 1=1 AND (ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($1),4326))) AND ("site".occupation IN ($2,$3)) AND ("database".published = true) AND ("site".database_id IN (1)) GROUP BY site.id`,
+		args:   []interface{}{sqlx_types.JSONText(nil), "single", "multiple"},
+	},
+	{
+		name:   "precisions",
+		params: Params{Database: []int{1}, Others: ParamsOthers{Precisions: []string{"exact"}, MaxUncertainty: 100}},
+		sql:    `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" WHERE 1=1 AND (ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($1),4326))) AND ("site".precision_class IN ($2)) AND ("site".uncertainty_radius <= $3) AND ("database".published = true) AND ("site".database_id IN (1)) GROUP BY site.id`,
+		args:   []interface{}{sqlx_types.JSONText(nil), "exact", float32(100)},
+	},
+	{
+		name:   "chronology inside",
+		params: Params{Database: []int{1}, Chronologies: []ParamsChronology{{StartDate: -800, EndDate: -450, ExistenceInsideInclude: "+", ExistenceInsideSureness: "potentially", ExistenceInsidePart: "full"}}},
+		sql:    `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" WHERE 1=1 AND (ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($1),4326))) AND (1=1 AND site.start_date1 <= $2 AND site.end_date2 >= $3 AND site.start_date1 >= $4 AND site.end_date2 <= $5) AND ("database".published = true) AND ("site".database_id IN (1)) GROUP BY site.id`,
+		args:   []interface{}{sqlx_types.JSONText(nil), -450, -800, -800, -450},
+	},
+	{
+		name:   "chronology outside",
+		params: Params{Database: []int{1}, Chronologies: []ParamsChronology{{StartDate: -800, EndDate: -450, ExistenceInsideInclude: "+", ExistenceInsideSureness: "certainly", ExistenceOutsideInclude: "-", ExistenceOutsideSureness: "potentially"}}},
+		sql:    `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" WHERE 1=1 AND (ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($1),4326))) AND (1=1 AND site.start_date2 <= $2 AND site.end_date1 >= $3 AND NOT (site.start_date2 < $4 OR site.end_date1 >= $5)) AND ("database".published = true) AND ("site".database_id IN (1)) GROUP BY site.id`,
+		args:   []interface{}{sqlx_types.JSONText(nil), -450, -800, -800, -450},
+	},
+	{
+		name:   "chronology exclude",
+		params: Params{Database: []int{1}, Chronologies: []ParamsChronology{{StartDate: -800, EndDate: -450, ExistenceInsideInclude: "-", ExistenceInsideSureness: "potentially-only"}}},
+		sql:    `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" LEFT JOIN "site" AS "x_site" ON "site"."id" = "x_site"."id" AND (1=1 AND x_site.start_date1 <= $1 AND x_site.end_date2 >= $2 AND x_site.start_date2 > $3 AND x_site.end_date1 < $4) WHERE 1=1 AND (ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($5),4326))) AND ("database".published = true) AND ("site".database_id IN (1)) AND "x_site".id IS NULL GROUP BY site.id`,
+		args:   []interface{}{-450, -800, -450, -800, sqlx_types.JSONText(nil)},
+	},
+	{
+		name: "characs all",
+		params: Params{
+			Database: []int{1},
+			Others:   ParamsOthers{CharacsLinked: "all"},
+			Characs: map[int]ParamsCharac{
+				11: {Include: true, RootId: 10},
+				12: {Include: true, RootId: 10},
+				21: {Include: true, Exceptional: true, RootId: 20},
+				31: {Include: false, RootId: 30},
+			},
+		},
+		sql:  `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" LEFT JOIN "site_range" AS "site_range" ON "site"."id" = "site_range"."site_id" LEFT JOIN "site_range__charac" AS "site_range__charac_10" ON "site_range"."id" = "site_range__charac_10"."site_range_id" LEFT JOIN "site_range__charac" AS "site_range__charac_20" ON "site_range"."id" = "site_range__charac_20"."site_range_id" LEFT JOIN "site_range__charac" AS "x_site_range__charac_30" ON "site_range"."id" = "x_site_range__charac_30"."site_range_id" AND (x_site_range__charac_30.charac_id IN (31)) WHERE 1=1 AND (ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($1),4326))) AND ("database".published = true) AND ("site".database_id IN (1)) AND (site_range__charac_10.charac_id IN (11,12)) AND (1=0 OR site_range__charac_20.charac_id = 21 AND site_range__charac_20.exceptional = true) AND "x_site_range__charac_30".id IS NULL GROUP BY site.id`,
+		args: []interface{}{sqlx_types.JSONText(nil)},
+	},
+	{
+		name: "characs at least one",
+		params: Params{
+			Database: []int{1},
+			Others:   ParamsOthers{CharacsLinked: "at-least-one"},
+			Characs: map[int]ParamsCharac{
+				11: {Include: true, RootId: 10},
+				21: {Include: true, Exceptional: true, RootId: 20},
+				31: {Include: false, RootId: 30},
+				32: {Include: false, RootId: 30},
+			},
+		},
+		sql:  `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" LEFT JOIN "site_range" AS "site_range" ON "site"."id" = "site_range"."site_id" LEFT JOIN "site_range__charac" AS "site_range__charac" ON "site_range"."id" = "site_range__charac"."site_range_id" LEFT JOIN "site_range__charac" AS "x_site_range__charac" ON "site_range"."id" = "x_site_range__charac"."site_range_id" AND (x_site_range__charac.charac_id IN (31,32)) WHERE 1=1 AND (ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($1),4326))) AND ("database".published = true) AND ("site".database_id IN (1)) AND (site_range__charac.charac_id IN (11)) AND (1=0 OR site_range__charac.charac_id = 21 AND site_range__charac.exceptional = true) AND "x_site_range__charac".id IS NULL GROUP BY site.id`,
+		args: []interface{}{sqlx_types.JSONText(nil)},
+	},
+	{
+		name: "characs expr",
+		params: Params{
+			Database: []int{1},
+			CharacsExpr: ParamsCharacExpr{Op: "or", Children: []ParamsCharacExpr{
+				{Op: "charac", CharacId: 11},
+				{Op: "and", SameSiteRange: true, Children: []ParamsCharacExpr{
+					{Op: "charac", CharacId: 21, Exceptional: true},
+					{Op: "not", Children: []ParamsCharacExpr{{Op: "charac", CharacId: 31}}},
+				}},
+			}},
+		},
+		sql:  `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" WHERE 1=1 AND (ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($1),4326))) AND ((EXISTS (SELECT 1 FROM site_range sr_2 JOIN site_range__charac src_1 ON src_1.site_range_id = sr_2.id WHERE sr_2.site_id = "site".id AND src_1.charac_id = $2)) OR (EXISTS (SELECT 1 FROM site_range sr_3 WHERE sr_3.site_id = "site".id AND (EXISTS (SELECT 1 FROM site_range__charac src_4 WHERE src_4.site_range_id = sr_3.id AND src_4.charac_id = $3 AND src_4.exceptional = true)) AND (NOT ((EXISTS (SELECT 1 FROM site_range__charac src_5 WHERE src_5.site_range_id = sr_3.id AND src_5.charac_id = $4))))))) AND ("database".published = true) AND ("site".database_id IN (1)) GROUP BY site.id`,
+		args: []interface{}{sqlx_types.JSONText(nil), 11, 21, 31},
+	},
+	{
+		name:   "text search",
+		params: Params{Database: []int{1}, Others: ParamsOthers{TextSearch: "oppidum", TextSearchIn: []string{"site_name", "city_name", "bibliography", "comment"}}},
+		sql:    `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" LEFT JOIN "site_range" AS "site_range" ON "site"."id" = "site_range"."site_id" LEFT JOIN "site_range__charac" AS "site_range__charac" ON "site_range"."id" = "site_range__charac"."site_range_id" LEFT JOIN "site_range__charac_tr" AS "site_range__charac_tr" ON "site_range__charac"."id" = "site_range__charac_tr"."site_range__charac_id" AND "database"."default_language" = "site_range__charac_tr"."lang_isocode" WHERE 1=1 AND (ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($1),4326))) AND (1=0 OR "site".name ILIKE $2 OR "site".city_name ILIKE $3 OR "site_range__charac_tr".bibliography ILIKE $4 OR "site_range__charac_tr".comment ILIKE $5) AND ("database".published = true) AND ("site".database_id IN (1)) GROUP BY site.id`,
+		args:   []interface{}{sqlx_types.JSONText(nil), "%oppidum%", "%oppidum%", "%oppidum%", "%oppidum%"},
+	},
+	{
+		name:   "full text search",
+		params: Params{Database: []int{1}, Others: ParamsOthers{TextSearch: "oppidum celte", TextSearchMode: "words"}},
+		sql:    `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" WHERE 1=1 AND (ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($1),4326))) AND (1=0 OR "site".search_tsv @@ to_tsquery((CASE "database".default_language WHEN 'da' THEN 'danish' WHEN 'de' THEN 'german' WHEN 'en' THEN 'english' WHEN 'es' THEN 'spanish' WHEN 'fi' THEN 'finnish' WHEN 'fr' THEN 'french' WHEN 'hu' THEN 'hungarian' WHEN 'it' THEN 'italian' WHEN 'nl' THEN 'dutch' WHEN 'no' THEN 'norwegian' WHEN 'pt' THEN 'portuguese' WHEN 'ro' THEN 'romanian' WHEN 'ru' THEN 'russian' WHEN 'sv' THEN 'swedish' WHEN 'tr' THEN 'turkish' ELSE 'simple' END)::regconfig, unaccent($2))) AND ("database".published = true) AND ("site".database_id IN (1)) GROUP BY site.id`,
+		args:   []interface{}{sqlx_types.JSONText(nil), "oppidum & celte"},
+	},
+	{
+		name:   "full text search prefix in",
+		params: Params{Database: []int{1}, Others: ParamsOthers{TextSearch: "oppi, celt", TextSearchMode: "prefix", TextSearchIn: []string{"site_name", "city_name"}}},
+		sql:    `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" WHERE 1=1 AND (ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($1),4326))) AND (1=0 OR "site".search_tsv @@ to_tsquery((CASE "database".default_language WHEN 'da' THEN 'danish' WHEN 'de' THEN 'german' WHEN 'en' THEN 'english' WHEN 'es' THEN 'spanish' WHEN 'fi' THEN 'finnish' WHEN 'fr' THEN 'french' WHEN 'hu' THEN 'hungarian' WHEN 'it' THEN 'italian' WHEN 'nl' THEN 'dutch' WHEN 'no' THEN 'norwegian' WHEN 'pt' THEN 'portuguese' WHEN 'ro' THEN 'romanian' WHEN 'ru' THEN 'russian' WHEN 'sv' THEN 'swedish' WHEN 'tr' THEN 'turkish' ELSE 'simple' END)::regconfig, unaccent($2)) OR "site".city_name ILIKE $3) AND ("database".published = true) AND ("site".database_id IN (1)) GROUP BY site.id`,
+		args:   []interface{}{sqlx_types.JSONText(nil), "oppi:*AB & celt:*AB", "%oppi, celt%"},
+	},
+	{
+		name:   "full text search phrase in comment",
+		params: Params{Database: []int{1}, Others: ParamsOthers{TextSearch: "oppidum celte", TextSearchMode: "phrase", TextSearchIn: []string{"comment"}}},
+		sql:    `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" WHERE 1=1 AND (ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($1),4326))) AND (1=0 OR "site".search_tsv @@ to_tsquery((CASE "database".default_language WHEN 'da' THEN 'danish' WHEN 'de' THEN 'german' WHEN 'en' THEN 'english' WHEN 'es' THEN 'spanish' WHEN 'fi' THEN 'finnish' WHEN 'fr' THEN 'french' WHEN 'hu' THEN 'hungarian' WHEN 'it' THEN 'italian' WHEN 'nl' THEN 'dutch' WHEN 'no' THEN 'norwegian' WHEN 'pt' THEN 'portuguese' WHEN 'ro' THEN 'romanian' WHEN 'ru' THEN 'russian' WHEN 'sv' THEN 'swedish' WHEN 'tr' THEN 'turkish' ELSE 'simple' END)::regconfig, unaccent($2))) AND ("database".published = true) AND ("site".database_id IN (1)) GROUP BY site.id`,
+		args:   []interface{}{sqlx_types.JSONText(nil), "oppidum:C <-> celte:C"},
+	},
+	{
+		name:   "full text search without word",
+		params: Params{Database: []int{1}, Others: ParamsOthers{TextSearch: "?!", TextSearchMode: "words"}},
+		sql:    `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" WHERE 1=1 AND (ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($1),4326))) AND (1=0) AND ("database".published = true) AND ("site".database_id IN (1)) GROUP BY site.id`,
+		args:   []interface{}{sqlx_types.JSONText(nil)},
+	},
+	{
+		name: "combination",
+		params: Params{
+			Database: []int{1, 2},
+			Area:     ParamsArea{Type: "disc", Lng: 7.5, Lat: 48.25, Radius: 1000},
+			Others: ParamsOthers{
+				Occupation:    []string{"continuous"},
+				Knowledges:    []string{"dig"},
+				CharacsLinked: "at-least-one",
+				TextSearch:    "oppidum",
+				TextSearchIn:  []string{"site_name"},
+			},
+			Characs: map[int]ParamsCharac{
+				11: {Include: true, RootId: 10},
+				31: {Include: false, RootId: 30},
+			},
+			Chronologies: []ParamsChronology{
+				{StartDate: -800, EndDate: -450, ExistenceInsideInclude: "+", ExistenceInsideSureness: "potentially"},
+				{StartDate: 1, EndDate: 500, ExistenceInsideInclude: "-", ExistenceInsideSureness: "certainly"},
+			},
+		},
+		sql:  `SELECT "site"."id" FROM "site" AS "site"   LEFT JOIN "database" AS "database" ON "site"."database_id" = "database"."id" LEFT JOIN "site_range" AS "site_range" ON "site"."id" = "site_range"."site_id" LEFT JOIN "site_range__charac" AS "site_range__charac" ON "site_range"."id" = "site_range__charac"."site_range_id" LEFT JOIN "site_range__charac" AS "x_site_range__charac" ON "site_range"."id" = "x_site_range__charac"."site_range_id" AND (x_site_range__charac.charac_id IN (31)) LEFT JOIN "site" AS "x_site" ON "site"."id" = "x_site"."id" AND (1=1 AND x_site.start_date2 <= $1 AND x_site.end_date1 >= $2) WHERE 1=1 AND (ST_DWithin("site".geom, Geography(ST_MakePoint($3, $4)), $5)) AND ("site".occupation IN ($6)) AND (1=0 OR "site".name ILIKE $7) AND (1=1 AND site.start_date1 <= $8 AND site.end_date2 >= $9) AND ("database".published = true) AND ("site".database_id IN (1,2)) AND ("site_range__charac".knowledge_type IN ($10)) AND (site_range__charac.charac_id IN (11)) AND "x_site_range__charac".id IS NULL AND "x_site".id IS NULL GROUP BY site.id`,
+		args: []interface{}{500, 1, float32(7.5), float32(48.25), float32(1000), "continuous", "%oppidum%", -450, -800, "dig"},
+	},
+}
+
+func TestCompile(t *testing.T) {
+	for _, test := range compileTests {
+		filters, errors := Compile(&test.params)
+		if len(errors) > 0 {
+			t.Errorf("%s: unexpected errors %v", test.name, errors)
+			continue
+		}
+		sql, args, err := filters.BuildQuery()
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if sql != test.sql {
+			t.Errorf("%s: sql is\n%s\nwant\n%s", test.name, sql, test.sql)
+		}
+		if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%s: args are %#v, want %#v", test.name, args, test.args)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		params Params
+		path   string
+	}{
+		{"knowledge", Params{Others: ParamsOthers{Knowledges: []string{"dig", "dig'"}}}, "json.others.knowledges"},
+		{"occupation", Params{Others: ParamsOthers{Occupation: []string{"single); --"}}}, "json.others.occupation"},
+		{"text search in", Params{Others: ParamsOthers{TextSearch: "a", TextSearchIn: []string{"code"}}}, "json.others.text_search_in"},
+		{"precision", Params{Others: ParamsOthers{Precisions: []string{"nearby"}}}, "json.others.precisions"},
+		{"buffer without geometry", Params{Area: ParamsArea{Type: "buffer", Buffer: 10}}, "json.area.geojson"},
+		{"charac expr without children", Params{CharacsExpr: ParamsCharacExpr{Op: "and"}}, "json.characs_expr.children"},
+		{"charac expr charac id", Params{CharacsExpr: ParamsCharacExpr{Op: "or", Children: []ParamsCharacExpr{{Op: "charac"}}}}, "json.characs_expr.children[].charac_id"},
+	}
+	for _, test := range tests {
+		filters, errors := Compile(&test.params)
+		if filters != nil || len(errors) != 1 || errors[0].FieldPath != test.path {
+			t.Errorf("%s: got %v, want an error on %s", test.name, errors, test.path)
+		}
+	}
+}
+
+func TestBuildQueryUnknownTable(t *testing.T) {
+	filters := MapSqlQuery{}
+	filters.Init()
+	filters.AddTable(&MapSqlDefSite, "site", false)
+	if err := filters.AddFilter("site_range", "1=1"); err == nil {
+		t.Error("AddFilter on an unknown table must fail")
+	}
+	if _, _, err := filters.BuildQuery(); err == nil {
+		t.Error("BuildQuery must return the error of AddFilter")
+	}
+}
+
+func TestNumberArgs(t *testing.T) {
+	got := NumberArgs("a = $$ AND b IN ($$,$$)", 3)
+	if want := "a = $3 AND b IN ($4,$5)"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,164 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mapsearch
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// tsConfigs are the postgresql text search configurations of the langs
+var tsConfigs = map[string]string{
+	"da": "danish",
+	"de": "german",
+	"en": "english",
+	"es": "spanish",
+	"fi": "finnish",
+	"fr": "french",
+	"hu": "hungarian",
+	"it": "italian",
+	"nl": "dutch",
+	"no": "norwegian",
+	"pt": "portuguese",
+	"ro": "romanian",
+	"ru": "russian",
+	"sv": "swedish",
+	"tr": "turkish",
+}
+
+// TsConfig returns the sql expression of the text search configuration of the lang isocode expression langexpr
+func TsConfig(langexpr string) string {
+	isocodes := make([]string, 0, len(tsConfigs))
+	for isocode := range tsConfigs {
+		isocodes = append(isocodes, isocode)
+	}
+	sort.Strings(isocodes)
+
+	q := "(CASE " + langexpr
+	for _, isocode := range isocodes {
+		q += " WHEN '" + isocode + "' THEN '" + tsConfigs[isocode] + "'"
+	}
+	return q + " ELSE 'simple' END)::regconfig"
+}
+
+// weights of the text search document (see model.Database.CacheTextSearch) for each "text search in" value
+var textSearchWeights = map[string]string{
+	"site_name":    "AB",
+	"comment":      "C",
+	"bibliography": "D",
+}
+
+// tsQueryText returns the text of the tsquery of the search, every word being
+// restricted to the weights. Only letters and numbers are kept from the
+// search, so it can't contain any tsquery operator.
+func tsQueryText(params *Params, weights string) string {
+	words := strings.FieldsFunc(params.Others.TextSearch, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	if len(words) == 0 {
+		return ""
+	}
+	label := ""
+	if weights != "" || params.Others.TextSearchMode == "prefix" {
+		label = ":"
+		if params.Others.TextSearchMode == "prefix" {
+			label += "*"
+		}
+		label += weights
+	}
+	op := " & "
+	if params.Others.TextSearchMode == "phrase" {
+		op = " <-> "
+	}
+	return strings.Join(words, label+op) + label
+}
+
+// tsQuery returns the sql tsquery of the search text, parsed with the text
+// search configuration of the default language of the database of the site,
+// given by the sql expression langexpr, as the text search document is. As
+// the query depends on the site, the text search index is only used through
+// the other filters. Accents are removed from the search as they are from the
+// text search document.
+func tsQuery(text string, langexpr string) (string, []interface{}) {
+	return `to_tsquery(` + TsConfig(langexpr) + `, unaccent($$))`, []interface{}{text}
+}
+
+// fullTextIn returns the weights of the text search document to search in
+// (empty for all of them), if the document is searched, and if the city name
+// is searched, as it is not in the text search document
+func fullTextIn(params *Params) (weights string, doc bool, city bool) {
+	if len(params.Others.TextSearchIn) == 0 {
+		return "", true, false
+	}
+	all := ""
+	for _, textSearchIn := range params.Others.TextSearchIn {
+		if textSearchIn == "city_name" {
+			city = true
+		}
+		all += textSearchWeights[textSearchIn]
+	}
+	for _, weight := range "ABCD" {
+		if strings.ContainsRune(all, weight) {
+			weights += string(weight)
+		}
+	}
+	doc = weights != ""
+	if weights == "ABCD" {
+		weights = ""
+	}
+	return
+}
+
+// compileFullText add the full text search filter
+func compileFullText(filters *MapSqlQuery, params *Params) {
+	weights, doc, city := fullTextIn(params)
+
+	q := "1=0"
+	args := []interface{}{}
+	if text := tsQueryText(params, weights); doc && text != "" {
+		tsq, tsqArgs := tsQuery(text, `"database".default_language`)
+		q += ` OR "site".search_tsv @@ ` + tsq
+		args = append(args, tsqArgs...)
+	}
+	if city {
+		q += ` OR "site".city_name ILIKE $$`
+		args = append(args, "%"+params.Others.TextSearch+"%")
+	}
+	filters.AddFilter("site", q, args...)
+}
+
+// RankExpr returns the sql expression of the relevance of a site for the full
+// text search, where "s" is the site table, or an empty string if there is no
+// full text search.
+func RankExpr(params *Params) (string, []interface{}) {
+	if params.Others.TextSearchMode == "" {
+		return "", nil
+	}
+	weights, doc, _ := fullTextIn(params)
+	text := tsQueryText(params, weights)
+	if !doc || text == "" {
+		return "", nil
+	}
+	tsq, args := tsQuery(text, `(SELECT default_language FROM "database" WHERE id = s.database_id)`)
+	return `ts_rank(s.search_tsv, ` + tsq + `)`, args
+}
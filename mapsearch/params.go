@@ -0,0 +1,88 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mapsearch
+
+import (
+	sqlx_types "github.com/jmoiron/sqlx/types"
+)
+
+type ParamsOthers struct {
+	Centroid       string   `json:"centroid" enum:",with,without" error:"MAP.FIELD_CENTROID.T_CHECK_INCORRECT"`
+	CharacsLinked  string   `json:"characs_linked" enum:",all,at-least-one" error:"MAP.FIELD_CHARACS_LINKED.T_CHECK_INCORRECT"`
+	Knowledges     []string `json:"knowledges"`
+	Occupation     []string `json:"occupation"`
+	TextSearch     string   `json:"text_search"`
+	TextSearchIn   []string `json:"text_search_in"`
+	TextSearchMode string   `json:"text_search_mode" enum:",words,phrase,prefix" error:"MAP.FIELD_TEXT_SEARCH_MODE.T_CHECK_INCORRECT"`
+	Precisions     []string `json:"precisions"`
+	MaxUncertainty float32  `json:"max_uncertainty" min:"0" error:"MAP.FIELD_MAX_UNCERTAINTY.T_CHECK_INCORRECT"`
+}
+
+type ParamsAreaGeometry struct {
+	Geometry sqlx_types.JSONText `json:"geometry"`
+}
+
+// ParamsArea is the area where sites are searched. With type "buffer", sites
+// are searched within Buffer metres of the Geojson geometry (of any type), or
+// of the feature ShapefileFeatureId of a published shapefile.
+// Uncertainty tells how the uncertainty radius of sites is used : with
+// "potentially", sites whose uncertainty disc touches the area are found,
+// with "certainly", only sites whose uncertainty disc is inside the area.
+type ParamsArea struct {
+	Type               string             `json:"type"`
+	Lat                float32            `json:"lat"`
+	Lng                float32            `json:"lng"`
+	Radius             float32            `json:"radius"`
+	Geojson            ParamsAreaGeometry `json:"geojson"`
+	Buffer             float32            `json:"buffer" min:"0" error:"MAP.FIELD_AREA_BUFFER.T_CHECK_INCORRECT"`
+	ShapefileFeatureId int                `json:"shapefile_feature_id" min:"0" error:"MAP.FIELD_AREA_SHAPEFILE_FEATURE_ID.T_CHECK_INCORRECT"`
+	Uncertainty        string             `json:"uncertainty" enum:",potentially,certainly" error:"MAP.FIELD_AREA_UNCERTAINTY.T_CHECK_INCORRECT"`
+}
+
+type ParamsCharac struct {
+	Include     bool `json:"include"`
+	Exceptional bool `json:"exceptional"`
+	RootId      int  `json:"root_id"`
+}
+
+type ParamsChronology struct {
+	StartDate                int    `json:"start_date"`
+	EndDate                  int    `json:"end_date"`
+	ExistenceInsideInclude   string `json:"existence_inside_include" enum:"+,-" error:"MAP.FIELD_EXISTENCE_INSIDE_INCLUDE.T_CHECK_INCORRECT"`
+	ExistenceInsidePart      string `json:"existence_inside_part"`
+	ExistenceInsideSureness  string `json:"existence_inside_sureness" enum:",potentially,certainly,potentially-only" error:"MAP.FIELD_EXISTENCE_INSIDE_SURENESS.T_CHECK_INCORRECT"`
+	ExistenceOutsideInclude  string `json:"existence_outside_include" enum:",+,-" error:"MAP.FIELD_EXISTENCE_OUTSIDE_INCLUDE.T_CHECK_INCORRECT"`
+	ExistenceOutsideSureness string `json:"existence_outside_sureness" enum:",potentially,certainly,potentially-only" error:"MAP.FIELD_EXISTENCE_OUTSIDE_SURENESS.T_CHECK_INCORRECT"`
+	SelectedChronologyId     int    `json:"selected_chronology_id"`
+}
+
+// Params is the query filter for searching sites
+type Params struct {
+	Knowledge    map[string]bool      `json:"knowledge"`
+	Occupation   map[string]bool      `json:"occupation"`
+	Database     []int                `json:"database"`
+	Chronologies []ParamsChronology   `json:"chronologies"`
+	Characs      map[int]ParamsCharac `json:"characs"`
+	Others       ParamsOthers         `json:"others"`
+	Area         ParamsArea           `json:"area"`
+	CharacsExpr  ParamsCharacExpr     `json:"characs_expr"`
+}
@@ -0,0 +1,259 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package mapsearch compiles the map search parameters into sql queries
+package mapsearch
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+type MapSqlJoin struct {
+	JoinLeftTable  string
+	JoinLeftKey    string
+	JoinRightTable string
+	JoinRightKey   string
+}
+
+type MapSqlTableDef struct {
+	TableName string
+	Joins     []MapSqlJoin
+}
+
+var MapSqlDefSite = MapSqlTableDef{
+	TableName: "site",
+	Joins:     []MapSqlJoin{},
+}
+
+var MapSqlDefXSite = MapSqlTableDef{
+	TableName: "site",
+	Joins: []MapSqlJoin{
+		{
+			JoinLeftTable:  "site",
+			JoinLeftKey:    "id",
+			JoinRightTable: "site",
+			JoinRightKey:   "id",
+		},
+	},
+}
+
+var MapSqlDefDatabase = MapSqlTableDef{
+	TableName: "database",
+	Joins: []MapSqlJoin{
+		{
+			JoinLeftTable:  "site",
+			JoinLeftKey:    "database_id",
+			JoinRightTable: "database",
+			JoinRightKey:   "id",
+		},
+	},
+}
+
+var MapSqlDefSiteRange = MapSqlTableDef{
+	TableName: "site_range",
+	Joins: []MapSqlJoin{
+		{
+			JoinLeftTable:  "site",
+			JoinLeftKey:    "id",
+			JoinRightTable: "site_range",
+			JoinRightKey:   "site_id",
+		},
+	},
+}
+
+var MapSqlDefSiteRangeCharac = MapSqlTableDef{
+	TableName: "site_range__charac",
+	Joins: []MapSqlJoin{
+		{
+			JoinLeftTable:  "site_range",
+			JoinLeftKey:    "id",
+			JoinRightTable: "site_range__charac",
+			JoinRightKey:   "site_range_id",
+		},
+	},
+}
+
+var MapSqlDefSiteRangeCharacTr = MapSqlTableDef{
+	TableName: "site_range__charac_tr",
+	Joins: []MapSqlJoin{
+		{
+			JoinLeftTable:  "site_range__charac",
+			JoinLeftKey:    "id",
+			JoinRightTable: "site_range__charac_tr",
+			JoinRightKey:   "site_range__charac_id",
+		},
+		{
+			JoinLeftTable:  "database",
+			JoinLeftKey:    "default_language",
+			JoinRightTable: "site_range__charac_tr",
+			JoinRightKey:   "lang_isocode",
+		},
+	},
+}
+
+type MapSqlQueryTable struct {
+	TableDef       *MapSqlTableDef
+	As             string
+	UsedForExclude bool
+}
+
+type MapSqlQueryWhere struct {
+	Table *MapSqlQueryTable
+	Where string
+	Args  []interface{}
+}
+
+type MapSqlQuery struct {
+	Tables []*MapSqlQueryTable
+	Wheres []*MapSqlQueryWhere
+	err    error // first error of AddFilter, returned by BuildQuery
+}
+
+func (sql *MapSqlQuery) Init() {
+	sql.Tables = make([]*MapSqlQueryTable, 0)
+	sql.Wheres = make([]*MapSqlQueryWhere, 0)
+}
+
+func (sql *MapSqlQuery) AddTable(tabledef *MapSqlTableDef, as string, usedforexclude bool) {
+	for _, t := range sql.Tables {
+		if t.TableDef == tabledef && t.As == as && t.UsedForExclude == usedforexclude {
+			return // don't add any table, we already have one
+		}
+	}
+
+	t := MapSqlQueryTable{
+		TableDef:       tabledef,
+		As:             as,
+		UsedForExclude: usedforexclude,
+	}
+
+	sql.Tables = append(sql.Tables, &t)
+}
+
+func (sql *MapSqlQuery) FindTable(tableas string, trymebefore *MapSqlQueryTable) (table *MapSqlQueryTable, ok bool) {
+	if trymebefore != nil && (trymebefore.As == tableas || trymebefore.TableDef.TableName == tableas) {
+		return trymebefore, true
+	}
+	for _, t := range sql.Tables {
+		if t.As == tableas {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// AddFilter add a where clause on the table tableas. The error is also
+// kept, and returned by BuildQuery.
+func (sql *MapSqlQuery) AddFilter(tableas string, where string, args ...interface{}) error {
+	table, ok := sql.FindTable(tableas, nil)
+	if !ok {
+		err := errors.New("mapsearch: add filter on an unknown table " + tableas)
+		if sql.err == nil {
+			sql.err = err
+		}
+		return err
+	}
+	sql.Wheres = append(sql.Wheres, &MapSqlQueryWhere{
+		Table: table,
+		Where: where,
+		Args:  args,
+	})
+	return nil
+}
+
+// BuildQuery returns the sql query selecting the ids of the sites matching the filters, and its arguments
+func (sql *MapSqlQuery) BuildQuery() (string, []interface{}, error) {
+	if sql.err != nil {
+		return "", nil, sql.err
+	}
+
+	q := ""
+	joins_str := ""
+	joins_args := []interface{}{}
+	where_str := "1=1"
+	where_args := []interface{}{}
+
+	for _, table := range sql.Tables {
+		if len(table.TableDef.Joins) > 0 {
+			joins_str += ` LEFT JOIN "` + table.TableDef.TableName + `" AS "` + table.As + `"`
+		} else { // no join mean first table
+			q += `SELECT "` + table.As + `"."id" FROM "` + table.TableDef.TableName + `" AS "` + table.As + `" `
+		}
+		for i, join := range table.TableDef.Joins {
+			lefttable, _ := sql.FindTable(join.JoinLeftTable, nil)
+			righttable, _ := sql.FindTable(join.JoinRightTable, table)
+			if righttable == nil {
+				return "", nil, errors.New("mapsearch: right table not found " + join.JoinRightTable)
+			}
+			if lefttable == nil {
+				return "", nil, errors.New("mapsearch: left table not found " + join.JoinLeftTable)
+			}
+			if i == 0 {
+				joins_str += ` ON "`
+			} else {
+				joins_str += ` AND "`
+			}
+			joins_str += lefttable.As + `"."` + join.JoinLeftKey + `" = "` + righttable.As + `"."` + join.JoinRightKey + `"`
+		}
+
+		if table.UsedForExclude == false {
+			for _, where := range sql.Wheres {
+				if where.Table == table {
+					where_str += ` AND (` + where.Where + `)`
+					where_args = append(where_args, where.Args...)
+				}
+			}
+		} else {
+			for _, where := range sql.Wheres {
+				if where.Table == table {
+					joins_str += ` AND (` + where.Where + `)`
+					joins_args = append(joins_args, where.Args...)
+				}
+			}
+			where_str += ` AND "` + table.As + `".id IS NULL`
+		}
+	}
+
+	q += " " + joins_str + " WHERE " + where_str
+
+	// query end
+	q += " GROUP BY site.id"
+
+	// replace $$
+	q = NumberArgs(q, 1)
+
+	return q, append(joins_args, where_args...), nil
+}
+
+// NumberArgs replace each $$ placeholder of q by a numbered one, starting at $first
+func NumberArgs(q string, first int) string {
+	q_copy := ""
+	for i := first; i < 999; i++ {
+		q_copy = strings.Replace(q, "$$", "$"+strconv.Itoa(i), 1)
+		if q_copy == q {
+			break
+		}
+		q = q_copy
+	}
+	return q
+}
@@ -27,6 +27,7 @@ import (
 	"time"
 	"strings"
 
+	"github.com/croll/arkeogis-server/mapsearch"
 	"github.com/jmoiron/sqlx"
 )
 
@@ -275,6 +276,13 @@ func (d *Database) DeleteSites(tx *sqlx.Tx) (err error) {
 	return
 }
 
+// SitesFingerprintsQuery selects the code of each site of the database $1 with a md5 hash of its content,
+// including its site ranges and characs. It is used to know which sites are modified by an import,
+// and must be kept in sync with the fingerprint of the staged sites in databaseimport.
+const SitesFingerprintsQuery = "SELECT s.code, md5(concat_ws('|', s.name, s.city_name, s.city_geonameid, ST_AsText(s.geom), ST_AsText(s.geom_3d), ST_AsText(s.geom_shape), s.centroid, s.occupation, s.uncertainty_radius, s.precision_class, " +
+	"(SELECT string_agg(r.content, ';' ORDER BY r.content) FROM (SELECT concat_ws('|', sr.start_date1, sr.start_date2, sr.end_date1, sr.end_date2, src.charac_id, src.knowledge_type, src.exceptional, srctr.bibliography, srctr.comment) AS content FROM site_range sr JOIN site_range__charac src ON src.site_range_id = sr.id LEFT JOIN site_range__charac_tr srctr ON srctr.site_range__charac_id = src.id AND srctr.lang_isocode = d.default_language WHERE sr.site_id = s.id) AS r))) AS fingerprint " +
+	"FROM site s JOIN database d ON d.id = s.database_id WHERE s.database_id = $1"
+
 // GetCountryList lists all countries linked to a database
 func (d *Database) GetCountryList(tx *sqlx.Tx, langIsocode string) ([]CountryInfos, error) {
 	countries := []CountryInfos{}
@@ -562,6 +570,16 @@ func (d *Database) CacheGeom(tx *sqlx.Tx) (err error) {
 	return
 }
 
+// CacheGeomExtent set the geographical extent of the database from its sites,
+// as a bbox, a convex hull or a concave hull
+func (d *Database) CacheGeomExtent(tx *sqlx.Tx, kind string, ratio float64) (err error) {
+	_, err = tx.Exec("UPDATE database SET geographical_extent_geom = COALESCE(("+ExtentQuery(kind, ratio, "SELECT id FROM site WHERE database_id = $1")+"), geographical_extent_geom) WHERE id = $1", d.Id)
+	if err != nil {
+		err = errors.New("database::CacheGeomExtent: " + err.Error())
+	}
+	return
+}
+
 // CacheDates get database sites extend and cache enveloppe
 func (d *Database) CacheDates(tx *sqlx.Tx) (err error) {
 	_, err = tx.NamedExec("UPDATE database SET start_date = (SELECT COALESCE(min(start_date1),-2147483648) FROM site_range WHERE site_id IN (SELECT id FROM site where database_id = :id) AND start_date1 != -2147483648), end_date = (SELECT COALESCE(max(end_date2),2147483647) FROM site_range WHERE site_id IN (SELECT id FROM site where database_id = :id) AND end_date2 != 2147483647) WHERE id = :id", d)
@@ -571,6 +589,26 @@ func (d *Database) CacheDates(tx *sqlx.Tx) (err error) {
 	return
 }
 
+// CacheTextSearch build the full text search document of every site of the database.
+// Site name is weighted A, site description B, charac comments C and bibliographies D.
+func (d *Database) CacheTextSearch(tx *sqlx.Tx) (err error) {
+	cfg := mapsearch.TsConfig("d.default_language")
+	doc := func(q string, weight string) string {
+		return "setweight(to_tsvector(" + cfg + ", unaccent(COALESCE((" + q + "), ''))), '" + weight + "')"
+	}
+	charactr := "SELECT string_agg(%s, ' ') FROM site_range sr JOIN site_range__charac src ON src.site_range_id = sr.id JOIN site_range__charac_tr srctr ON srctr.site_range__charac_id = src.id AND srctr.lang_isocode = d.default_language WHERE sr.site_id = s.id"
+	_, err = tx.Exec("UPDATE site s SET search_tsv = "+
+		doc("s.name", "A")+" || "+
+		doc("SELECT string_agg(description, ' ') FROM site_tr WHERE site_id = s.id", "B")+" || "+
+		doc(strings.Replace(charactr, "%s", "srctr.comment", 1), "C")+" || "+
+		doc(strings.Replace(charactr, "%s", "srctr.bibliography", 1), "D")+
+		" FROM database d WHERE d.id = s.database_id AND d.id = $1", d.Id)
+	if err != nil {
+		err = errors.New("database::CacheTextSearch: " + err.Error())
+	}
+	return
+}
+
 // IsLinkedToProject returns true or false if database is linked or not to user project
 func (d *Database) IsLinkedToProject(tx *sqlx.Tx, project_ID int) (linked bool, err error) {
 	linked = false
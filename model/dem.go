@@ -0,0 +1,82 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Christophe Beveraggi <beve@croll.fr>
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package model
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Storages of a DEM
+const (
+	DemStoragePostgis = "postgis"
+	DemStorageDisk    = "disk"
+)
+
+// Get the dem from the dem table
+func (d *Dem) Get(tx *sqlx.Tx) error {
+	return tx.Get(d, "SELECT * FROM \"dem\" WHERE id = $1", d.Id)
+}
+
+// Create the dem and load its raster as 256x256 tiles in dem_tile. With the
+// postgis storage, content is a GDAL readable raster (GeoTIFF, ...) copied in
+// the database. With the disk storage, Filename is a raster file readable by
+// the postgresql server, and tiles are registered as out-db rasters, which
+// needs postgis.enable_outdb_rasters and postgis.gdal_enabled_drivers.
+func (d *Dem) Create(tx *sqlx.Tx, content []byte) error {
+	err := tx.Get(&d.Id, "INSERT INTO \"dem\" (\"name\", \"storage\", \"filename\", \"creator_user_id\", \"created_at\", \"updated_at\") VALUES ($1, $2, $3, $4, now(), now()) RETURNING id", d.Name, d.Storage, d.Filename, d.Creator_user_id)
+	if err != nil {
+		return errors.New("dem::Create: " + err.Error())
+	}
+
+	if d.Storage == DemStorageDisk {
+		_, err = tx.Exec("INSERT INTO \"dem_tile\" (\"dem_id\", \"rast\") SELECT $1, ST_Tile(ST_AddBand(NULL::raster, $2::text, NULL::int[]), 1, 256, 256)", d.Id, d.Filename)
+	} else {
+		_, err = tx.Exec("INSERT INTO \"dem_tile\" (\"dem_id\", \"rast\") SELECT $1, ST_Tile(ST_FromGDALRaster($2), 1, 256, 256)", d.Id, content)
+	}
+	if err != nil {
+		return errors.New("dem::Create: can't load raster: " + err.Error())
+	}
+	return nil
+}
+
+// Delete the dem and its tiles
+func (d *Dem) Delete(tx *sqlx.Tx) error {
+	_, err := tx.Exec("DELETE FROM \"dem\" WHERE id = $1", d.Id)
+	return err
+}
+
+// GetSrid returns the srid of the dem rasters
+func (d *Dem) GetSrid(tx *sqlx.Tx) (srid int, err error) {
+	err = tx.Get(&srid, "SELECT ST_SRID(rast) FROM \"dem_tile\" WHERE dem_id = $1 LIMIT 1", d.Id)
+	return
+}
+
+// DemElevationSql returns an SQL expression of the elevation of the dem demIdArg
+// at the geometry point pointSql (EPSG:4326), srid is the srid of the dem. The
+// value is NULL outside of the dem or on nodata cells.
+func DemElevationSql(demIdArg string, srid int, pointSql string) string {
+	p := "ST_Transform(" + pointSql + ", " + strconv.Itoa(srid) + ")"
+	return "(SELECT ST_Value(t.rast, 1, " + p + ") FROM \"dem_tile\" t WHERE t.dem_id = " + demIdArg + " AND ST_Intersects(t.rast, " + p + ") LIMIT 1)"
+}
@@ -0,0 +1,116 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package model
+
+import (
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Get the import profile
+func (p *Import_profile) Get(tx *sqlx.Tx) error {
+	err := tx.Get(p, "SELECT * FROM \"import_profile\" WHERE id = $1", p.Id)
+	if err != nil {
+		err = errors.New("import_profile::Get: " + err.Error())
+	}
+	return err
+}
+
+// Create the import profile
+func (p *Import_profile) Create(tx *sqlx.Tx) error {
+	stmt, err := tx.PrepareNamed("INSERT INTO \"import_profile\" (" + Import_profile_InsertStr + ") VALUES (" + Import_profile_InsertValuesStr + ") RETURNING id")
+	if err != nil {
+		return errors.New("import_profile::Create: " + err.Error())
+	}
+	defer stmt.Close()
+	err = stmt.Get(&p.Id, p)
+	if err != nil {
+		err = errors.New("import_profile::Create: " + err.Error())
+	}
+	return err
+}
+
+// Update the import profile
+func (p *Import_profile) Update(tx *sqlx.Tx) error {
+	_, err := tx.NamedExec("UPDATE \"import_profile\" SET "+Import_profile_UpdateStr+" WHERE id = :id", p)
+	if err != nil {
+		err = errors.New("import_profile::Update: " + err.Error())
+	}
+	return err
+}
+
+// Delete the import profile
+func (p *Import_profile) Delete(tx *sqlx.Tx) error {
+	_, err := tx.Exec("DELETE FROM \"import_profile\" WHERE id = $1", p.Id)
+	if err != nil {
+		err = errors.New("import_profile::Delete: " + err.Error())
+	}
+	return err
+}
+
+// GetDatabases returns the ids of the databases linked to the import profile
+func (p *Import_profile) GetDatabases(tx *sqlx.Tx) (ids []int, err error) {
+	ids = []int{}
+	err = tx.Select(&ids, "SELECT database_id FROM \"database__import_profile\" WHERE import_profile_id = $1 ORDER BY database_id", p.Id)
+	if err != nil {
+		err = errors.New("import_profile::GetDatabases: " + err.Error())
+	}
+	return
+}
+
+// SetDatabases links the import profile to the databases, replacing previous links
+func (p *Import_profile) SetDatabases(tx *sqlx.Tx, ids []int) error {
+	_, err := tx.Exec("DELETE FROM \"database__import_profile\" WHERE import_profile_id = $1", p.Id)
+	if err != nil {
+		return errors.New("import_profile::SetDatabases: " + err.Error())
+	}
+	for _, id := range ids {
+		_, err = tx.Exec("INSERT INTO \"database__import_profile\" (\"database_id\", \"import_profile_id\") VALUES ($1, $2)", id, p.Id)
+		if err != nil {
+			return errors.New("import_profile::SetDatabases: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// importProfileUsableSql restricts import profiles to those of the user $1, or linked to a database the user owns or is author of
+const importProfileUsableSql = "(p.user_id = $1 OR p.id IN (SELECT dp.import_profile_id FROM database__import_profile dp JOIN database d ON d.id = dp.database_id WHERE d.owner = $1 OR d.id IN (SELECT database_id FROM database__authors WHERE user_id = $1)))"
+
+// IsUsableBy returns true if the user can import files with the import profile
+func (p *Import_profile) IsUsableBy(tx *sqlx.Tx, uid int) (usable bool, err error) {
+	err = tx.Get(&usable, "SELECT EXISTS (SELECT 1 FROM \"import_profile\" p WHERE p.id = $2 AND "+importProfileUsableSql+")", uid, p.Id)
+	if err != nil {
+		err = errors.New("import_profile::IsUsableBy: " + err.Error())
+	}
+	return
+}
+
+// GetImportProfiles returns the import profiles the user can use
+func GetImportProfiles(tx *sqlx.Tx, uid int) (profiles []Import_profile, err error) {
+	profiles = []Import_profile{}
+	err = tx.Select(&profiles, "SELECT p.* FROM \"import_profile\" p WHERE "+importProfileUsableSql+" ORDER BY p.name", uid)
+	if err != nil {
+		err = errors.New("model::GetImportProfiles: " + err.Error())
+	}
+	return
+}
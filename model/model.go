@@ -165,6 +165,12 @@ type Database__country struct {
 }
 
 
+type Database__import_profile struct {
+	Database_id	int	`db:"database_id" json:"database_id" xmltopsql:"ondelete:cascade"`	// Database.Id
+	Import_profile_id	int	`db:"import_profile_id" json:"import_profile_id" xmltopsql:"ondelete:cascade"`	// Import_profile.Id
+}
+
+
 type Database_context struct {
 	Id	int	`db:"id" json:"id"`
 	Database_id	int	`db:"database_id" json:"database_id"`	// Database.Id
@@ -198,6 +204,24 @@ type Database_tr struct {
 }
 
 
+type Dem struct {
+	Id	int	`db:"id" json:"id"`
+	Name	string	`db:"name" json:"name"`
+	Storage	string	`db:"storage" json:"storage"`
+	Filename	string	`db:"filename" json:"filename"`
+	Creator_user_id	int	`db:"creator_user_id" json:"creator_user_id"`	// User.Id
+	Created_at	time.Time	`db:"created_at" json:"created_at"`
+	Updated_at	time.Time	`db:"updated_at" json:"updated_at"`
+}
+
+
+type Dem_tile struct {
+	Id	int	`db:"id" json:"id"`
+	Dem_id	int	`db:"dem_id" json:"dem_id" xmltopsql:"ondelete:cascade"`	// Dem.Id
+	Rast	string	`db:"rast" json:"rast"`
+}
+
+
 type Group struct {
 	Id	int	`db:"id" json:"id"`
 	Type	string	`db:"type" json:"type"`
@@ -230,7 +254,21 @@ type Import struct {
 	Filename	string	`db:"filename" json:"filename"`
 	Number_of_lines	int	`db:"number_of_lines" json:"number_of_lines"`
 	Number_of_sites	int	`db:"number_of_sites" json:"number_of_sites"`
+	Number_of_new_sites	int	`db:"number_of_new_sites" json:"number_of_new_sites"`
+	Number_of_modified_sites	int	`db:"number_of_modified_sites" json:"number_of_modified_sites"`
+	Number_of_unchanged_sites	int	`db:"number_of_unchanged_sites" json:"number_of_unchanged_sites"`
+	Number_of_deleted_sites	int	`db:"number_of_deleted_sites" json:"number_of_deleted_sites"`
+	Created_at	time.Time	`db:"created_at" json:"created_at"`
+}
+
+
+type Import_profile struct {
+	Id	int	`db:"id" json:"id"`
+	Name	string	`db:"name" json:"name" min:"1" max:"255" error:"IMPORT.FIELD_PROFILE_NAME.T_CHECK_MANDATORY"`
+	User_id	int	`db:"user_id" json:"user_id" xmltopsql:"ondelete:cascade"`	// User.Id
+	Mapping	string	`db:"mapping" json:"mapping"`
 	Created_at	time.Time	`db:"created_at" json:"created_at"`
+	Updated_at	time.Time	`db:"updated_at" json:"updated_at"`
 }
 
 
@@ -340,6 +378,12 @@ type Project__chronology struct {
 }
 
 
+type Project__collaborators struct {
+	Project_id	int	`db:"project_id" json:"project_id" xmltopsql:"ondelete:cascade"`	// Project.Id
+	User_id	int	`db:"user_id" json:"user_id" xmltopsql:"ondelete:cascade"`	// User.Id
+}
+
+
 type Project__database struct {
 	Project_id	int	`db:"project_id" json:"project_id" xmltopsql:"ondelete:cascade"`	// Project.Id
 	Database_id	int	`db:"database_id" json:"database_id"`	// Database.Id
@@ -365,9 +409,23 @@ type Project_hidden_characs struct {
 
 
 type Saved_query struct {
+	Id	int	`db:"id" json:"id"`
 	Project_id	int	`db:"project_id" json:"project_id" xmltopsql:"ondelete:cascade"`	// Project.Id
 	Name	string	`db:"name" json:"name" min:"1"`
 	Params	string	`db:"params" json:"params"`
+	Owner_user_id	int	`db:"owner_user_id" json:"owner_user_id" xmltopsql:"ondelete:cascade"`	// User.Id
+	Visibility	string	`db:"visibility" json:"visibility" enum:"private,project,public" error:"QUERY.FIELD_VISIBILITY.T_CHECK_INCORRECT"`
+	Public_token	string	`db:"public_token" json:"public_token"`
+	Created_at	time.Time	`db:"created_at" json:"created_at"`
+	Updated_at	time.Time	`db:"updated_at" json:"updated_at"`
+}
+
+
+type Saved_query_snapshot struct {
+	Id	int	`db:"id" json:"id"`
+	Saved_query_id	int	`db:"saved_query_id" json:"saved_query_id" xmltopsql:"ondelete:cascade"`	// Saved_query.Id
+	Sites	string	`db:"sites" json:"sites"`
+	Created_at	time.Time	`db:"created_at" json:"created_at"`
 }
 
 
@@ -402,6 +460,14 @@ type Shapefile__authors struct {
 }
 
 
+type Shapefile_feature struct {
+	Id	int	`db:"id" json:"id"`
+	Shapefile_id	int	`db:"shapefile_id" json:"shapefile_id" xmltopsql:"ondelete:cascade"`	// Shapefile.Id
+	Geom	string	`db:"geom" json:"geom"`
+	Properties	string	`db:"properties" json:"properties"`
+}
+
+
 type Shapefile_tr struct {
 	Shapefile_id	int	`db:"shapefile_id" json:"shapefile_id"`	// Shapefile.Id
 	Lang_isocode	string	`db:"lang_isocode" json:"lang_isocode"`	// Lang.Isocode
@@ -420,7 +486,10 @@ type Site struct {
 	City_geonameid	int	`db:"city_geonameid" json:"city_geonameid"`
 	Geom	string	`db:"geom" json:"geom"`
 	Geom_3d	string	`db:"geom_3d" json:"geom_3d"`
+	Geom_shape	sql.NullString	`db:"geom_shape" json:"geom_shape"`
 	Centroid	bool	`db:"centroid" json:"centroid" enum:"0,1" error:"SITE.FIELD_CENTROID.T_CHECK_MANDATORY"`
+	Uncertainty_radius	float64	`db:"uncertainty_radius" json:"uncertainty_radius" min:"0" error:"SITE.FIELD_UNCERTAINTY_RADIUS.T_CHECK_INCORRECT"`
+	Precision_class	string	`db:"precision_class" json:"precision_class" enum:"exact,approximate,commune,region" error:"SITE.FIELD_PRECISION_CLASS.T_CHECK_INCORRECT"`
 	Occupation	string	`db:"occupation" json:"occupation" enum:"not_documented,single,continuous,multiple" error:"SITE.FIELD_OCCUPATION.T_CHECK_INCORRECT"`
 	Database_id	int	`db:"database_id" json:"database_id"`	// Database.Id
 	Created_at	time.Time	`db:"created_at" json:"created_at"`
@@ -430,6 +499,7 @@ type Site struct {
 	Start_date2	int	`db:"start_date2" json:"start_date2"`
 	End_date1	int	`db:"end_date1" json:"end_date1"`
 	End_date2	int	`db:"end_date2" json:"end_date2"`
+	Search_tsv	sql.NullString	`db:"search_tsv" json:"search_tsv"`
 }
 
 
@@ -533,9 +603,9 @@ const Project__chronology_UpdateStr = ""
 const Database_InsertStr = "\"name\", \"scale_resolution\", \"geographical_extent\", \"type\", \"owner\", \"editor\", \"editor_url\", \"contributor\", \"default_language\", \"state\", \"license_id\", \"published\", \"soft_deleted\", \"geographical_extent_geom\", \"start_date\", \"end_date\", \"declared_creation_date\", \"public\", \"created_at\", \"updated_at\""
 const Database_InsertValuesStr = ":name, :scale_resolution, :geographical_extent, :type, :owner, :editor, :editor_url, :contributor, :default_language, :state, :license_id, :published, :soft_deleted, :geographical_extent_geom, :start_date, :end_date, :declared_creation_date, :public, now(), now()"
 const Database_UpdateStr = "\"name\" = :name, \"scale_resolution\" = :scale_resolution, \"geographical_extent\" = :geographical_extent, \"type\" = :type, \"owner\" = :owner, \"editor\" = :editor, \"editor_url\" = :editor_url, \"contributor\" = :contributor, \"default_language\" = :default_language, \"state\" = :state, \"license_id\" = :license_id, \"published\" = :published, \"soft_deleted\" = :soft_deleted, \"geographical_extent_geom\" = :geographical_extent_geom, \"start_date\" = :start_date, \"end_date\" = :end_date, \"declared_creation_date\" = :declared_creation_date, \"public\" = :public, \"updated_at\" = now()"
-const Site_InsertStr = "\"code\", \"name\", \"city_name\", \"city_geonameid\", \"geom\", \"geom_3d\", \"centroid\", \"occupation\", \"database_id\", \"created_at\", \"updated_at\", \"altitude\", \"start_date1\", \"start_date2\", \"end_date1\", \"end_date2\""
-const Site_InsertValuesStr = ":code, :name, :city_name, :city_geonameid, :geom, :geom_3d, :centroid, :occupation, :database_id, now(), now(), :altitude, :start_date1, :start_date2, :end_date1, :end_date2"
-const Site_UpdateStr = "\"code\" = :code, \"name\" = :name, \"city_name\" = :city_name, \"city_geonameid\" = :city_geonameid, \"geom\" = :geom, \"geom_3d\" = :geom_3d, \"centroid\" = :centroid, \"occupation\" = :occupation, \"database_id\" = :database_id, \"updated_at\" = now(), \"altitude\" = :altitude, \"start_date1\" = :start_date1, \"start_date2\" = :start_date2, \"end_date1\" = :end_date1, \"end_date2\" = :end_date2"
+const Site_InsertStr = "\"code\", \"name\", \"city_name\", \"city_geonameid\", \"geom\", \"geom_3d\", \"geom_shape\", \"centroid\", \"uncertainty_radius\", \"precision_class\", \"occupation\", \"database_id\", \"created_at\", \"updated_at\", \"altitude\", \"start_date1\", \"start_date2\", \"end_date1\", \"end_date2\", \"search_tsv\""
+const Site_InsertValuesStr = ":code, :name, :city_name, :city_geonameid, :geom, :geom_3d, :geom_shape, :centroid, :uncertainty_radius, :precision_class, :occupation, :database_id, now(), now(), :altitude, :start_date1, :start_date2, :end_date1, :end_date2, :search_tsv"
+const Site_UpdateStr = "\"code\" = :code, \"name\" = :name, \"city_name\" = :city_name, \"city_geonameid\" = :city_geonameid, \"geom\" = :geom, \"geom_3d\" = :geom_3d, \"geom_shape\" = :geom_shape, \"centroid\" = :centroid, \"uncertainty_radius\" = :uncertainty_radius, \"precision_class\" = :precision_class, \"occupation\" = :occupation, \"database_id\" = :database_id, \"updated_at\" = now(), \"altitude\" = :altitude, \"start_date1\" = :start_date1, \"start_date2\" = :start_date2, \"end_date1\" = :end_date1, \"end_date2\" = :end_date2, \"search_tsv\" = :search_tsv"
 const Database_tr_InsertStr = "\"description\", \"geographical_limit\", \"bibliography\", \"context_description\", \"source_description\", \"source_relation\", \"copyright\", \"subject\", \"re_use\""
 const Database_tr_InsertValuesStr = ":description, :geographical_limit, :bibliography, :context_description, :source_description, :source_relation, :copyright, :subject, :re_use"
 const Database_tr_UpdateStr = "\"description\" = :description, \"geographical_limit\" = :geographical_limit, \"bibliography\" = :bibliography, \"context_description\" = :context_description, \"source_description\" = :source_description, \"source_relation\" = :source_relation, \"copyright\" = :copyright, \"subject\" = :subject, \"re_use\" = :re_use"
@@ -581,6 +651,9 @@ const Project__map_layer_UpdateStr = ""
 const Project__shapefile_InsertStr = ""
 const Project__shapefile_InsertValuesStr = ""
 const Project__shapefile_UpdateStr = ""
+const Project__collaborators_InsertStr = ""
+const Project__collaborators_InsertValuesStr = ""
+const Project__collaborators_UpdateStr = ""
 const Site_range__charac_InsertStr = "\"site_range_id\", \"charac_id\", \"exceptional\", \"knowledge_type\""
 const Site_range__charac_InsertValuesStr = ":site_range_id, :charac_id, :exceptional, :knowledge_type"
 const Site_range__charac_UpdateStr = "\"site_range_id\" = :site_range_id, \"charac_id\" = :charac_id, \"exceptional\" = :exceptional, \"knowledge_type\" = :knowledge_type"
@@ -617,9 +690,9 @@ const Country_tr_UpdateStr = "\"name\" = :name, \"name_ascii\" = :name_ascii"
 const Database__authors_InsertStr = ""
 const Database__authors_InsertValuesStr = ""
 const Database__authors_UpdateStr = ""
-const Import_InsertStr = "\"database_id\", \"user_id\", \"md5sum\", \"filename\", \"number_of_lines\", \"number_of_sites\", \"created_at\""
-const Import_InsertValuesStr = ":database_id, :user_id, :md5sum, :filename, :number_of_lines, :number_of_sites, now()"
-const Import_UpdateStr = "\"database_id\" = :database_id, \"user_id\" = :user_id, \"md5sum\" = :md5sum, \"filename\" = :filename, \"number_of_lines\" = :number_of_lines, \"number_of_sites\" = :number_of_sites"
+const Import_InsertStr = "\"database_id\", \"user_id\", \"md5sum\", \"filename\", \"number_of_lines\", \"number_of_sites\", \"number_of_new_sites\", \"number_of_modified_sites\", \"number_of_unchanged_sites\", \"number_of_deleted_sites\", \"created_at\""
+const Import_InsertValuesStr = ":database_id, :user_id, :md5sum, :filename, :number_of_lines, :number_of_sites, :number_of_new_sites, :number_of_modified_sites, :number_of_unchanged_sites, :number_of_deleted_sites, now()"
+const Import_UpdateStr = "\"database_id\" = :database_id, \"user_id\" = :user_id, \"md5sum\" = :md5sum, \"filename\" = :filename, \"number_of_lines\" = :number_of_lines, \"number_of_sites\" = :number_of_sites, \"number_of_new_sites\" = :number_of_new_sites, \"number_of_modified_sites\" = :number_of_modified_sites, \"number_of_unchanged_sites\" = :number_of_unchanged_sites, \"number_of_deleted_sites\" = :number_of_deleted_sites"
 const License_InsertStr = "\"name\", \"url\""
 const License_InsertValuesStr = ":name, :url"
 const License_UpdateStr = "\"name\" = :name, \"url\" = :url"
@@ -665,6 +738,24 @@ const Map_layer__authors_UpdateStr = ""
 const Project__charac_InsertStr = ""
 const Project__charac_InsertValuesStr = ""
 const Project__charac_UpdateStr = ""
-const Saved_query_InsertStr = "\"params\""
-const Saved_query_InsertValuesStr = ":params"
-const Saved_query_UpdateStr = "\"params\" = :params"
+const Saved_query_InsertStr = "\"project_id\", \"name\", \"params\", \"owner_user_id\", \"visibility\", \"public_token\", \"created_at\", \"updated_at\""
+const Saved_query_InsertValuesStr = ":project_id, :name, :params, :owner_user_id, :visibility, :public_token, now(), now()"
+const Saved_query_UpdateStr = "\"project_id\" = :project_id, \"name\" = :name, \"params\" = :params, \"owner_user_id\" = :owner_user_id, \"visibility\" = :visibility, \"public_token\" = :public_token, \"updated_at\" = now()"
+const Shapefile_feature_InsertStr = "\"shapefile_id\", \"geom\", \"properties\""
+const Shapefile_feature_InsertValuesStr = ":shapefile_id, :geom, :properties"
+const Shapefile_feature_UpdateStr = "\"shapefile_id\" = :shapefile_id, \"geom\" = :geom, \"properties\" = :properties"
+const Saved_query_snapshot_InsertStr = "\"saved_query_id\", \"sites\", \"created_at\""
+const Saved_query_snapshot_InsertValuesStr = ":saved_query_id, :sites, now()"
+const Saved_query_snapshot_UpdateStr = "\"saved_query_id\" = :saved_query_id, \"sites\" = :sites"
+const Dem_InsertStr = "\"name\", \"storage\", \"filename\", \"creator_user_id\", \"created_at\", \"updated_at\""
+const Dem_InsertValuesStr = ":name, :storage, :filename, :creator_user_id, now(), now()"
+const Dem_UpdateStr = "\"name\" = :name, \"storage\" = :storage, \"filename\" = :filename, \"creator_user_id\" = :creator_user_id, \"updated_at\" = now()"
+const Dem_tile_InsertStr = "\"dem_id\", \"rast\""
+const Dem_tile_InsertValuesStr = ":dem_id, :rast"
+const Dem_tile_UpdateStr = "\"dem_id\" = :dem_id, \"rast\" = :rast"
+const Import_profile_InsertStr = "\"name\", \"user_id\", \"mapping\", \"created_at\", \"updated_at\""
+const Import_profile_InsertValuesStr = ":name, :user_id, :mapping, now(), now()"
+const Import_profile_UpdateStr = "\"name\" = :name, \"user_id\" = :user_id, \"mapping\" = :mapping, \"updated_at\" = now()"
+const Database__import_profile_InsertStr = ""
+const Database__import_profile_InsertValuesStr = ""
+const Database__import_profile_UpdateStr = ""
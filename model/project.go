@@ -51,6 +51,9 @@ type ProjectFullInfos struct {
 	Databases []struct {
 		Database_id int `json:"id"`
 	} `json:"databases"`
+	Collaborators []struct {
+		User_id int `json:"id"`
+	} `json:"collaborators"`
 }
 
 func (pfi *ProjectFullInfos) Get(tx *sqlx.Tx) (err error) {
@@ -83,6 +86,13 @@ func (pfi *ProjectFullInfos) Get(tx *sqlx.Tx) (err error) {
 		return
 	}
 
+	// Collaborators
+	err = tx.Select(&pfi.Collaborators, "SELECT user_id from project__collaborators WHERE project_id = $1", pfi.Id)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
 	// Layers WMS
 	// transquery := GetQueryTranslationsAsJSONObject("map_layer_tr", "tbl.map_layer_id = ml.id", "", false, "name", "attribution", "copyright")
 	// err = tx.Select(&pfi.Layers, "SELECT ml.id, ST_AsGeojson(ml.geographical_extent_geom) as geographical_extent_geom, url, identifier, ("+transquery+") as translations, ml.min_scale, ml.max_scale, ml.type, 'wms' || ml.id AS uniq_code FROM project__map_layer pml LEFT JOIN map_layer ml ON pml.map_layer_id = ml.id WHERE pml.project_id = $1", pfi.Id)
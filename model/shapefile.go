@@ -66,6 +66,22 @@ func (u *Shapefile) Delete(tx *sqlx.Tx) error {
 	return err
 }
 
+// UpdateGeojson replaces the geojson of the shapefile, when a new file is uploaded
+func (u *Shapefile) UpdateGeojson(tx *sqlx.Tx) error {
+	_, err := tx.NamedExec("UPDATE \"shapefile\" SET \"geojson\" = :geojson, \"geojson_with_data\" = :geojson_with_data, \"updated_at\" = now() WHERE id=:id", u)
+	return err
+}
+
+// CacheFeatures splits the stored geojson of the shapefile into the shapefile_feature table, so features can be queried spatially
+func (u *Shapefile) CacheFeatures(tx *sqlx.Tx) error {
+	_, err := tx.NamedExec("DELETE FROM \"shapefile_feature\" WHERE shapefile_id=:id", u)
+	if err != nil {
+		return err
+	}
+	_, err = tx.NamedExec("INSERT INTO \"shapefile_feature\" (shapefile_id, geom, properties) SELECT s.id, ST_SetSRID(ST_GeomFromGeoJSON(f->>'geometry'), 4326)::geography, COALESCE(f->>'properties', '{}') FROM \"shapefile\" s, json_array_elements(COALESCE(NULLIF(s.geojson_with_data, ''), s.geojson)::json->'features') f WHERE s.id = :id AND f->'geometry' IS NOT NULL AND json_typeof(f->'geometry') = 'object'", u)
+	return err
+}
+
 // Set publication state of the shapefile
 func (u *Shapefile) SetPublicationState(tx *sqlx.Tx) error {
 	_, err := tx.NamedExec("UPDATE \"shapefile\" SET published = :published WHERE id=:id", u)
@@ -56,22 +56,6 @@ func (s *Site) Get(tx *sqlx.Tx) (err error) {
 	return
 }
 
-func (s *SiteInfos) Create(tx *sqlx.Tx) (err error) {
-	var q string
-	if s.EPSG != 4326 {
-		q = "INSERT INTO \"site\" (\"code\", \"name\", \"city_name\", \"city_geonameid\", \"geom\", \"geom_3d\", \"altitude\", \"centroid\", \"occupation\", \"database_id\", \"created_at\", \"updated_at\") VALUES (:code, :name, :city_name, :city_geonameid, ST_Transform(ST_GeometryFromText(:geom), 4326)::::geography, ST_Transform(ST_GeometryFromText(:geom_3d), 4326)::::geography, :altitude, :centroid, :occupation, :database_id, now(), now()) RETURNING id"
-	} else {
-		q = "INSERT INTO \"site\" (\"code\", \"name\", \"city_name\", \"city_geonameid\", \"geom\", \"geom_3d\", \"altitude\", \"centroid\", \"occupation\", \"database_id\", \"created_at\", \"updated_at\") VALUES (:code, :name, :city_name, :city_geonameid, ST_GeographyFromText(:geom), ST_GeographyFromText(:geom_3d), :altitude, :centroid, :occupation, :database_id, now(), now()) RETURNING id"
-	}
-	stmt, err := tx.PrepareNamed(q)
-	if err != nil {
-		return
-	}
-	defer stmt.Close()
-	err = stmt.Get(&s.Id, s)
-	return
-}
-
 // CacheDates get database sites extend and cache enveloppe
 func (s *SiteInfos) CacheDates(tx *sqlx.Tx) (err error) {
 
@@ -88,22 +72,6 @@ func (s *SiteInfos) CacheDates(tx *sqlx.Tx) (err error) {
 	return
 }
 
-func (s *SiteInfos) Update(tx *sqlx.Tx) (err error) {
-	var q string
-	if s.EPSG != 4326 {
-		q = "UPDATE \"site\" SET \"code\" = :code, \"name\" = :name, \"city_name\" = :city_name, \"city_geonameid\" = :city_geonameid, geom = ST_Transform(ST_GeometryFromText(:geom), 4326)::geography, geom_3d = ST_Transform(ST_GeometryFromText(:geom_3d), 4326)::::geography, \"altitude\" = :altitude, \"centroid\" = :centroid, \"occupation\" = :occupation, \"database_id\" = :database_id, \"updated_at\" = now() WHERE database_id = :id"
-	} else {
-		q = "UPDATE \"site\" SET \"code\" = :code, \"name\" = :name, \"city_name\" = :city_name, \"city_geonameid\" = :city_geonameid, geom = ST_GeographyFromText(:geom), geom_3d = ST_GeographyFromText(:geom_3d), \"altitude\" = :altitude, \"centroid\" = :centroid, \"occupation\" = :occupation, \"database_id\" = :database_id, \"updated_at\" = now() WHERE id = :id"
-	}
-	stmt, err := tx.PrepareNamed(q)
-	if err != nil {
-		return
-	}
-	defer stmt.Close()
-	_, err = stmt.Exec(s)
-	return
-}
-
 func (sr *Site_range) Create(tx *sqlx.Tx) (err error) {
 	stmt, err := tx.PrepareNamed("INSERT INTO \"site_range\" (" + Site_range_InsertStr + ") VALUES (" + Site_range_InsertValuesStr + ") RETURNING id")
 	if err != nil {
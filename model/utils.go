@@ -111,3 +111,29 @@ func IntJoin(a []int, hackempty bool) string {
 	}
 	return res
 }
+
+// Kinds of spatial extent of a set of sites
+const (
+	ExtentBbox        = "bbox"
+	ExtentConvexHull  = "convex_hull"
+	ExtentConcaveHull = "concave_hull"
+)
+
+// ExtentQuery returns a query computing the extent polygon of the sites whose
+// ids are returned by sitesQuery. ratio is the target percent of area of the
+// concave hull, from 0 to 1. Degenerated extents (a single site, aligned
+// sites) are buffered so the extent is always a polygon.
+func ExtentQuery(kind string, ratio float64, sitesQuery string) string {
+	collect := "ST_Collect(geom::geometry)"
+	var extent string
+	switch kind {
+	case ExtentConvexHull:
+		extent = "ST_ConvexHull(" + collect + ")"
+	case ExtentConcaveHull:
+		extent = "ST_ConcaveHull(" + collect + ", " + strconv.FormatFloat(ratio, 'f', -1, 64) + ")"
+	default:
+		extent = "ST_Envelope(" + collect + ")"
+	}
+	return "SELECT CASE GeometryType(e) WHEN 'POLYGON' THEN e WHEN 'MULTIPOLYGON' THEN ST_ConvexHull(e) ELSE ST_Buffer(e::geography, 1)::geometry END" +
+		" FROM (SELECT " + extent + " AS e FROM site WHERE id IN (" + sitesQuery + ") AND geom IS NOT NULL) extent"
+}
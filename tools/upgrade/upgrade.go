@@ -0,0 +1,184 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// This tool upgrades the datas of an existing database to the current schema.
+// New tables are created from the schema with xmltopsql, then this tool adds
+// the new columns of existing tables and fills them. Every step can safely be
+// run again.
+
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	db "github.com/croll/arkeogis-server/db"
+	"github.com/croll/arkeogis-server/model"
+	"github.com/jmoiron/sqlx"
+)
+
+// steps are run in order, each one in its own transaction
+var steps = []struct {
+	name string
+	run  func(tx *sqlx.Tx) error
+}{
+	{"shapefile features", cacheShapefileFeatures},
+	{"saved queries", upgradeSavedQueries},
+	{"sites text search", cacheTextSearch},
+	{"sites shapes", upgradeSiteShapes},
+	{"sites precision", upgradeSitePrecision},
+	{"imports changes", upgradeImportChanges},
+}
+
+func main() {
+	for _, step := range steps {
+		tx, err := db.DB.Beginx()
+		if err != nil {
+			log.Fatalln("can't start transaction:", err)
+		}
+		if err = step.run(tx); err != nil {
+			_ = tx.Rollback()
+			log.Fatalln(step.name, "failed:", err)
+		}
+		if err = tx.Commit(); err != nil {
+			log.Fatalln(step.name, "commit failed:", err)
+		}
+		log.Println(step.name, "done")
+	}
+}
+
+// cacheShapefileFeatures fills the features of the shapefiles saved before they were cached
+func cacheShapefileFeatures(tx *sqlx.Tx) error {
+	ids := []int{}
+	err := tx.Select(&ids, "SELECT id FROM shapefile s WHERE NOT EXISTS (SELECT 1 FROM shapefile_feature f WHERE f.shapefile_id = s.id)")
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		shapefile := model.Shapefile{Id: id}
+		if err = shapefile.CacheFeatures(tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upgradeSavedQueries gives an id, an owner (the owner of the project), a
+// visibility and a public token to the queries saved before they had them
+func upgradeSavedQueries(tx *sqlx.Tx) error {
+	queries := []string{
+		`DO $$ BEGIN CREATE TYPE saved_query_visibility AS ENUM('private', 'project', 'public'); EXCEPTION WHEN duplicate_object THEN NULL; END $$`,
+		`ALTER TABLE "saved_query" ADD COLUMN IF NOT EXISTS "id" serial`,
+		`ALTER TABLE "saved_query" ADD COLUMN IF NOT EXISTS "owner_user_id" integer`,
+		`ALTER TABLE "saved_query" ADD COLUMN IF NOT EXISTS "visibility" saved_query_visibility NOT NULL DEFAULT 'private'`,
+		`ALTER TABLE "saved_query" ADD COLUMN IF NOT EXISTS "public_token" varchar(64)`,
+		`ALTER TABLE "saved_query" ADD COLUMN IF NOT EXISTS "created_at" timestamp NOT NULL DEFAULT now()`,
+		`ALTER TABLE "saved_query" ADD COLUMN IF NOT EXISTS "updated_at" timestamp NOT NULL DEFAULT now()`,
+		`UPDATE "saved_query" q SET "owner_user_id" = p.user_id FROM "project" p WHERE p.id = q.project_id AND q.owner_user_id IS NULL`,
+		`UPDATE "saved_query" SET "public_token" = md5(random()::text || id) || md5(random()::text || clock_timestamp()) WHERE "public_token" IS NULL`,
+		`ALTER TABLE "saved_query" ALTER COLUMN "owner_user_id" SET NOT NULL, ALTER COLUMN "public_token" SET NOT NULL, ALTER COLUMN "created_at" DROP DEFAULT, ALTER COLUMN "updated_at" DROP DEFAULT`,
+		// the primary key was (project_id, name), which is now only unique
+		`DO $$ BEGIN
+		  IF NOT EXISTS (SELECT 1 FROM information_schema.key_column_usage WHERE table_name = 'saved_query' AND constraint_name = 'saved_query_pkey' AND column_name = 'id') THEN
+		   ALTER TABLE "saved_query" DROP CONSTRAINT IF EXISTS "saved_query_pkey";
+		   ALTER TABLE "saved_query" ADD PRIMARY KEY ("id");
+		  END IF;
+		  IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'c_saved_query.owner_user_id') THEN
+		   ALTER TABLE "saved_query" ADD CONSTRAINT "c_saved_query.owner_user_id" FOREIGN KEY ("owner_user_id") REFERENCES "user" ("id") ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED;
+		  END IF;
+		 END $$`,
+		`CREATE INDEX IF NOT EXISTS "i_saved_query.owner_user_id" ON "saved_query" ("owner_user_id")`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS "i_saved_query.project_id,name" ON "saved_query" ( "project_id", "name" )`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS "i_saved_query.public_token" ON "saved_query" ( "public_token" )`,
+	}
+	return execAll(tx, queries)
+}
+
+// cacheTextSearch builds the text search document of the sites imported before it existed
+func cacheTextSearch(tx *sqlx.Tx) error {
+	err := execAll(tx, []string{
+		`CREATE EXTENSION IF NOT EXISTS unaccent`,
+		`ALTER TABLE "site" ADD COLUMN IF NOT EXISTS "search_tsv" tsvector`,
+		`CREATE INDEX IF NOT EXISTS "i_site.search_tsv" ON "site" USING GIN ( "search_tsv" )`,
+	})
+	if err != nil {
+		return err
+	}
+	ids := []int{}
+	err = tx.Select(&ids, "SELECT id FROM database d WHERE EXISTS (SELECT 1 FROM site s WHERE s.database_id = d.id AND s.search_tsv IS NULL)")
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		database := model.Database{Id: id}
+		if err = database.CacheTextSearch(tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upgradeSiteShapes adds the polygon or line of the sites
+func upgradeSiteShapes(tx *sqlx.Tx) error {
+	return execAll(tx, []string{
+		`ALTER TABLE "site" ADD COLUMN IF NOT EXISTS "geom_shape" geography(GEOMETRY,4326)`,
+		`CREATE INDEX IF NOT EXISTS "i_site.geom_shape" ON "site" USING GIST ( "geom_shape" )`,
+	})
+}
+
+// upgradeSitePrecision adds the positional uncertainty and the precision class
+// of the sites. Sites located at their city centroid are located to the
+// commune, as they are when imported without precision
+func upgradeSitePrecision(tx *sqlx.Tx) error {
+	return execAll(tx, []string{
+		`DO $$ BEGIN CREATE TYPE site_precision_class AS ENUM('exact', 'approximate', 'commune', 'region'); EXCEPTION WHEN duplicate_object THEN NULL; END $$`,
+		`ALTER TABLE "site" ADD COLUMN IF NOT EXISTS "uncertainty_radius" double precision NOT NULL DEFAULT 0`,
+		`DO $$ BEGIN
+		  IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'site' AND column_name = 'precision_class') THEN
+		   ALTER TABLE "site" ADD COLUMN "precision_class" site_precision_class NOT NULL DEFAULT 'exact';
+		   UPDATE "site" SET "precision_class" = 'commune' WHERE "centroid";
+		  END IF;
+		 END $$`,
+	})
+}
+
+// upgradeImportChanges adds the counts of the changes made by the imports, and
+// the index used to match the imported sites with the existing ones
+func upgradeImportChanges(tx *sqlx.Tx) error {
+	return execAll(tx, []string{
+		`ALTER TABLE "import" ADD COLUMN IF NOT EXISTS "number_of_new_sites" integer NOT NULL DEFAULT 0`,
+		`ALTER TABLE "import" ADD COLUMN IF NOT EXISTS "number_of_modified_sites" integer NOT NULL DEFAULT 0`,
+		`ALTER TABLE "import" ADD COLUMN IF NOT EXISTS "number_of_unchanged_sites" integer NOT NULL DEFAULT 0`,
+		`ALTER TABLE "import" ADD COLUMN IF NOT EXISTS "number_of_deleted_sites" integer NOT NULL DEFAULT 0`,
+		`CREATE INDEX IF NOT EXISTS "i_site.database_id,code" ON "site" ( "database_id", "code" )`,
+	})
+}
+
+// execAll executes the queries, in order
+func execAll(tx *sqlx.Tx, queries []string) error {
+	for _, q := range queries {
+		if _, err := tx.Exec(q); err != nil {
+			return errors.New(strings.SplitN(q, "\n", 2)[0] + ": " + err.Error())
+		}
+	}
+	return nil
+}
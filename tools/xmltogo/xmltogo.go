@@ -87,7 +87,7 @@ func mysqlToPsqlType(row Row) string {
 		return "time.Time"
 	}
 
-	if row.Datatype == "TEXT" || row.Datatype == "MEDIUMTEXT" || strings.Index(row.Datatype, "VARCHAR") == 0 || strings.Index(row.Datatype, "CHAR") == 0 || strings.Index(row.Datatype, "ENUM") == 0 || strings.Index(row.Datatype, "BIT") == 0 {
+	if row.Datatype == "TEXT" || row.Datatype == "MEDIUMTEXT" || strings.Index(row.Datatype, "VARCHAR") == 0 || strings.Index(row.Datatype, "CHAR") == 0 || strings.Index(row.Datatype, "ENUM") == 0 || strings.Index(row.Datatype, "BIT") == 0 || row.Datatype == "TSVECTOR" || row.Datatype == "RASTER" {
 		if row.Null == 0 {
 			return "string"
 		} else {
@@ -108,10 +108,22 @@ func mysqlToPsqlType(row Row) string {
 		return "geography(MULTIPOLYGON,4326)"
 	}
 
+	if row.Datatype == "VARCHAR(GEOMETRY)" {
+		return "geography(GEOMETRY,4326)"
+	}
+
 	if row.Datatype == "TIMESTAMP" {
 		return "timestamp with time zone"
 	}
 
+	if row.Datatype == "TSVECTOR" {
+		return "tsvector"
+	}
+
+	if row.Datatype == "RASTER" {
+		return "raster"
+	}
+
 	return row.Datatype
 }
 
@@ -123,6 +135,7 @@ func printPsql(sql Sql) {
 	constraints := ""
 	indexes := ""
 	times := "set timezone TO 'GMT';\n"
+	extensions := "CREATE EXTENSION IF NOT EXISTS unaccent;\nCREATE EXTENSION IF NOT EXISTS postgis_raster;\n"
 
 	var constraintRegexp = regexp.MustCompile(`xmltopsql:"([a-z]+)\:{1}([a-z]+)"`)
 
@@ -187,17 +200,31 @@ func printPsql(sql Sql) {
 
 				// search if the index concern a geographic column, so we use the correct index type to it
 				isgeo := false
+				istsv := false
+				israster := false
 				for _, keyname := range key.Parts {
 					for _, row := range table.Rows {
 						if row.Name == keyname {
 							if strings.Index(row.PsqlType, "geography(") == 0 {
 								isgeo = true
 							}
+							if row.PsqlType == "tsvector" {
+								istsv = true
+							}
+							if row.PsqlType == "raster" {
+								israster = true
+							}
 						}
 					}
 				}
 
-				if isgeo {
+				if israster {
+					indexes += fmt.Sprintf("CREATE INDEX \"i_%s.%s\" ON \"%s\" USING GIST ( ST_ConvexHull(\"%s\") );\n",
+						table.Name, strings.Join(key.Parts, ","), table.Name, strings.Join(key.Parts, "\"), ST_ConvexHull(\""))
+				} else if istsv {
+					indexes += fmt.Sprintf("CREATE INDEX \"i_%s.%s\" ON \"%s\" USING GIN ( \"%s\" );\n",
+						table.Name, strings.Join(key.Parts, ","), table.Name, strings.Join(key.Parts, "\", \""))
+				} else if isgeo {
 					indexes += fmt.Sprintf("CREATE INDEX \"i_%s.%s\" ON \"%s\" USING GIST ( \"%s\" );\n",
 						table.Name, strings.Join(key.Parts, ","), table.Name, strings.Join(key.Parts, "\", \""))
 				} else {
@@ -212,6 +239,7 @@ func printPsql(sql Sql) {
 		}
 		creates += fmt.Sprintf(");\n\n")
 	}
+	fmt.Println(extensions)
 	fmt.Println(types)
 	fmt.Println(creates)
 	fmt.Println(geoms)
@@ -143,6 +143,16 @@ func init() {
 			},
 			Json: reflect.TypeOf(DatabaseInfosParams{}),
 		},
+		&routes.Route{
+			Path:        "/api/database/extent",
+			Description: "Set the geographical extent of a database from its sites",
+			Func:        DatabaseSetExtent,
+			Method:      "POST",
+			Permissions: []string{
+				"import",
+			},
+			Json: reflect.TypeOf(DatabaseExtentParams{}),
+		},
 		&routes.Route{
 			Path:        "/api/licences",
 			Description: "Get list of licenses",
@@ -911,6 +921,55 @@ func DatabaseDelete(w http.ResponseWriter, r *http.Request, proute routes.Proute
 
 }
 
+// DatabaseExtentParams is the kind of extent computed from the sites of a database
+type DatabaseExtentParams struct {
+	Id            int     `json:"id" min:"1" error:"Database Id is mandatory"`
+	Extent        string  `json:"extent" enum:"bbox,convex_hull,concave_hull" default:"bbox" error:"DATABASE.FIELD_EXTENT.T_CHECK_INCORRECT"`
+	Concave_ratio float64 `json:"concave_ratio" min:"0" max:"1" default:"0.8"`
+}
+
+// DatabaseSetExtent set the geographical_extent_geom of a database to the bbox, convex hull or concave hull of its sites
+func DatabaseSetExtent(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	params := proute.Json.(*DatabaseExtentParams)
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Println("can't start transaction")
+		userSqlError(w, err)
+		return
+	}
+
+	d := model.Database{}
+	d.Id = params.Id
+
+	err = d.CacheGeomExtent(tx, params.Extent, params.Concave_ratio)
+	if err != nil {
+		log.Println("Unable to set database extent", err)
+		userSqlError(w, err)
+		tx.Rollback()
+		return
+	}
+
+	var geom string
+	err = tx.Get(&geom, "SELECT ST_AsGeoJSON(geographical_extent_geom) FROM database WHERE id = $1", d.Id)
+	if err != nil {
+		log.Println("Unable to get database extent", err)
+		userSqlError(w, err)
+		tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("Unable to set database extent")
+		userSqlError(w, err)
+		tx.Rollback()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(geom))
+}
+
 func DatabaseGetImportedCSV(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
 	params := proute.Params.(*DatabaseInfosParams)
 
@@ -0,0 +1,330 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package rest
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+
+	db "github.com/croll/arkeogis-server/db"
+	"github.com/croll/arkeogis-server/model"
+	"github.com/croll/arkeogis-server/webserver/routes"
+)
+
+func init() {
+	Routes := []*routes.Route{
+		&routes.Route{
+			Path:        "/api/dem",
+			Description: "Get the list of the registered DEMs",
+			Func:        DemList,
+			Method:      "GET",
+			Permissions: []string{
+				"request map",
+			},
+		},
+		&routes.Route{
+			Path:        "/api/dem",
+			Description: "Register a DEM, uploaded in PostGIS raster or read from a file on the server disk",
+			Func:        DemCreate,
+			Method:      "POST",
+			Json:        reflect.TypeOf(DemCreateParams{}),
+			Permissions: []string{
+				"manage all wms/wmts",
+			},
+		},
+		&routes.Route{
+			Path:        "/api/dem/delete",
+			Description: "Delete a DEM",
+			Func:        DemDelete,
+			Method:      "POST",
+			Json:        reflect.TypeOf(DemDeleteParams{}),
+			Permissions: []string{
+				"manage all wms/wmts",
+			},
+		},
+		&routes.Route{
+			Path:        "/api/dem/profile",
+			Description: "Get the elevation profile and the intervisibility between two sites",
+			Func:        DemProfile,
+			Method:      "POST",
+			Json:        reflect.TypeOf(DemProfileParams{}),
+			Permissions: []string{
+				"request map",
+			},
+		},
+	}
+	routes.RegisterMultiple(Routes)
+}
+
+// DemList returns all the registered DEMs
+func DemList(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	dems := []model.Dem{}
+	err := db.DB.Select(&dems, "SELECT * FROM dem ORDER BY name")
+	if err != nil {
+		log.Println("can't list dems", err)
+		userSqlError(w, err)
+		return
+	}
+
+	j, err := json.Marshal(dems)
+	if err != nil {
+		log.Println("marshal failed: ", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// DemCreateParams : with the postgis storage, the raster is the uploaded File,
+// with the disk storage, it is Filename, a path on the server
+type DemCreateParams struct {
+	Name     string       `json:"name" min:"1" max:"255" error:"DEM.FIELD_NAME.T_CHECK_MANDATORY"`
+	Storage  string       `json:"storage" enum:"postgis,disk" default:"postgis" error:"DEM.FIELD_STORAGE.T_CHECK_INCORRECT"`
+	Filename string       `json:"filename"`
+	File     *routes.File `json:"-"`
+}
+
+// DemCreate register a DEM and load its tiles
+func DemCreate(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	params := proute.Json.(*DemCreateParams)
+
+	_user, _ := proute.Session.Get("user")
+	user := _user.(model.User)
+
+	dem := model.Dem{
+		Name:            params.Name,
+		Storage:         params.Storage,
+		Filename:        params.Filename,
+		Creator_user_id: user.Id,
+	}
+
+	var content []byte
+	if params.Storage == model.DemStoragePostgis {
+		if params.File == nil {
+			routes.FieldError(w, "json.file", "file", "DEM.FIELD_FILE.T_CHECK_MANDATORY")
+			return
+		}
+		dem.Filename = params.File.Name
+		content = params.File.Content
+	} else if params.Filename == "" {
+		routes.FieldError(w, "json.filename", "filename", "DEM.FIELD_FILENAME.T_CHECK_MANDATORY")
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Println("can't start transaction")
+		userSqlError(w, err)
+		return
+	}
+
+	err = dem.Create(tx, content)
+	if err != nil {
+		log.Println("can't create dem", err)
+		userSqlError(w, err)
+		_ = tx.Rollback()
+		return
+	}
+
+	err = dem.Get(tx)
+	if err != nil {
+		log.Println("can't get dem", err)
+		userSqlError(w, err)
+		_ = tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("can't commit")
+		userSqlError(w, err)
+		return
+	}
+
+	j, err := json.Marshal(dem)
+	if err != nil {
+		log.Println("marshal failed: ", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+type DemDeleteParams struct {
+	Id int `json:"id" min:"1" error:"DEM.FIELD_ID.T_CHECK_MANDATORY"`
+}
+
+// DemDelete delete a DEM and its tiles
+func DemDelete(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	params := proute.Json.(*DemDeleteParams)
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Println("can't start transaction")
+		userSqlError(w, err)
+		return
+	}
+
+	dem := model.Dem{Id: params.Id}
+	err = dem.Delete(tx)
+	if err != nil {
+		log.Println("can't delete dem", err)
+		userSqlError(w, err)
+		_ = tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("can't commit")
+		userSqlError(w, err)
+		return
+	}
+}
+
+// DemProfileParams : heights are in metres above the ground, Refraction is
+// the atmospheric refraction coefficient used to correct the earth curvature
+type DemProfileParams struct {
+	Dem_id          int     `json:"dem_id" min:"1" error:"DEM.FIELD_ID.T_CHECK_MANDATORY"`
+	From_site_id    int     `json:"from_site_id" min:"1" error:"DEM.FIELD_FROM_SITE.T_CHECK_MANDATORY"`
+	To_site_id      int     `json:"to_site_id" min:"1" error:"DEM.FIELD_TO_SITE.T_CHECK_MANDATORY"`
+	Samples         int     `json:"samples" min:"2" max:"2000" default:"200" error:"DEM.FIELD_SAMPLES.T_CHECK_INCORRECT"`
+	Observer_height float64 `json:"observer_height" min:"0" default:"1.6"`
+	Target_height   float64 `json:"target_height" min:"0" default:"0"`
+	Refraction      float64 `json:"refraction" min:"0" max:"1" default:"0.13"`
+}
+
+// DemProfilePoint is a sample of the profile, distance is from the first site
+type DemProfilePoint struct {
+	Distance  float64  `json:"distance" db:"distance"`
+	Lng       float64  `json:"lng" db:"lng"`
+	Lat       float64  `json:"lat" db:"lat"`
+	Elevation *float64 `json:"elevation" db:"elevation"`
+}
+
+// DemProfileResult : Visible is null when the elevation of one of the sites is unknown
+type DemProfileResult struct {
+	Dem_id       int               `json:"dem_id"`
+	From_site_id int               `json:"from_site_id"`
+	To_site_id   int               `json:"to_site_id"`
+	Distance     float64           `json:"distance"`
+	Profile      []DemProfilePoint `json:"profile"`
+	Visible      *bool             `json:"visible"`
+	Obstruction  *DemProfilePoint  `json:"obstruction"`
+}
+
+// earthRadius is the mean radius of the earth in metres
+const earthRadius = 6371008.8
+
+// DemProfile sample the DEM along the line between two sites, and check if
+// the target site is visible from the observer site
+func DemProfile(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	params := proute.Json.(*DemProfileParams)
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Println("can't start transaction")
+		userSqlError(w, err)
+		return
+	}
+
+	dem := model.Dem{Id: params.Dem_id}
+	srid, err := dem.GetSrid(tx)
+	if err != nil {
+		log.Println("can't get dem srid", err)
+		userSqlError(w, err)
+		_ = tx.Rollback()
+		return
+	}
+
+	res := DemProfileResult{
+		Dem_id:       params.Dem_id,
+		From_site_id: params.From_site_id,
+		To_site_id:   params.To_site_id,
+		Profile:      []DemProfilePoint{},
+	}
+
+	err = tx.Select(&res.Profile, "WITH ends AS ("+
+		" SELECT a.geom::geometry AS a, b.geom::geometry AS b, ST_Distance(a.geom, b.geom) AS dist"+
+		" FROM site a JOIN database da ON da.id = a.database_id AND da.published = true,"+
+		" site b JOIN database db ON db.id = b.database_id AND db.published = true"+
+		" WHERE a.id = $2 AND b.id = $3"+
+		"), samples AS ("+
+		" SELECT i, i::float / $4::integer * dist AS distance, ST_LineInterpolatePoint(ST_MakeLine(a, b), i::float / $4::integer) AS p"+
+		" FROM ends, generate_series(0, $4::integer) i"+
+		")"+
+		" SELECT distance, ST_X(p) AS lng, ST_Y(p) AS lat, "+model.DemElevationSql("$1", srid, "p")+" AS elevation"+
+		" FROM samples ORDER BY i", params.Dem_id, params.From_site_id, params.To_site_id, params.Samples)
+	if err != nil {
+		log.Println("can't get dem profile", err)
+		userSqlError(w, err)
+		_ = tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("can't commit")
+		userSqlError(w, err)
+		return
+	}
+
+	if len(res.Profile) == 0 {
+		routes.FieldError(w, "json.from_site_id", "from_site_id", "DEM.FIELD_SITES.T_NOT_FOUND")
+		return
+	}
+
+	from := res.Profile[0]
+	to := res.Profile[len(res.Profile)-1]
+	res.Distance = to.Distance
+	if from.Elevation != nil && to.Elevation != nil {
+		// line of sight between the observer and the target, the terrain
+		// between them is raised by the earth curvature, less the refraction
+		hFrom := *from.Elevation + params.Observer_height
+		hTo := *to.Elevation + params.Target_height
+		visible := true
+		for i := 1; i < len(res.Profile)-1; i++ {
+			p := res.Profile[i]
+			if p.Elevation == nil {
+				continue
+			}
+			sight := hFrom + (hTo-hFrom)*p.Distance/res.Distance
+			bulge := p.Distance * (res.Distance - p.Distance) * (1 - params.Refraction) / (2 * earthRadius)
+			if *p.Elevation+bulge > sight {
+				visible = false
+				res.Obstruction = &res.Profile[i]
+				break
+			}
+		}
+		res.Visible = &visible
+	}
+
+	j, err := json.Marshal(res)
+	if err != nil {
+		log.Println("marshal failed: ", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
@@ -0,0 +1,158 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package rest
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+
+	db "github.com/croll/arkeogis-server/db"
+	"github.com/croll/arkeogis-server/geo"
+	"github.com/croll/arkeogis-server/webserver/routes"
+)
+
+func init() {
+	Routes := []*routes.Route{
+		&routes.Route{
+			Path:        "/api/geo/srs/{epsg:[0-9]+}",
+			Description: "Get a spatial reference system, with its domain of use",
+			Func:        GeoSpatialRef,
+			Method:      "GET",
+			Params:      reflect.TypeOf(GeoSpatialRefParams{}),
+			Permissions: []string{},
+		},
+		&routes.Route{
+			Path:        "/api/geo/transform",
+			Description: "Reproject a WKT geometry from a spatial reference system to another",
+			Func:        GeoTransform,
+			Method:      "POST",
+			Json:        reflect.TypeOf(GeoTransformParams{}),
+			Permissions: []string{},
+		},
+	}
+	routes.RegisterMultiple(Routes)
+}
+
+type GeoSpatialRefParams struct {
+	Epsg int `min:"1" error:"GEO.FIELD_EPSG.T_CHECK_INCORRECT"`
+}
+
+// GeoSpatialRef returns the spatial reference of an EPSG code
+func GeoSpatialRef(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	params := proute.Params.(*GeoSpatialRefParams)
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Println("can't start transaction")
+		userSqlError(w, err)
+		return
+	}
+
+	srs, err := geo.GetSpatialRef(tx, params.Epsg)
+	if err == geo.ErrUnknownEPSG {
+		routes.FieldError(w, "params.epsg", "epsg", "GEO.FIELD_EPSG.T_CHECK_NOT_EXISTS")
+		_ = tx.Rollback()
+		return
+	} else if err != nil {
+		log.Println("can't get spatial ref", err)
+		userSqlError(w, err)
+		_ = tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("can't commit")
+		userSqlError(w, err)
+		return
+	}
+
+	j, err := json.Marshal(srs)
+	if err != nil {
+		log.Println("marshal failed: ", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+type GeoTransformParams struct {
+	From int    `json:"from" min:"1" error:"GEO.FIELD_FROM.T_CHECK_INCORRECT"`
+	To   int    `json:"to" min:"1" default:"4326" error:"GEO.FIELD_TO.T_CHECK_INCORRECT"`
+	Wkt  string `json:"wkt" min:"1" error:"GEO.FIELD_WKT.T_CHECK_MANDATORY"`
+}
+
+// GeoTransform reproject a WKT geometry
+func GeoTransform(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	params := proute.Json.(*GeoTransformParams)
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Println("can't start transaction")
+		userSqlError(w, err)
+		return
+	}
+
+	for _, epsg := range []struct {
+		name  string
+		value int
+	}{{"from", params.From}, {"to", params.To}} {
+		_, err := geo.GetSpatialRef(tx, epsg.value)
+		if err == geo.ErrUnknownEPSG {
+			routes.FieldError(w, "json."+epsg.name, epsg.name, "GEO.FIELD_EPSG.T_CHECK_NOT_EXISTS")
+			_ = tx.Rollback()
+			return
+		} else if err != nil {
+			log.Println("can't get spatial ref", err)
+			userSqlError(w, err)
+			_ = tx.Rollback()
+			return
+		}
+	}
+
+	wkt, err := geo.TransformWKT(tx, params.Wkt, params.From, params.To)
+	if err != nil {
+		routes.FieldError(w, "json.wkt", "wkt", "GEO.FIELD_WKT.T_CHECK_INCORRECT")
+		_ = tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("can't commit")
+		userSqlError(w, err)
+		return
+	}
+
+	j, err := json.Marshal(struct {
+		Epsg int    `json:"epsg"`
+		Wkt  string `json:"wkt"`
+	}{params.To, wkt})
+	if err != nil {
+		log.Println("marshal failed: ", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
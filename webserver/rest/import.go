@@ -29,6 +29,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 
 	"log"
 	"net/http"
@@ -56,6 +57,16 @@ func init() {
 				"import",
 			},
 		},
+		&routes.Route{
+			Path:        "/api/import/dry-run",
+			Description: "Validate a CSV importation of sites without saving anything and return a report",
+			Func:        ImportDryRun,
+			Method:      "POST",
+			Json:        reflect.TypeOf(ImportStep1T{}),
+			Permissions: []string{
+				"import",
+			},
+		},
 		&routes.Route{
 			Path:        "/api/import/update-step1",
 			Description: "Four step of ArkeoGIS import procedure",
@@ -100,9 +111,21 @@ type ImportStep1T struct {
 	UseGeonames         bool
 	Separator           string `min:"1" max:"1" error:"Wrong separator"`
 	EchapCharacter      string `min:"1" max:"1" error:"Wrong echap characted"`
+	Profile_id          int
 	File                *routes.File
 }
 
+// ImportStep1Response is the result of the importation of a csv file
+type ImportStep1Response struct {
+	DatabaseId     int                           `json:"database_id"`
+	ImportId       int                           `json:"import_id"`
+	NumberOfSites  int                           `json:"nbSites"`
+	SitesWithError []string                      `json:"sitesWithError"`
+	Errors         []*databaseimport.ImportError `json:"errors"`
+	Lines          int                           `json:"nbLines"`
+	databaseimport.SitesChanges
+}
+
 // ImportStep1 is called by rest
 func ImportStep1(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
 
@@ -116,30 +139,69 @@ func ImportStep1(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
 	_user, _ := proute.Session.Get("user")
 	user := _user.(model.User)
 
-	filehash := fmt.Sprintf("%x", md5.Sum([]byte(params.File.Name)))
-	filepath := "./uploaded/databases/" + filehash + "_" + params.File.Name
-
-	var dbImport *databaseimport.DatabaseImport
-
-	outfile, err := os.Create(filepath)
+	filehash, filepath, err := saveImportFile(params.File)
 	if err != nil {
 		http.Error(w, "Error saving file: "+err.Error(), http.StatusBadRequest)
 		log.Println(err)
 		return
 	}
 
-	// Save the file on filesystem
-	_, err = io.WriteString(outfile, string(params.File.Content))
+	ticker := time.NewTicker(time.Second * 10)
+	w.Header().Set("Content-Type", "application/json")
+	go func() {
+		for range ticker.C {
+			w.Write([]byte(" "))
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+	}()
+	response, parserErrors := importCsv(params, user, filehash, filepath, nil)
+	ticker.Stop()
+
+	if len(parserErrors) > 0 {
+		sendError(w, parserErrors)
+		return
+	}
+
+	lok, _ := json.Marshal(response)
+	w.Write(lok)
+}
+
+// saveImportFile saves an uploaded csv file on filesystem
+func saveImportFile(file *routes.File) (filehash string, filepath string, err error) {
+	filehash = fmt.Sprintf("%x", md5.Sum([]byte(file.Name)))
+	filepath = "./uploaded/databases/" + filehash + "_" + file.Name
+
+	outfile, err := os.Create(filepath)
 	if err != nil {
-		http.Error(w, "Error saving file: "+err.Error(), http.StatusBadRequest)
-		log.Println(err)
 		return
 	}
+	defer outfile.Close()
+
+	_, err = io.WriteString(outfile, string(file.Content))
+	return
+}
+
+// importCsv imports the csv file saved at filepath. If job is not nil, its progress is updated every
+// databaseimport.ProgressStep lines and the import is rolled back when it is cancelled.
+// Errors preventing the import are returned as parser errors
+func importCsv(params *ImportStep1T, user model.User, filehash string, filepath string, job *databaseimport.Job) (*ImportStep1Response, []*databaseimport.ParserError) {
 
 	// Parse the file
 	parser, err := databaseimport.NewParser(filepath, params.Default_language, user.First_lang_isocode)
 	if err != nil {
-		parser.AddError("IMPORT.CSV_FILE.T_ERROR_PARSING_FAILED")
+		log.Println(err)
+		return nil, []*databaseimport.ParserError{&databaseimport.ParserError{ErrMsg: "IMPORT.CSV_FILE.T_ERROR_PARSING_FAILED"}}
+	}
+
+	// Use the column mapping of the chosen profile
+	if params.Profile_id > 0 {
+		parser.Mapping, err = getImportMapping(user.Id, params.Profile_id)
+		if err != nil {
+			log.Println(err)
+			return nil, []*databaseimport.ParserError{&databaseimport.ParserError{ErrMsg: "IMPORT.FIELD_PROFILE_ID.T_CHECK_INCORRECT"}}
+		}
 	}
 
 	// utf8 validation
@@ -148,30 +210,35 @@ func ImportStep1(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
 	}
 
 	if parser.HasError() {
-		sendError(w, parser.Errors)
-		return
+		return nil, parser.Errors
 	}
 
 	// Set parser preferences
 	parser.SetUserChoices("UseGeonames", params.UseGeonames)
 
 	// Init import
-	dbImport = new(databaseimport.DatabaseImport)
+	dbImport := new(databaseimport.DatabaseImport)
+
+	if job != nil {
+		parser.Progress = func(lines int) {
+			job.SetProgress(dbImport)
+		}
+		parser.Cancel = job.Cancelled()
+	}
+
 	err = dbImport.New(parser, user.Id, params.Name, params.Default_language, filehash, nil)
 	if err != nil {
 		parser.AddError(err.Error())
-		sendError(w, parser.Errors)
-		dbImport.Tx.Rollback()
-		return
+		if dbImport.Tx != nil {
+			dbImport.Tx.Rollback()
+		}
+		return nil, parser.Errors
 	}
 
 	// Analyze csv headers
 	if err = parser.CheckHeader(); err != nil {
-		if err != nil {
-			sendError(w, parser.Errors)
-			dbImport.Tx.Rollback()
-			return
-		}
+		dbImport.Tx.Rollback()
+		return nil, parser.Errors
 	}
 
 	// Record database essentials infos
@@ -186,56 +253,47 @@ func ImportStep1(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
 	err = dbImport.ProcessEssentialDatabaseInfos(params.Name, params.Geographical_extent, continentsID, countriesID)
 	if err != nil {
 		parser.AddError("Import: error processing essential infos " + err.Error())
-		sendError(w, parser.Errors)
 		dbImport.Tx.Rollback()
-		return
+		return nil, parser.Errors
+	}
+
+	err = parser.Parse(dbImport.ProcessRecord)
+	if job != nil {
+		job.SetProgress(dbImport)
+	}
+	if err == databaseimport.ErrCancelled {
+		parser.AddError(err.Error())
+		dbImport.Tx.Rollback()
+		return nil, parser.Errors
 	}
-	ticker := time.NewTicker(time.Second * 10)
-	w.Header().Set("Content-Type", "application/json")
-	go func() {
-		for range ticker.C {
-			w.Write([]byte(" "))
-			if f, ok := w.(http.Flusher); ok {
-				f.Flush()
-			}
-		}
-	}()
-	parser.Parse(dbImport.ProcessRecord)
-	ticker.Stop()
-	/*
-		if err != nil {
-			for siteCode, e := range dbImport.Errors {
-				fmt.Println("Error line", e.Line, "-- Site Code:", siteCode, "-- Column", strings.Join(e.Columns, ","), ":", e.ErrMsg)
-			}
-		}
-	*/
 
 	import_id, err := dbImport.Save(params.File.Name)
 	if err != nil {
 		parser.AddError("Error saving import " + err.Error())
 	}
 
-	if len(dbImport.SitesWithError) < dbImport.NumberOfSites-1 {
-		// Cache geom
-		err = dbImport.Database.CacheGeom(dbImport.Tx)
-		if err != nil {
-			parser.AddError("Error caching geom " + err.Error())
-		}
-
-		// Cache dates
-		err = dbImport.Database.CacheDates(dbImport.Tx)
-		if err != nil {
-			parser.AddError("Error caching dates" + err.Error())
+	// A job cancelled while saving is rolled back too
+	cancelled := false
+	if job != nil {
+		select {
+		case <-job.Cancelled():
+			cancelled = true
+		default:
 		}
+	}
 
+	if !cancelled && dbImport.NumberOfSitesWithError < dbImport.NumberOfSites-1 {
 		err = dbImport.Tx.Commit()
 		if err != nil {
 			parser.AddError("Error when inserting import into database: " + err.Error())
-			sendError(w, parser.Errors)
-			return
+			return nil, parser.Errors
 		}
 	} else {
 		err = dbImport.Tx.Rollback()
+		if cancelled {
+			parser.AddError(databaseimport.ErrCancelled.Error())
+			return nil, parser.Errors
+		}
 	}
 
 	// Prepare response
@@ -246,23 +304,145 @@ func ImportStep1(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
 		sitesWithError = append(sitesWithError, id)
 	}
 
-	response := struct {
-		DatabaseId     int                           `json:"database_id"`
-		ImportId       int                           `json:"import_id"`
-		NumberOfSites  int                           `json:"nbSites"`
-		SitesWithError []string                      `json:"sitesWithError"`
-		Errors         []*databaseimport.ImportError `json:"errors"`
-		Lines          int                           `json:"nbLines"`
-	}{
+	return &ImportStep1Response{
 		DatabaseId:     dbImport.Database.Id,
 		ImportId:       import_id,
 		NumberOfSites:  dbImport.NumberOfSites,
 		SitesWithError: sitesWithError,
 		Errors:         dbImport.Errors,
 		Lines:          dbImport.Parser.Line - 1, // Remove first line
+		SitesChanges:   dbImport.Changes,
+	}, nil
+}
+
+// ImportDryRun runs the whole import of the file in a transaction which is always rolled back,
+// so contributors can fix their file before importing it
+func ImportDryRun(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+
+	params := proute.Json.(*ImportStep1T)
+
+	if params.File == nil {
+		userSqlError(w, errors.New("No file provided"))
+		return
 	}
-	lok, _ := json.Marshal(response)
+
+	_user, _ := proute.Session.Get("user")
+	user := _user.(model.User)
+
+	// The file is only kept during the validation
+	outfile, err := ioutil.TempFile("", "arkeogis_dryrun_")
+	if err != nil {
+		log.Println(err)
+		routes.ServerError(w, 500, "INTERNAL ERROR")
+		return
+	}
+	defer os.Remove(outfile.Name())
+	_, err = outfile.Write(params.File.Content)
+	outfile.Close()
+	if err != nil {
+		log.Println(err)
+		routes.ServerError(w, 500, "INTERNAL ERROR")
+		return
+	}
+
+	parser, err := databaseimport.NewParser(outfile.Name(), params.Default_language, user.First_lang_isocode)
+	if err != nil {
+		log.Println(err)
+		sendError(w, []*databaseimport.ParserError{&databaseimport.ParserError{ErrMsg: "IMPORT.CSV_FILE.T_ERROR_PARSING_FAILED"}})
+		return
+	}
+
+	if params.Profile_id > 0 {
+		parser.Mapping, err = getImportMapping(user.Id, params.Profile_id)
+		if err != nil {
+			log.Println(err)
+			sendError(w, []*databaseimport.ParserError{&databaseimport.ParserError{ErrMsg: "IMPORT.FIELD_PROFILE_ID.T_CHECK_INCORRECT"}})
+			return
+		}
+	}
+
+	// utf8 validation
+	if !utf8.ValidString(string(params.File.Content)) {
+		parser.AddError("IMPORT.CSV_FILE.T_ERROR_NOT_UTF8_ENCODING")
+		sendError(w, parser.Errors)
+		return
+	}
+
+	parser.SetUserChoices("UseGeonames", params.UseGeonames)
+
+	dbImport := new(databaseimport.DatabaseImport)
+	err = dbImport.New(parser, user.Id, params.Name, params.Default_language, "", nil)
+	if dbImport.Tx != nil {
+		defer dbImport.Tx.Rollback()
+	}
+	if err != nil {
+		parser.AddError(err.Error())
+		sendError(w, parser.Errors)
+		return
+	}
+
+	if err = parser.CheckHeader(); err != nil {
+		sendError(w, parser.Errors)
+		return
+	}
+
+	var continentsID = make([]int, 0)
+	for _, c := range params.Continents {
+		continentsID = append(continentsID, c.Geonameid)
+	}
+	var countriesID = make([]int, 0)
+	for _, c := range params.Countries {
+		countriesID = append(countriesID, c.Geonameid)
+	}
+	err = dbImport.ProcessEssentialDatabaseInfos(params.Name, params.Geographical_extent, continentsID, countriesID)
+	if err != nil {
+		parser.AddError("Import: error processing essential infos " + err.Error())
+		sendError(w, parser.Errors)
+		return
+	}
+
+	// Spaces are sent while parsing to keep the connection alive. Once they started, the status
+	// can't be changed anymore, so errors are returned in the report
+	ticker := time.NewTicker(time.Second * 10)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
 	w.Header().Set("Content-Type", "application/json")
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				w.Write([]byte(" "))
+				if f, ok := w.(http.Flusher); ok {
+					f.Flush()
+				}
+			}
+		}
+	}()
+
+	var reportError string
+	err = parser.Parse(dbImport.ProcessRecord)
+	if err != nil && err != databaseimport.ErrErrorsDetected {
+		// The file could not be read until the end, the line is in the error message
+		log.Println(err)
+		parser.AddError(err.Error())
+		reportError = "IMPORT.CSV_FILE.T_ERROR_PARSING_FAILED"
+	} else if _, err = dbImport.Save(params.File.Name); err != nil {
+		// Saving the import deletes the removed sites and counts the changes, it is rolled back as well
+		log.Println(err)
+		reportError = "INTERNAL ERROR"
+	}
+
+	report := dbImport.Report()
+	report.Error = reportError
+
+	ticker.Stop()
+	close(done)
+	<-stopped
+
+	lok, _ := json.Marshal(report)
 	w.Write(lok)
 }
 
@@ -569,6 +749,8 @@ type ImportStep4T struct {
 	}
 }
 
+// ImportStep4 saves the informations about the sources of the database. Unlike the import of the file,
+// it only updates a few rows and is not run as an import job
 func ImportStep4(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
 
 	params := proute.Json.(*ImportStep4T)
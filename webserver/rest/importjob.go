@@ -0,0 +1,171 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"reflect"
+	"runtime/debug"
+
+	"github.com/croll/arkeogis-server/databaseimport"
+	"github.com/croll/arkeogis-server/model"
+	"github.com/croll/arkeogis-server/webserver/routes"
+)
+
+func init() {
+	Routes := []*routes.Route{
+		&routes.Route{
+			Path:        "/api/import/jobs",
+			Description: "Start the CSV importation of sites in a background job",
+			Func:        ImportJobStart,
+			Method:      "POST",
+			Json:        reflect.TypeOf(ImportStep1T{}),
+			Permissions: []string{
+				"import",
+			},
+		},
+		&routes.Route{
+			Path:        "/api/import/jobs",
+			Description: "List the import jobs of the user",
+			Func:        ImportJobList,
+			Method:      "GET",
+			Permissions: []string{
+				"import",
+			},
+		},
+		&routes.Route{
+			Path:        "/api/import/jobs/{id:[0-9]+}",
+			Description: "Get the status, progress and errors of an import job",
+			Func:        ImportJobGet,
+			Method:      "GET",
+			Params:      reflect.TypeOf(ImportJobParams{}),
+			Permissions: []string{
+				"import",
+			},
+		},
+		&routes.Route{
+			Path:        "/api/import/jobs/{id:[0-9]+}/cancel",
+			Description: "Cancel an import job, the import is rolled back",
+			Func:        ImportJobCancel,
+			Method:      "POST",
+			Params:      reflect.TypeOf(ImportJobParams{}),
+			Permissions: []string{
+				"import",
+			},
+		},
+	}
+	routes.RegisterMultiple(Routes)
+}
+
+// ImportJobParams is the id of an import job
+type ImportJobParams struct {
+	Id int `min:"1" error:"IMPORT.FIELD_JOB_ID.T_CHECK_INCORRECT"`
+}
+
+// ImportJobStart saves the uploaded file and runs its import in a worker goroutine.
+// It returns the job, which status can then be polled
+func ImportJobStart(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+
+	params := proute.Json.(*ImportStep1T)
+
+	if params.File == nil {
+		userSqlError(w, errors.New("No file provided"))
+		return
+	}
+
+	_user, _ := proute.Session.Get("user")
+	user := _user.(model.User)
+
+	filehash, filepath, err := saveImportFile(params.File)
+	if err != nil {
+		http.Error(w, "Error saving file: "+err.Error(), http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	job := databaseimport.NewJob(user.Id, params.File.Name)
+	go func() {
+		// A panic of the worker would stop the whole server and leave the job running forever
+		defer func() {
+			if r := recover(); r != nil {
+				log.Println("import job panic: ", r, "\n", string(debug.Stack()))
+				job.Finish(nil, []*databaseimport.ParserError{&databaseimport.ParserError{ErrMsg: "INTERNAL ERROR"}})
+			}
+		}()
+		response, parserErrors := importCsv(params, user, filehash, filepath, job)
+		job.Finish(response, parserErrors)
+	}()
+
+	sendJobStatus(w, job.Status())
+}
+
+// ImportJobList returns the import jobs of the user, so they can be found again after a reload
+func ImportJobList(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	_user, _ := proute.Session.Get("user")
+	user := _user.(model.User)
+
+	l, _ := json.Marshal(databaseimport.GetUserJobs(user.Id))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(l)
+}
+
+// ImportJobGet returns the status of an import job
+func ImportJobGet(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	params := proute.Params.(*ImportJobParams)
+
+	_user, _ := proute.Session.Get("user")
+	user := _user.(model.User)
+
+	job := databaseimport.GetJob(user.Id, params.Id)
+	if job == nil {
+		routes.FieldError(w, "id", "id", "IMPORT.FIELD_JOB_ID.T_CHECK_INCORRECT")
+		return
+	}
+
+	sendJobStatus(w, job.Status())
+}
+
+// ImportJobCancel cancels an import job
+func ImportJobCancel(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	params := proute.Params.(*ImportJobParams)
+
+	_user, _ := proute.Session.Get("user")
+	user := _user.(model.User)
+
+	job := databaseimport.GetJob(user.Id, params.Id)
+	if job == nil {
+		routes.FieldError(w, "id", "id", "IMPORT.FIELD_JOB_ID.T_CHECK_INCORRECT")
+		return
+	}
+
+	job.Cancel()
+	sendJobStatus(w, job.Status())
+}
+
+func sendJobStatus(w http.ResponseWriter, status databaseimport.JobStatus) {
+	l, _ := json.Marshal(status)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(l)
+}
@@ -0,0 +1,285 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"reflect"
+
+	"github.com/croll/arkeogis-server/databaseimport"
+	db "github.com/croll/arkeogis-server/db"
+	"github.com/croll/arkeogis-server/model"
+	"github.com/croll/arkeogis-server/webserver/routes"
+)
+
+func init() {
+	Routes := []*routes.Route{
+		&routes.Route{
+			Path:        "/api/import/profiles",
+			Description: "List the column mapping profiles the user can use to import csv files",
+			Func:        ImportProfileList,
+			Method:      "GET",
+			Permissions: []string{
+				"import",
+			},
+		},
+		&routes.Route{
+			Path:        "/api/import/profiles",
+			Description: "Create or update a column mapping profile",
+			Func:        ImportProfileSave,
+			Method:      "POST",
+			Json:        reflect.TypeOf(ImportProfileSaveParams{}),
+			Permissions: []string{
+				"import",
+			},
+		},
+		&routes.Route{
+			Path:        "/api/import/profiles/delete",
+			Description: "Delete a column mapping profile",
+			Func:        ImportProfileDelete,
+			Method:      "POST",
+			Json:        reflect.TypeOf(ImportProfileDeleteParams{}),
+			Permissions: []string{
+				"import",
+			},
+		},
+	}
+	routes.RegisterMultiple(Routes)
+}
+
+// ImportProfile is a column mapping profile with its mapping decoded
+type ImportProfile struct {
+	model.Import_profile
+	Mapping   databaseimport.Mapping `json:"mapping"`
+	Databases []int                  `json:"databases"`
+}
+
+// ImportProfileList returns the profiles of the user, and those linked to its databases
+func ImportProfileList(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	_user, _ := proute.Session.Get("user")
+	user := _user.(model.User)
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Println("can't start transaction")
+		userSqlError(w, err)
+		return
+	}
+
+	list, err := model.GetImportProfiles(tx, user.Id)
+	if err != nil {
+		log.Println(err)
+		userSqlError(w, err)
+		_ = tx.Rollback()
+		return
+	}
+
+	profiles := []ImportProfile{}
+	for _, p := range list {
+		profile := ImportProfile{Import_profile: p}
+		if err = json.Unmarshal([]byte(p.Mapping), &profile.Mapping); err != nil {
+			log.Println("import profile", p.Id, "has an invalid mapping:", err)
+		}
+		profile.Databases, err = p.GetDatabases(tx)
+		if err != nil {
+			log.Println(err)
+			userSqlError(w, err)
+			_ = tx.Rollback()
+			return
+		}
+		profiles = append(profiles, profile)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("can't commit")
+		userSqlError(w, err)
+		return
+	}
+
+	j, _ := json.Marshal(profiles)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// ImportProfileSaveParams is a profile to create, or to update if Id is set.
+// Databases are the databases the profile is shared with
+type ImportProfileSaveParams struct {
+	Id        int                    `json:"id"`
+	Name      string                 `json:"name" min:"1" max:"255" error:"IMPORT.FIELD_PROFILE_NAME.T_CHECK_MANDATORY"`
+	Mapping   databaseimport.Mapping `json:"mapping"`
+	Databases []int                  `json:"databases"`
+}
+
+// ImportProfileSave creates or updates a profile of the user
+func ImportProfileSave(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	params := proute.Json.(*ImportProfileSaveParams)
+
+	_user, _ := proute.Session.Get("user")
+	user := _user.(model.User)
+
+	if err := params.Mapping.Check(); err != nil {
+		routes.FieldError(w, "json.mapping", "mapping", err.Error())
+		return
+	}
+	mapping, _ := json.Marshal(params.Mapping)
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Println("can't start transaction")
+		userSqlError(w, err)
+		return
+	}
+
+	// Profiles can only be shared with databases of the user
+	if len(params.Databases) > 0 {
+		var count int
+		err = tx.Get(&count, "SELECT count(*) FROM \"database\" d WHERE d.id IN ("+model.IntJoin(params.Databases, true)+") AND (d.owner = $1 OR d.id IN (SELECT database_id FROM database__authors WHERE user_id = $1))", user.Id)
+		if err != nil {
+			log.Println(err)
+			userSqlError(w, err)
+			_ = tx.Rollback()
+			return
+		}
+		if count != len(params.Databases) {
+			_ = tx.Rollback()
+			routes.FieldError(w, "json.databases", "databases", "IMPORT.FIELD_PROFILE_DATABASES.T_CHECK_INCORRECT")
+			return
+		}
+	}
+
+	profile := model.Import_profile{
+		Id:      params.Id,
+		Name:    params.Name,
+		User_id: user.Id,
+		Mapping: string(mapping),
+	}
+
+	if params.Id > 0 {
+		previous := model.Import_profile{Id: params.Id}
+		err = previous.Get(tx)
+		if err != nil || previous.User_id != user.Id {
+			_ = tx.Rollback()
+			routes.FieldError(w, "json.id", "id", "IMPORT.FIELD_PROFILE_ID.T_CHECK_INCORRECT")
+			return
+		}
+		err = profile.Update(tx)
+	} else {
+		err = profile.Create(tx)
+	}
+	if err == nil {
+		err = profile.SetDatabases(tx, params.Databases)
+	}
+	if err != nil {
+		log.Println(err)
+		userSqlError(w, err)
+		_ = tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("can't commit")
+		userSqlError(w, err)
+		return
+	}
+
+	j, _ := json.Marshal(ImportProfile{Import_profile: profile, Mapping: params.Mapping, Databases: params.Databases})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// ImportProfileDeleteParams is the profile to delete
+type ImportProfileDeleteParams struct {
+	Id int `json:"id" min:"1" error:"IMPORT.FIELD_PROFILE_ID.T_CHECK_INCORRECT"`
+}
+
+// ImportProfileDelete deletes a profile of the user
+func ImportProfileDelete(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	params := proute.Json.(*ImportProfileDeleteParams)
+
+	_user, _ := proute.Session.Get("user")
+	user := _user.(model.User)
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Println("can't start transaction")
+		userSqlError(w, err)
+		return
+	}
+
+	profile := model.Import_profile{Id: params.Id}
+	err = profile.Get(tx)
+	if err != nil || profile.User_id != user.Id {
+		_ = tx.Rollback()
+		routes.FieldError(w, "json.id", "id", "IMPORT.FIELD_PROFILE_ID.T_CHECK_INCORRECT")
+		return
+	}
+
+	err = profile.Delete(tx)
+	if err != nil {
+		log.Println(err)
+		userSqlError(w, err)
+		_ = tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("can't commit")
+		userSqlError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status": "ok"}`))
+}
+
+// getImportMapping returns the mapping of the import profile, if the user can use it
+func getImportMapping(uid int, profileId int) (*databaseimport.Mapping, error) {
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	profile := model.Import_profile{Id: profileId}
+	usable, err := profile.IsUsableBy(tx, uid)
+	if err != nil {
+		return nil, err
+	}
+	if !usable {
+		return nil, errors.New("IMPORT.FIELD_PROFILE_ID.T_CHECK_INCORRECT")
+	}
+	if err = profile.Get(tx); err != nil {
+		return nil, err
+	}
+
+	mapping := &databaseimport.Mapping{}
+	if err = json.Unmarshal([]byte(profile.Mapping), mapping); err != nil {
+		return nil, err
+	}
+	return mapping, mapping.Check()
+}
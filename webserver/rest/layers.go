@@ -244,6 +244,16 @@ func SaveShpLayer(w http.ResponseWriter, r *http.Request, proute routes.Proute)
 			userSqlError(w, err)
 			return
 		}
+		// geojson is only replaced by a new file
+		if params.File != nil {
+			err = layer.UpdateGeojson(tx)
+			if err != nil {
+				log.Println(err)
+				_ = tx.Rollback()
+				userSqlError(w, err)
+				return
+			}
+		}
 	} else {
 		err = layer.Create(tx)
 		if err != nil {
@@ -254,6 +264,14 @@ func SaveShpLayer(w http.ResponseWriter, r *http.Request, proute routes.Proute)
 		}
 	}
 
+	err = layer.CacheFeatures(tx)
+	if err != nil {
+		log.Println("Error caching shapefile features: ", err)
+		_ = tx.Rollback()
+		userSqlError(w, err)
+		return
+	}
+
 	err = layer.SetAuthors(tx, params.Authors)
 	if err != nil {
 		log.Println("Error setting database authors: ", err)
@@ -32,10 +32,11 @@ import (
 
 	db "github.com/croll/arkeogis-server/db"
 	export "github.com/croll/arkeogis-server/export"
+	"github.com/croll/arkeogis-server/mapsearch"
 	"github.com/croll/arkeogis-server/model"
 	routes "github.com/croll/arkeogis-server/webserver/routes"
 	"github.com/jmoiron/sqlx"
-	sqlx_types "github.com/jmoiron/sqlx/types"
+	"github.com/lib/pq"
 )
 
 func init() {
@@ -60,584 +61,134 @@ func init() {
 				"request map",
 			},
 		},
-	}
-	routes.RegisterMultiple(Routes)
-}
-
-type MapSqlJoin struct {
-	JoinLeftTable  string
-	JoinLeftKey    string
-	JoinRightTable string
-	JoinRightKey   string
-}
-
-type MapSqlTableDef struct {
-	TableName string
-	Joins     []MapSqlJoin
-}
-
-var MapSqlDefSite = MapSqlTableDef{
-	TableName: "site",
-	Joins:     []MapSqlJoin{},
-}
-
-var MapSqlDefXSite = MapSqlTableDef{
-	TableName: "site",
-	Joins: []MapSqlJoin{
-		{
-			JoinLeftTable:  "site",
-			JoinLeftKey:    "id",
-			JoinRightTable: "site",
-			JoinRightKey:   "id",
-		},
-	},
-}
-
-var MapSqlDefDatabase = MapSqlTableDef{
-	TableName: "database",
-	Joins: []MapSqlJoin{
-		{
-			JoinLeftTable:  "site",
-			JoinLeftKey:    "database_id",
-			JoinRightTable: "database",
-			JoinRightKey:   "id",
-		},
-	},
-}
-
-var MapSqlDefSiteRange = MapSqlTableDef{
-	TableName: "site_range",
-	Joins: []MapSqlJoin{
-		{
-			JoinLeftTable:  "site",
-			JoinLeftKey:    "id",
-			JoinRightTable: "site_range",
-			JoinRightKey:   "site_id",
-		},
-	},
-}
-
-var MapSqlDefSiteRangeCharac = MapSqlTableDef{
-	TableName: "site_range__charac",
-	Joins: []MapSqlJoin{
-		{
-			JoinLeftTable:  "site_range",
-			JoinLeftKey:    "id",
-			JoinRightTable: "site_range__charac",
-			JoinRightKey:   "site_range_id",
-		},
-	},
-}
-
-var MapSqlDefSiteRangeCharacTr = MapSqlTableDef{
-	TableName: "site_range__charac_tr",
-	Joins: []MapSqlJoin{
-		{
-			JoinLeftTable:  "site_range__charac",
-			JoinLeftKey:    "id",
-			JoinRightTable: "site_range__charac_tr",
-			JoinRightKey:   "site_range__charac_id",
-		},
-		{
-			JoinLeftTable:  "database",
-			JoinLeftKey:    "default_language",
-			JoinRightTable: "site_range__charac_tr",
-			JoinRightKey:   "lang_isocode",
+		&routes.Route{
+			Path:        "/api/map/searchtogeojson",
+			Description: "Main map search function, result as a GeoJSON FeatureCollection",
+			Func:        MapSearchToGeoJSON,
+			Method:      "POST",
+			Json:        reflect.TypeOf(MapSearchParams{}),
+			Permissions: []string{
+				"request map",
+			},
 		},
-	},
-}
-
-type MapSqlQueryTable struct {
-	TableDef       *MapSqlTableDef
-	As             string
-	UsedForExclude bool
-}
-
-type MapSqlQueryWhere struct {
-	Table *MapSqlQueryTable
-	Where string
-	Args  []interface{}
-}
-
-type MapSqlQuery struct {
-	Tables []*MapSqlQueryTable
-	Wheres []*MapSqlQueryWhere
-}
-
-func (sql *MapSqlQuery) Init() {
-	sql.Tables = make([]*MapSqlQueryTable, 0)
-	sql.Wheres = make([]*MapSqlQueryWhere, 0)
-}
-
-func (sql *MapSqlQuery) AddTable(tabledef *MapSqlTableDef, as string, usedforexclude bool) {
-	for _, t := range sql.Tables {
-		if t.TableDef == tabledef && t.As == as && t.UsedForExclude == usedforexclude {
-			return // don't add any table, we already have one
-		}
-	}
-
-	t := MapSqlQueryTable{
-		TableDef:       tabledef,
-		As:             as,
-		UsedForExclude: usedforexclude,
 	}
-
-	sql.Tables = append(sql.Tables, &t)
-}
-
-func (sql *MapSqlQuery) FindTable(tableas string, trymebefore *MapSqlQueryTable) (table *MapSqlQueryTable, ok bool) {
-	if trymebefore != nil && (trymebefore.As == tableas || trymebefore.TableDef.TableName == tableas) {
-		return trymebefore, true
-	}
-	for _, t := range sql.Tables {
-		if t.As == tableas {
-			return t, true
-		}
-	}
-	return nil, false
+	routes.RegisterMultiple(Routes)
 }
 
-func (sql *MapSqlQuery) AddFilter(tableas string, where string, args ...interface{}) {
-	if table, ok := sql.FindTable(tableas, nil); ok {
-		sql.Wheres = append(sql.Wheres, &MapSqlQueryWhere{
-			Table: table,
-			Where: where,
-			Args:  args,
-		})
-	} else {
-		fmt.Println("BAD: add filter on an unknow tableas : ", tableas, where)
-	}
+// MapSearchParams is the query filter for searching sites, and how results are returned
+type MapSearchParams struct {
+	mapsearch.Params
+	Cluster MapSearchParamsCluster `json:"cluster"`
+	Page    MapSearchParamsPage    `json:"page"`
+	Facets  bool                   `json:"facets"`
+	Extent  MapSearchParamsExtent  `json:"extent"`
 }
 
-func (sql *MapSqlQuery) BuildQuery() (string, []interface{}) {
-	q := ""
-	joins_str := ""
-	joins_args := []interface{}{}
-	where_str := "1=1"
-	where_args := []interface{}{}
-
-	for _, table := range sql.Tables {
-		if len(table.TableDef.Joins) > 0 {
-			joins_str += ` LEFT JOIN "` + table.TableDef.TableName + `" AS "` + table.As + `"`
-		} else { // no join mean first table
-			q += `SELECT "` + table.As + `"."id" FROM "` + table.TableDef.TableName + `" AS "` + table.As + `" `
-		}
-		for i, join := range table.TableDef.Joins {
-			lefttable, _ := sql.FindTable(join.JoinLeftTable, nil)
-			righttable, _ := sql.FindTable(join.JoinRightTable, table)
-			if righttable == nil {
-				fmt.Println("BAD: right table not found : ", join.JoinRightTable)
-			}
-			if lefttable != nil {
-				if i == 0 {
-					joins_str += ` ON "`
-				} else {
-					joins_str += ` AND "`
-				}
-				joins_str += lefttable.As + `"."` + join.JoinLeftKey + `" = "` + righttable.As + `"."` + join.JoinRightKey + `"`
-			} else {
-				fmt.Println("BAD: left table not found : ", join.JoinLeftTable)
-			}
-		}
-
-		if table.UsedForExclude == false {
-			for _, where := range sql.Wheres {
-				if where.Table == table {
-					where_str += ` AND (` + where.Where + `)`
-					where_args = append(where_args, where.Args...)
-				}
-			}
-		} else {
-			for _, where := range sql.Wheres {
-				if where.Table == table {
-					joins_str += ` AND (` + where.Where + `)`
-					joins_args = append(joins_args, where.Args...)
-				}
-			}
-			where_str += ` AND "` + table.As + `".id IS NULL`
-		}
-	}
-
-	q += " " + joins_str + " WHERE " + where_str
-
-	// query end
-	q += " GROUP BY site.id"
-
-	// replace $$
-	q_copy := ""
-	for i := 1; i < 999; i++ {
-		q_copy = strings.Replace(q, "$$", "$"+strconv.Itoa(i), 1)
-		if q_copy == q {
-			break
-		}
-		q = q_copy
+// mapSearchSiteIds returns the ids of the sites matching the filters of a map search
+func mapSearchSiteIds(filters *mapsearch.MapSqlQuery, tx *sqlx.Tx) ([]int, error) {
+	q, q_args, err := filters.BuildQuery()
+	if err != nil {
+		return nil, err
 	}
+	fmt.Println("q: ", q, q_args)
 
-	return q, append(joins_args, where_args...)
-}
-
-type MapSearchParamsOthers struct {
-	Centroid      string   `json:"centroid"`
-	CharacsLinked string   `json:"characs_linked"`
-	Knowledges    []string `json:"knowledges"`
-	Occupation    []string `json:"occupation"`
-	TextSearch    string   `json:"text_search"`
-	TextSearchIn  []string `json:"text_search_in"`
-}
-
-type MapSearchParamsAreaGeometry struct {
-	Geometry sqlx_types.JSONText `json:"geometry"`
-}
-
-type MapSearchParamsArea struct {
-	Type    string                      `json:"type"`
-	Lat     float32                     `json:"lat"`
-	Lng     float32                     `json:"lng"`
-	Radius  float32                     `json:"radius"`
-	Geojson MapSearchParamsAreaGeometry `json:"geojson"`
-}
-
-type MapSearchParamsCharac struct {
-	Include     bool `json:"include"`
-	Exceptional bool `json:"exceptional"`
-	RootId      int  `json:"root_id"`
-}
-
-type MapSearchParamsChronology struct {
-	StartDate                int    `json:"start_date"`
-	EndDate                  int    `json:"end_date"`
-	ExistenceInsideInclude   string `json:"existence_inside_include"`
-	ExistenceInsidePart      string `json:"existence_inside_part"`
-	ExistenceInsideSureness  string `json:"existence_inside_sureness"`
-	ExistenceOutsideInclude  string `json:"existence_outside_include"`
-	ExistenceOutsideSureness string `json:"existence_outside_sureness"`
-	SelectedChronologyId     int    `json:"selected_chronology_id"`
+	site_ids := []int{}
+	err = tx.Select(&site_ids, q, q_args...)
+	return site_ids, err
 }
 
-// MapSearchParams is the query filter for searching sites
-type MapSearchParams struct {
-	Knowledge    map[string]bool               `json:"knowledge"`
-	Occupation   map[string]bool               `json:"occupation"`
-	Database     []int                         `json:"database"`
-	Chronologies []MapSearchParamsChronology   `json:"chronologies"`
-	Characs      map[int]MapSearchParamsCharac `json:"characs"`
-	Others       MapSearchParamsOthers         `json:"others"`
-	Area         MapSearchParamsArea           `json:"area"`
-}
+// Output formats of the map search
+const (
+	mapSearchOutputJSON    = "json"
+	mapSearchOutputCSV     = "csv"
+	mapSearchOutputGeoJSON = "geojson"
+)
 
 // MapSearch search for sites using many filters
 func MapSearch(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
-	mapSearch(w, r, proute, false)
+	mapSearch(w, r, proute, mapSearchOutputJSON)
 }
 
 func MapSearchToCSV(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
-	mapSearch(w, r, proute, true)
+	mapSearch(w, r, proute, mapSearchOutputCSV)
 }
 
-func mapSearch(w http.ResponseWriter, r *http.Request, proute routes.Proute, tocsv bool) {
-	// for measuring execution time
-	start := time.Now()
+// MapSearchToGeoJSON search for sites and stream them as a RFC 7946 FeatureCollection
+func MapSearchToGeoJSON(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	mapSearch(w, r, proute, mapSearchOutputGeoJSON)
+}
 
+func mapSearch(w http.ResponseWriter, r *http.Request, proute routes.Proute, output string) {
 	params := proute.Json.(*MapSearchParams)
 
-	fmt.Println("params: ", params)
-
-	tx, err := db.DB.Beginx()
-	if err != nil {
-		log.Println("can't start transaction")
-		userSqlError(w, err)
-		return
-	}
-
 	_user, _ := proute.Session.Get("user")
 	user := _user.(model.User)
 
-	//q := `SELECT site.id FROM site`
-
-	filters := MapSqlQuery{}
-	filters.Init()
-
-	// custom hard coded / mandatory filters
-	filters.AddTable(&MapSqlDefSite, "site", false)
-	filters.AddTable(&MapSqlDefDatabase, "database", false)
-	filters.AddFilter("database", `"database".published = true`)
-
-	// add database filter
-	filters.AddFilter("database", `"site".database_id IN (`+model.IntJoin(params.Database, true)+`)`)
-
-	// Area filter
-	fmt.Println(params.Area.Type, params.Area.Lat, params.Area.Lng, params.Area.Radius)
-	if params.Area.Type == "disc" || params.Area.Type == "custom" {
-		filters.AddFilter("site", `ST_DWithin("site".geom, Geography(ST_MakePoint($$, $$)), $$)`,
-			params.Area.Lng, params.Area.Lat, params.Area.Radius)
-	} else {
-		filters.AddFilter("site", `ST_Within("site".geom::geometry, ST_SetSRID(ST_GeomFromGeoJSON($$),4326))`,
-			params.Area.Geojson.Geometry)
-	}
-
-	// add centroid filter
-	switch params.Others.Centroid {
-	case "with":
-		filters.AddFilter("site", `"site".centroid = true`)
-	case "without":
-		filters.AddFilter("site", `"site".centroid = false`)
-	case "":
-		// do not filter
-	}
-
-	// add knowledge filter
-	str := ""
-	for _, knowledge := range params.Others.Knowledges {
-		switch knowledge {
-		case "literature", "surveyed", "dig", "not_documented", "prospected_aerial", "prospected_pedestrian":
-			if str == "" {
-				str += "'" + knowledge + "'"
-			} else {
-				str += ",'" + knowledge + "'"
-			}
-		}
-	}
-	if str != "" {
-		filters.AddTable(&MapSqlDefSiteRange, `site_range`, false)
-		filters.AddTable(&MapSqlDefSiteRangeCharac, `site_range__charac`, false)
-		filters.AddFilter("site_range__charac", `"site_range__charac".knowledge_type IN (`+str+`)`)
-	}
+	mapSearchRun(w, params, user, output)
+}
 
-	// add occupation filter
-	str = ""
-	for _, occupation := range params.Others.Knowledges {
-		switch occupation {
-		case "not_documented", "single", "continuous", "multiple":
-			if str == "" {
-				str += "'" + occupation + "'"
-			} else {
-				str += ",'" + occupation + "'"
-			}
-		}
-	}
-	if str != "" {
-		filters.AddFilter("site", `"site".occupation IN (`+str+`)`)
-	}
+// mapSearchRun search for sites and write them in the output format
+func mapSearchRun(w http.ResponseWriter, params *MapSearchParams, user model.User, output string) {
+	fmt.Println("params: ", params)
 
-	// text filter
-	if params.Others.TextSearch != "" {
-		str = "1=0"
-		args := []interface{}{}
-		for _, textSearchIn := range params.Others.TextSearchIn {
-			switch textSearchIn {
-			case "site_name":
-				args = append(args, "%"+params.Others.TextSearch+"%")
-				str += ` OR "site".name ILIKE $$`
-			case "city_name":
-				args = append(args, "%"+params.Others.TextSearch+"%")
-				str += ` OR "site".city_name ILIKE $$`
-			case "bibliography":
-				args = append(args, "%"+params.Others.TextSearch+"%")
-				filters.AddTable(&MapSqlDefSiteRange, `site_range`, false)
-				filters.AddTable(&MapSqlDefSiteRangeCharac, `site_range__charac`, false)
-				filters.AddTable(&MapSqlDefSiteRangeCharacTr, `site_range__charac_tr`, false)
-				str += ` OR "site_range__charac_tr".bibliography ILIKE $$`
-			case "comment":
-				args = append(args, "%"+params.Others.TextSearch+"%")
-				filters.AddTable(&MapSqlDefSiteRange, `site_range`, false)
-				filters.AddTable(&MapSqlDefSiteRangeCharac, `site_range__charac`, false)
-				filters.AddTable(&MapSqlDefSiteRangeCharacTr, `site_range__charac_tr`, false)
-				str += ` OR "site_range__charac_tr".comment ILIKE $$`
-			}
-		}
-		if str != "1=0" {
-			filters.AddFilter("site", str, args...)
-		}
+	filters, errors := mapsearch.Compile(&params.Params)
+	if len(errors) > 0 {
+		routes.Errors(w, errors)
+		return
 	}
 
-	// characs filters
-	includes := make(map[int][]int, 0)
-	excludes := make(map[int][]int, 0)
-	exceptionals := make(map[int][]int, 0)
-
-	for characid, sel := range params.Characs {
-		if sel.Include && !sel.Exceptional {
-			if _, ok := includes[sel.RootId]; !ok {
-				includes[sel.RootId] = make([]int, 0)
-			}
-			includes[sel.RootId] = append(includes[sel.RootId], characid)
-		} else if sel.Include && sel.Exceptional {
-			if _, ok := exceptionals[sel.RootId]; !ok {
-				exceptionals[sel.RootId] = make([]int, 0)
-			}
-			exceptionals[sel.RootId] = append(exceptionals[sel.RootId], characid)
-		} else if !sel.Include {
-			if _, ok := excludes[sel.RootId]; !ok {
-				excludes[sel.RootId] = make([]int, 0)
-			}
-			excludes[sel.RootId] = append(excludes[sel.RootId], characid)
-		}
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Println("can't start transaction")
+		userSqlError(w, err)
+		return
 	}
 
-	if params.Others.CharacsLinked == "all" {
-		for rootid, characids := range includes {
-			tableas := "site_range__charac_" + strconv.Itoa(rootid)
-			filters.AddTable(&MapSqlDefSiteRange, "site_range", false)
-			filters.AddTable(&MapSqlDefSiteRangeCharac, tableas, false)
-			filters.AddFilter(tableas, tableas+`.charac_id IN (`+model.IntJoin(characids, true)+`)`)
-		}
-
-		for rootid, characids := range exceptionals {
-			tableas := "site_range__charac_" + strconv.Itoa(rootid)
-			filters.AddTable(&MapSqlDefSiteRange, "site_range", false)
-			filters.AddTable(&MapSqlDefSiteRangeCharac, tableas, false)
-
-			q := "1=0"
-			for _, characid := range characids {
-				q += " OR " + tableas + ".charac_id = " + strconv.Itoa(characid) + " AND " + tableas + ".exceptional = true"
-			}
-
-			filters.AddFilter(tableas, q)
-		}
+	// relevance of each site for the full text search
+	rank, rankArgs := mapsearch.RankExpr(&params.Params)
 
-		for rootid, characids := range excludes {
-			tableas := "x_site_range__charac_" + strconv.Itoa(rootid)
-			filters.AddTable(&MapSqlDefSiteRange, "site_range", false)
-			filters.AddTable(&MapSqlDefSiteRangeCharac, tableas, true)
-			filters.AddFilter(tableas, tableas+".charac_id IN ("+model.IntJoin(characids, true)+")")
-		}
-
-	} else if params.Others.CharacsLinked == "at-least-one" { // default
-		s_includes := []int{}
-		s_excludes := []int{}
-		s_exceptionals := []int{}
-
-		for _, characids := range includes {
-			s_includes = append(s_includes, characids...)
-		}
-		for _, characids := range excludes {
-			s_excludes = append(s_excludes, characids...)
-		}
-		for _, characids := range exceptionals {
-			s_exceptionals = append(s_exceptionals, characids...)
-		}
-
-		if len(s_includes) > 0 {
-			filters.AddTable(&MapSqlDefSiteRange, "site_range", false)
-			filters.AddTable(&MapSqlDefSiteRangeCharac, "site_range__charac", false)
-			filters.AddFilter("site_range__charac", `site_range__charac.charac_id IN (`+model.IntJoin(s_includes, true)+`)`)
-		}
-
-		if len(s_excludes) > 0 {
-			filters.AddTable(&MapSqlDefSiteRange, "site_range", false)
-			filters.AddTable(&MapSqlDefSiteRangeCharac, "x_site_range__charac", true)
-			filters.AddFilter("x_site_range__charac", `x_site_range__charac.charac_id IN (`+model.IntJoin(s_includes, true)+`)`)
-		}
-
-		if len(s_exceptionals) > 0 {
-			filters.AddTable(&MapSqlDefSiteRange, "site_range", false)
-			filters.AddTable(&MapSqlDefSiteRangeCharac, "site_range__charac", false)
-			q := "1=0"
-			for _, characid := range s_exceptionals {
-				q += " OR site_range__charac.charac_id = " + strconv.Itoa(characid) + " AND site_range__charac.exceptional = true"
-			}
-			filters.AddFilter("site_range__charac", q)
+	var site_ids []int
+	var page *mapSearchPage
+	if params.Page.IsWanted() {
+		page, err = mapSearchSitesPage(params.Page, filters, rank, rankArgs, tx)
+		if err == errMapSearchBadCursor {
+			routes.FieldError(w, "json.page.cursor", "cursor", "MAP.FIELD_PAGE_CURSOR.T_CHECK_INCORRECT")
+			_ = tx.Rollback()
+			return
 		}
-	}
-
-	/*
-		if len(excludes) > 0 {
-			filters.AddExclude("site_range__charac", "x_site_range__charac.charac_id IN ("+model.IntJoin(excludes, true)+")")
+		if err == errMapSearchNoPosition {
+			routes.FieldError(w, "json.page.lng", "lng", "MAP.FIELD_PAGE_POSITION.T_CHECK_INCORRECT")
+			_ = tx.Rollback()
+			return
 		}
-	*/
-	for _, chronology := range params.Chronologies {
-
-		q := "1=1"
-
-		var start_date_str = strconv.Itoa(chronology.StartDate)
-		var end_date_str = strconv.Itoa(chronology.EndDate)
-
-		var tblname string
-		if chronology.ExistenceInsideInclude == "+" {
-			tblname = "site"
-		} else if chronology.ExistenceInsideInclude == "-" {
-			tblname = "x_site"
-		} else {
-			log.Println("ExistenceInsideInclude is bad : ", chronology.ExistenceInsideInclude)
+		if err != nil {
+			fmt.Println("query failed : ", err)
+			userSqlError(w, err)
 			_ = tx.Rollback()
 			return
 		}
+		site_ids = page.Sites
 
-		switch chronology.ExistenceInsideSureness {
-		case "potentially":
-			q += " AND " + tblname + ".start_date1 <= " + end_date_str + " AND " + tblname + ".end_date2 >= " + start_date_str
-			if chronology.ExistenceInsidePart == "full" {
-				q += " AND " + tblname + ".start_date1 >= " + start_date_str + " AND " + tblname + ".end_date2 <= " + end_date_str
-			}
-		case "certainly":
-			q += " AND " + tblname + ".start_date2 <= " + end_date_str + " AND " + tblname + ".end_date1 >= " + start_date_str
-			if chronology.ExistenceInsidePart == "full" {
-				q += " AND " + tblname + ".start_date2 >= " + start_date_str + " AND " + tblname + ".end_date1 <= " + end_date_str
-			}
-		case "potentially-only":
-			q += " AND " + tblname + ".start_date1 <= " + end_date_str + " AND " + tblname + ".end_date2 >= " + start_date_str
-			q += " AND " + tblname + ".start_date2 > " + end_date_str + " AND " + tblname + ".end_date1 < " + start_date_str
-
-			if chronology.ExistenceInsidePart == "full" {
-				q += " AND " + tblname + ".start_date1 >= " + start_date_str + " AND " + tblname + ".end_date2 <= " + end_date_str
-			}
+		// pagination infos are sent in headers, so every output format can be paginated
+		w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+		if page.NextCursor != "" {
+			w.Header().Set("X-Next-Cursor", page.NextCursor)
 		}
-
-		switch chronology.ExistenceOutsideInclude {
-		case "": // it can
-			// do nothing
-		case "+": // it must
-			switch chronology.ExistenceOutsideSureness {
-			case "potentially":
-				q += " AND (" + tblname + ".start_date2 < " + start_date_str + " OR " + tblname + ".end_date1 >= " + end_date_str + ")"
-			case "certainly":
-				q += " AND (" + tblname + ".start_date1 < " + start_date_str + " OR " + tblname + ".end_date1 >= " + end_date_str + ")"
-			case "potentially-only":
-				q += " AND (" + tblname + ".start_date2 < " + start_date_str + " AND " + tblname + ".start_date1 >= " + start_date_str
-				q += " OR " + tblname + ".end_date1 > " + end_date_str + " AND " + tblname + ".end_date2 <= " + end_date_str + ")"
-			}
-
-		case "-": // it must not
-			switch chronology.ExistenceOutsideSureness {
-			case "potentially":
-				q += " AND NOT (" + tblname + ".start_date2 < " + start_date_str + " OR " + tblname + ".end_date1 >= " + end_date_str + ")"
-			case "certainly":
-				q += " AND NOT (" + tblname + ".start_date1 < " + start_date_str + " OR " + tblname + ".end_date1 >= " + end_date_str + ")"
-			case "potentially-only":
-				q += " AND NOT (" + tblname + ".start_date2 < " + start_date_str + " AND " + tblname + ".start_date1 >= " + start_date_str
-				q += " OR " + tblname + ".end_date1 > " + end_date_str + " AND " + tblname + ".end_date2 <= " + end_date_str + ")"
-			}
-		}
-
-		if q != "1=1" {
-			if chronology.ExistenceInsideInclude == "+" {
-				filters.AddFilter("site", q)
-			} else if chronology.ExistenceInsideInclude == "-" {
-				filters.AddTable(&MapSqlDefXSite, "x_site", true)
-				filters.AddFilter("x_site", q)
-			}
+	} else if output != mapSearchOutputGeoJSON {
+		// the geojson output streams the sites from the filters query itself
+		site_ids, err = mapSearchSiteIds(filters, tx)
+		if err != nil {
+			fmt.Println("query failed : ", err)
+			userSqlError(w, err)
+			_ = tx.Rollback()
+			return
 		}
 	}
-
-	q, q_args := filters.BuildQuery()
-	fmt.Println("q: ", q, q_args)
-
-	site_ids := []int{}
-	err = tx.Select(&site_ids, q, q_args...)
-	if err != nil {
-		fmt.Println("query failed : ", err)
-		userSqlError(w, err)
-		_ = tx.Rollback()
-		return
-	}
 	//fmt.Println("site_ids : ", site_ids)
 
-	elapsed := time.Since(start)
-	fmt.Printf("Search took %s", elapsed)
-
 	res := ""
-	if tocsv {
-		fmt.Println("ICI")
+	switch output {
+	case mapSearchOutputCSV:
 		w.Header().Set("Content-Type", "text/csv")
 		csvContent, err := export.SitesAsCSV(nil, site_ids, user.First_lang_isocode, true, true, false, tx)
 		if err != nil {
@@ -648,9 +199,51 @@ func mapSearch(w http.ResponseWriter, r *http.Request, proute routes.Proute, toc
 		w.Header().Set("Content-Type", "text/csv")
 		w.Header().Set("Content-Disposition", "attachment; filename=export.csv")
 		w.Write([]byte(csvContent))
-	} else {
+	case mapSearchOutputGeoJSON:
+		err = mapWriteSitesAsGeoJSON(w, filters, page, user.First_lang_isocode, rank, rankArgs, tx)
+		if err != nil {
+			log.Println("can't export query as geojson")
+			userSqlError(w, err)
+			_ = tx.Rollback()
+			return
+		}
+		// the sites are already written, the search only read so there is nothing to commit
+		_ = tx.Rollback()
+		return
+	default:
 		w.Header().Set("Content-Type", "application/json")
-		res = mapGetSitesAsJson(site_ids, tx)
+		if page == nil && params.Cluster.IsWanted(len(site_ids)) {
+			res, err = mapGetClustersAsJson(params.Cluster, filters, tx)
+			if err != nil {
+				log.Println("can't cluster sites")
+				userSqlError(w, err)
+				_ = tx.Rollback()
+				return
+			}
+		} else {
+			res = mapGetSitesAsJson(site_ids, rank, rankArgs, tx)
+		}
+		if params.Facets {
+			facets, err := mapGetFacetsAsJson(filters, mapFacetsChronologyId(&params.Params), tx)
+			if err != nil {
+				log.Println("can't get facets")
+				userSqlError(w, err)
+				_ = tx.Rollback()
+				return
+			}
+			// facets are a foreign member of the FeatureCollection
+			res = strings.TrimSuffix(res, "}") + `, "facets": ` + facets + `}`
+		}
+		if params.Extent.IsWanted() {
+			extent, err := mapGetExtentAsJson(params.Extent, filters, tx)
+			if err != nil {
+				log.Println("can't get extent")
+				userSqlError(w, err)
+				_ = tx.Rollback()
+				return
+			}
+			res = strings.TrimSuffix(res, "}") + `, "extent": ` + extent + `}`
+		}
 	}
 	//mapDebug(site_ids, tx)
 
@@ -684,7 +277,9 @@ func mapDebug(sites []int, tx *sqlx.Tx) {
 	}*/
 }
 
-func mapGetSitesAsJson(sites []int, tx *sqlx.Tx) string {
+// mapGetSitesAsJson returns the sites as a geojson FeatureCollection. If rank
+// is set, the relevance of each site is returned in the "score" property
+func mapGetSitesAsJson(sites []int, rank string, rankArgs []interface{}, tx *sqlx.Tx) string {
 
 	// for measuring execution time
 	start := time.Now()
@@ -709,10 +304,14 @@ func mapGetSitesAsJson(sites []int, tx *sqlx.Tx) string {
 	q += `	)`
 	q += `	 FROM (SELECT si.id, si.code, si.name, si.centroid, si.occupation, si.start_date1, si.start_date2, si.end_date1, si.end_date2, d.id AS database_id, d.name as database_name FROM site si LEFT JOIN database d ON si.database_id = d.id WHERE si.id = s.id) site_infos`
 	q += `)`
+	if rank != "" {
+		q += `|| ', "score": ' || COALESCE((` + mapsearch.NumberArgs(rank, 1) + `)::text, 'null')`
+	}
 	q += `|| '}}'`
-	q += ` FROM site s WHERE s.id IN (` + model.IntJoin(sites, true) + `)`
+	q += ` FROM unnest(ARRAY[` + model.IntJoin(sites, true) + `]::integer[]) WITH ORDINALITY AS u(id, ord) JOIN site s ON s.id = u.id`
+	q += ` LEFT JOIN database d ON d.id = s.database_id ORDER BY u.ord`
 
-	err := tx.Select(&jsonResult, q)
+	err := tx.Select(&jsonResult, q, rankArgs...)
 
 	elapsed := time.Since(start)
 	fmt.Printf("mapGetSitesAsJson took %s", elapsed)
@@ -725,3 +324,97 @@ func mapGetSitesAsJson(sites []int, tx *sqlx.Tx) string {
 
 	return jsonString
 }
+
+// mapWriteSitesAsGeoJSON streams sites as a RFC 7946 FeatureCollection, one Feature per site.
+// The geometry of a feature is the point of the site, its polygon or line is the geom_shape property.
+// Site ranges, characs and database attributes are set as properties of each feature.
+// The sites are the ones matched by the filters, or the sites of the page when the search is paginated.
+// Once the features are being written, errors can't be sent anymore: they are logged and the output is truncated.
+func mapWriteSitesAsGeoJSON(w http.ResponseWriter, filters *mapsearch.MapSqlQuery, page *mapSearchPage, langIsocode string, rank string, rankArgs []interface{}, tx *sqlx.Tx) error {
+
+	var from, order string
+	var args []interface{}
+	if page != nil {
+		args = []interface{}{pq.Array(page.Sites)}
+		from, order = ` FROM unnest($1::integer[]) WITH ORDINALITY AS u(id, ord) JOIN site s ON s.id = u.id`, ` ORDER BY u.ord`
+	} else {
+		fq, fargs, err := filters.BuildQuery()
+		if err != nil {
+			return err
+		}
+		args = fargs
+		from, order = ` FROM site s JOIN (`+fq+`) f ON f.id = s.id`, ` ORDER BY s.id`
+	}
+	args = append(args, langIsocode)
+	langArg := "$" + strconv.Itoa(len(args))
+	if rank != "" {
+		rank = mapsearch.NumberArgs(rank, len(args)+1)
+		args = append(args, rankArgs...)
+	}
+
+	q := `SELECT json_build_object(`
+	q += `	'type', 'Feature',`
+	q += `	'id', s.id,`
+	q += `	'geometry', ST_AsGeoJSON(s.geom::geometry)::json,`
+	q += `	'properties', json_build_object(`
+	q += `		'id', s.id, 'code', s.code, 'name', s.name, 'city_name', s.city_name, 'city_geonameid', s.city_geonameid,`
+	q += `		'centroid', s.centroid, 'occupation', s.occupation, 'altitude', ST_Z(s.geom_3d::geometry), 'uncertainty_radius', s.uncertainty_radius, 'precision_class', s.precision_class,`
+	q += `		'geom_shape', ST_AsGeoJSON(s.geom_shape::geometry)::json,`
+	q += `		'start_date1', s.start_date1, 'start_date2', s.start_date2, 'end_date1', s.end_date1, 'end_date2', s.end_date2,`
+	q += `		'database_id', d.id, 'database_name', d.name, 'database_type', d.type, 'database_scale_resolution', d.scale_resolution,`
+	q += `		'database_state', d.state, 'database_editor', d.editor, 'database_default_language', d.default_language, 'database_license', l.name,`
+	if rank != "" {
+		q += `		'score', ` + rank + `,`
+	}
+	q += `		'site_ranges', (`
+	q += `			SELECT json_agg(json_build_object(`
+	q += `				'start_date1', sr.start_date1, 'start_date2', sr.start_date2, 'end_date1', sr.end_date1, 'end_date2', sr.end_date2,`
+	q += `				'characs', (`
+	q += `					SELECT json_agg(json_build_object(`
+	q += `						'charac_id', src.charac_id, 'name', ctr.name, 'exceptional', src.exceptional, 'knowledge_type', src.knowledge_type,`
+	q += `						'comment', srctr.comment, 'bibliography', srctr.bibliography`
+	q += `					) ORDER BY src.id)`
+	q += `					FROM site_range__charac src`
+	q += `					LEFT JOIN charac_tr ctr ON ctr.charac_id = src.charac_id AND ctr.lang_isocode = ` + langArg
+	q += `					LEFT JOIN site_range__charac_tr srctr ON srctr.site_range__charac_id = src.id AND srctr.lang_isocode = d.default_language`
+	q += `					WHERE src.site_range_id = sr.id`
+	q += `				)`
+	q += `			) ORDER BY sr.id) FROM site_range sr WHERE sr.site_id = s.id`
+	q += `		)`
+	q += `	)`
+	q += `)::text`
+	q += from
+	q += ` LEFT JOIN database d ON s.database_id = d.id LEFT JOIN license l ON d.license_id = l.id`
+	q += order
+
+	rows, err := tx.Query(q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.Header().Set("Content-Disposition", "attachment; filename=export.geojson")
+
+	w.Write([]byte(`{"type": "FeatureCollection", "features": [`))
+	first := true
+	for rows.Next() {
+		var feature string
+		if err = rows.Scan(&feature); err != nil {
+			log.Println("geojson output truncated: ", err)
+			return nil
+		}
+		if !first {
+			w.Write([]byte(","))
+		}
+		w.Write([]byte(feature))
+		first = false
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("geojson output truncated: ", err)
+		return nil
+	}
+	w.Write([]byte(`]}`))
+
+	return nil
+}
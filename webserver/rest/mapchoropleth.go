@@ -0,0 +1,135 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package rest
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	db "github.com/croll/arkeogis-server/db"
+	"github.com/croll/arkeogis-server/mapsearch"
+	"github.com/croll/arkeogis-server/model"
+	"github.com/croll/arkeogis-server/webserver/routes"
+)
+
+func init() {
+	Routes := []*routes.Route{
+		&routes.Route{
+			Path:        "/api/map/choropleth",
+			Description: "Count the sites of a map search per country, continent or city, as a GeoJSON FeatureCollection",
+			Func:        MapChoropleth,
+			Method:      "POST",
+			Json:        reflect.TypeOf(MapChoroplethParams{}),
+			Permissions: []string{
+				"request map",
+			},
+		},
+	}
+	routes.RegisterMultiple(Routes)
+}
+
+// MapChoroplethParams are the map search filters, and the administrative unit used to count sites
+type MapChoroplethParams struct {
+	mapsearch.Params
+	Unit string `json:"unit" enum:"country,continent,city" error:"MAP.FIELD_CHOROPLETH_UNIT.T_CHECK_INCORRECT"`
+}
+
+// MapChoropleth count the sites of a map search per administrative unit. Sites
+// are joined to countries and continents by their geometries, and to cities
+// by the city of the site.
+func MapChoropleth(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	params := proute.Json.(*MapChoroplethParams)
+
+	_user, _ := proute.Session.Get("user")
+	user := _user.(model.User)
+
+	filters, errors := mapsearch.Compile(&params.Params)
+	if len(errors) > 0 {
+		routes.Errors(w, errors)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Println("can't start transaction")
+		userSqlError(w, err)
+		return
+	}
+
+	q, q_args, err := filters.BuildQuery()
+	if err != nil {
+		log.Println("can't build the search query : ", err)
+		routes.ServerError(w, 500, "INTERNAL ERROR")
+		_ = tx.Rollback()
+		return
+	}
+	langArg := "$" + strconv.Itoa(len(q_args)+1)
+
+	var unit string
+	switch params.Unit {
+	case "continent":
+		unit = `SELECT u.geonameid, u.iso_code, u.geom::geometry AS geom, count(s.id) AS count` +
+			` FROM continent u JOIN site s ON ST_Covers(u.geom, s.geom)` +
+			` WHERE s.id IN (SELECT id FROM sites) GROUP BY u.geonameid`
+	case "city":
+		unit = `SELECT u.geonameid, NULL::text AS iso_code, COALESCE(u.geom, u.geom_centroid)::geometry AS geom, count(s.id) AS count` +
+			` FROM city u JOIN site s ON s.city_geonameid = u.geonameid` +
+			` WHERE s.id IN (SELECT id FROM sites) GROUP BY u.geonameid`
+	default:
+		unit = `SELECT u.geonameid, u.iso_code, u.geom::geometry AS geom, count(s.id) AS count` +
+			` FROM country u JOIN site s ON ST_Covers(u.geom, s.geom)` +
+			` WHERE s.id IN (SELECT id FROM sites) GROUP BY u.geonameid`
+	}
+	// translated names of the units
+	name := `(SELECT name FROM ` + params.Unit + `_tr WHERE ` + params.Unit + `_geonameid = u.geonameid AND lang_isocode = %s LIMIT 1)`
+
+	res := ""
+	err = tx.Get(&res, `WITH sites AS (`+q+`), units AS (`+unit+`)`+
+		` SELECT json_build_object('type', 'FeatureCollection', 'features', COALESCE(json_agg(json_build_object(`+
+		`  'type', 'Feature',`+
+		`  'id', u.geonameid,`+
+		`  'geometry', ST_AsGeoJSON(u.geom)::json,`+
+		`  'properties', json_build_object(`+
+		`   'geonameid', u.geonameid, 'iso_code', u.iso_code, 'count', u.count,`+
+		`   'name', COALESCE(`+fmt.Sprintf(name, langArg)+`, `+fmt.Sprintf(name, "'en'")+`)`+
+		`  )`+
+		` ) ORDER BY u.count DESC), '[]'))::text FROM units u`, append(q_args, user.First_lang_isocode)...)
+	if err != nil {
+		log.Println("choropleth query failed : ", err)
+		userSqlError(w, err)
+		_ = tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("can't commit")
+		userSqlError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.Write([]byte(res))
+}
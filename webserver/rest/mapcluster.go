@@ -0,0 +1,122 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package rest
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/croll/arkeogis-server/mapsearch"
+	"github.com/jmoiron/sqlx"
+)
+
+// MapSearchParamsBbox is a bounding box in WGS84 coordinates
+type MapSearchParamsBbox struct {
+	MinLng float64 `json:"min_lng"`
+	MinLat float64 `json:"min_lat"`
+	MaxLng float64 `json:"max_lng"`
+	MaxLat float64 `json:"max_lat"`
+}
+
+// IsSet returns true if the bounding box is not empty
+func (b MapSearchParamsBbox) IsSet() bool {
+	return b.MinLng != b.MaxLng && b.MinLat != b.MaxLat
+}
+
+// MapSearchParamsCluster configure the clustering of search results.
+// When Type is empty, sites are returned one by one as usual.
+type MapSearchParamsCluster struct {
+	Type      string              `json:"type" enum:",grid,geohash" error:"MAP.FIELD_CLUSTER_TYPE.T_CHECK_INCORRECT"`
+	Zoom      int                 `json:"zoom" min:"0" max:"22" error:"MAP.FIELD_CLUSTER_ZOOM.T_CHECK_INCORRECT"`
+	Bbox      MapSearchParamsBbox `json:"bbox"`
+	Threshold int                 `json:"threshold" min:"0" error:"MAP.FIELD_CLUSTER_THRESHOLD.T_CHECK_INCORRECT"`
+}
+
+// mapClusterMaxZoom is the zoom level from which sites are never clustered
+const mapClusterMaxZoom = 14
+
+// mapClusterCellsPerTile is the number of grid cells on each side of a 256px tile
+const mapClusterCellsPerTile = 4
+
+// IsWanted returns true if the result of a search of nbSites sites has to be clustered
+func (c MapSearchParamsCluster) IsWanted(nbSites int) bool {
+	if c.Type == "" || c.Zoom >= mapClusterMaxZoom {
+		return false
+	}
+	return nbSites > c.Threshold
+}
+
+// cellExpr returns the sql expression grouping geometry g in a cell at the current zoom level
+func (c MapSearchParamsCluster) cellExpr() string {
+	switch c.Type {
+	case "geohash":
+		// roughly 5 bits per character, 2 zoom levels per bit pair
+		precision := c.Zoom/2 + 1
+		if precision > 12 {
+			precision = 12
+		}
+		return "ST_GeoHash(g, " + strconv.Itoa(precision) + ")"
+	default:
+		size := 360 / math.Pow(2, float64(c.Zoom)) / mapClusterCellsPerTile
+		return "ST_AsText(ST_SnapToGrid(g, " + strconv.FormatFloat(size, 'f', -1, 64) + "))"
+	}
+}
+
+// mapGetClustersAsJson aggregates sites in clusters computed by PostGIS and returns them as a FeatureCollection.
+// Each cluster is a point feature at the centroid of its sites, with its count, bbox, dominant database and date span.
+// The sites are the ones matched by the filters, selected by PostgreSQL in the same query.
+func mapGetClustersAsJson(cluster MapSearchParamsCluster, filters *mapsearch.MapSqlQuery, tx *sqlx.Tx) (string, error) {
+
+	fq, args, err := filters.BuildQuery()
+	if err != nil {
+		return "", err
+	}
+
+	q := `WITH s AS (`
+	q += `	SELECT id, geom::geometry AS g, database_id,`
+	q += `	NULLIF(start_date1, -2147483648) AS start_date, NULLIF(end_date2, 2147483647) AS end_date`
+	q += `	FROM site WHERE id IN (` + fq + `)`
+	if cluster.Bbox.IsSet() {
+		q += ` AND geom::geometry && ST_MakeEnvelope(` + mapsearch.NumberArgs("$$, $$, $$, $$", len(args)+1) + `, 4326)`
+		args = append(args, cluster.Bbox.MinLng, cluster.Bbox.MinLat, cluster.Bbox.MaxLng, cluster.Bbox.MaxLat)
+	}
+	q += `), c AS (`
+	q += `	SELECT ` + cluster.cellExpr() + ` AS cell, count(*) AS count, ST_Centroid(ST_Collect(g)) AS center, ST_Extent(g) AS extent,`
+	q += `	mode() WITHIN GROUP (ORDER BY database_id) AS database_id, min(start_date) AS start_date, max(end_date) AS end_date`
+	q += `	FROM s GROUP BY cell`
+	q += `)`
+	q += `SELECT json_build_object('type', 'FeatureCollection', 'clustered', true, 'features', COALESCE(json_agg(json_build_object(`
+	q += `	'type', 'Feature',`
+	q += `	'geometry', ST_AsGeoJSON(c.center)::json,`
+	q += `	'properties', json_build_object(`
+	q += `		'cluster', true, 'count', c.count,`
+	q += `		'bbox', json_build_array(ST_XMin(c.extent), ST_YMin(c.extent), ST_XMax(c.extent), ST_YMax(c.extent)),`
+	q += `		'database_id', c.database_id, 'database_name', d.name,`
+	q += `		'start_date', c.start_date, 'end_date', c.end_date`
+	q += `	)`
+	q += `)), '[]'))::text FROM c LEFT JOIN database d ON c.database_id = d.id`
+
+	var jsonResult string
+	err = tx.Get(&jsonResult, q, args...)
+
+	return jsonResult, err
+}
@@ -0,0 +1,76 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package rest
+
+import (
+	"encoding/json"
+
+	"github.com/croll/arkeogis-server/mapsearch"
+	"github.com/croll/arkeogis-server/model"
+	"github.com/jmoiron/sqlx"
+)
+
+// MapSearchParamsExtent are the extents of the matched sites returned with a
+// map search. Concave_ratio is the target percent of area of the concave hull.
+type MapSearchParamsExtent struct {
+	Bbox          bool    `json:"bbox"`
+	Convex_hull   bool    `json:"convex_hull"`
+	Concave_hull  bool    `json:"concave_hull"`
+	Concave_ratio float64 `json:"concave_ratio" min:"0" max:"1" default:"0.8" error:"MAP.FIELD_EXTENT_CONCAVE_RATIO.T_CHECK_INCORRECT"`
+}
+
+// IsWanted returns true if at least one extent is asked
+func (e MapSearchParamsExtent) IsWanted() bool {
+	return e.Bbox || e.Convex_hull || e.Concave_hull
+}
+
+// mapGetExtentAsJson returns the wanted extents of all the sites matching the
+// filters, as GeoJSON geometries
+func mapGetExtentAsJson(e MapSearchParamsExtent, filters *mapsearch.MapSqlQuery, tx *sqlx.Tx) (string, error) {
+	q, q_args, err := filters.BuildQuery()
+	if err != nil {
+		return "", err
+	}
+
+	extents := map[string]json.RawMessage{}
+	for _, kind := range []struct {
+		name   string
+		wanted bool
+	}{
+		{model.ExtentBbox, e.Bbox},
+		{model.ExtentConvexHull, e.Convex_hull},
+		{model.ExtentConcaveHull, e.Concave_hull},
+	} {
+		if !kind.wanted {
+			continue
+		}
+		var geojson string
+		err := tx.Get(&geojson, "SELECT COALESCE(ST_AsGeoJSON(("+model.ExtentQuery(kind.name, e.Concave_ratio, q)+")), 'null')", q_args...)
+		if err != nil {
+			return "", err
+		}
+		extents[kind.name] = json.RawMessage(geojson)
+	}
+
+	j, err := json.Marshal(extents)
+	return string(j), err
+}
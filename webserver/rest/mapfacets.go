@@ -0,0 +1,91 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package rest
+
+import (
+	"strconv"
+
+	"github.com/croll/arkeogis-server/mapsearch"
+	"github.com/jmoiron/sqlx"
+)
+
+// mapFacetsChronologyId returns the selected chronology of the search, or 0 if there is none
+func mapFacetsChronologyId(params *mapsearch.Params) int {
+	for _, chronology := range params.Chronologies {
+		if chronology.SelectedChronologyId > 0 {
+			return chronology.SelectedChronologyId
+		}
+	}
+	return 0
+}
+
+// mapGetFacetsAsJson returns the composition of the sites matched by the
+// filters: counts of sites per database, charac (each charac also counts the
+// sites of its children), knowledge type, occupation, centroid flag and period
+// of the selected chronology.
+func mapGetFacetsAsJson(filters *mapsearch.MapSqlQuery, chronologyId int, tx *sqlx.Tx) (string, error) {
+
+	q, q_args, err := filters.BuildQuery()
+	if err != nil {
+		return "", err
+	}
+
+	chronologyArg := "$" + strconv.Itoa(len(q_args)+1) + "::integer"
+
+	sql := `WITH RECURSIVE sites AS (` + q + `),`
+	// every charac with all its ancestors
+	sql += ` charac_tree(id, ancestor_id) AS (`
+	sql += `  SELECT id, id FROM charac`
+	sql += `  UNION ALL SELECT t.id, c.parent_id FROM charac_tree t JOIN charac c ON c.id = t.ancestor_id WHERE c.parent_id != 0`
+	sql += ` ),`
+	// periods of the selected chronology
+	sql += ` periods(id) AS (`
+	sql += `  SELECT id FROM chronology WHERE parent_id = ` + chronologyArg + ` AND ` + chronologyArg + ` > 0`
+	sql += `  UNION ALL SELECT c.id FROM chronology c JOIN periods p ON c.parent_id = p.id`
+	sql += ` ),`
+	sql += ` src AS (`
+	sql += `  SELECT sr.site_id, sr.start_date1, sr.end_date2, src.charac_id, src.knowledge_type FROM site_range sr`
+	sql += `  LEFT JOIN site_range__charac src ON src.site_range_id = sr.id WHERE sr.site_id IN (SELECT id FROM sites)`
+	sql += ` )`
+	sql += ` SELECT json_build_object(`
+	sql += `  'total', (SELECT count(*) FROM sites),`
+	sql += `  'databases', (SELECT COALESCE(json_agg(json_build_object('id', d.id, 'name', d.name, 'count', x.count) ORDER BY x.count DESC), '[]')`
+	sql += `   FROM (SELECT s.database_id, count(*) FROM site s WHERE s.id IN (SELECT id FROM sites) GROUP BY s.database_id) x JOIN database d ON d.id = x.database_id),`
+	sql += `  'characs', (SELECT COALESCE(json_agg(json_build_object('id', c.id, 'parent_id', c.parent_id, 'count', x.count) ORDER BY c.id), '[]')`
+	sql += `   FROM (SELECT t.ancestor_id, count(DISTINCT src.site_id) FROM src JOIN charac_tree t ON t.id = src.charac_id GROUP BY t.ancestor_id) x JOIN charac c ON c.id = x.ancestor_id),`
+	sql += `  'knowledge_types', (SELECT COALESCE(json_object_agg(x.knowledge_type, x.count), '{}')`
+	sql += `   FROM (SELECT src.knowledge_type, count(DISTINCT src.site_id) FROM src WHERE src.knowledge_type IS NOT NULL GROUP BY src.knowledge_type) x),`
+	sql += `  'occupations', (SELECT COALESCE(json_object_agg(x.occupation, x.count), '{}')`
+	sql += `   FROM (SELECT s.occupation, count(*) FROM site s WHERE s.id IN (SELECT id FROM sites) GROUP BY s.occupation) x),`
+	sql += `  'centroids', (SELECT COALESCE(json_object_agg(x.centroid, x.count), '{}')`
+	sql += `   FROM (SELECT s.centroid, count(*) FROM site s WHERE s.id IN (SELECT id FROM sites) GROUP BY s.centroid) x),`
+	sql += `  'chronologies', (SELECT COALESCE(json_agg(json_build_object('id', c.id, 'parent_id', c.parent_id, 'count', x.count) ORDER BY c.start_date, c.id), '[]')`
+	sql += `   FROM (SELECT p.id, count(DISTINCT src.site_id) FROM periods p JOIN chronology c ON c.id = p.id`
+	sql += `    JOIN src ON src.start_date1 <= c.end_date AND src.end_date2 >= c.start_date`
+	sql += `    WHERE src.start_date1 != -2147483648 AND src.end_date2 != 2147483647 GROUP BY p.id) x JOIN chronology c ON c.id = x.id)`
+	sql += ` )::text`
+
+	facets := ""
+	err = tx.Get(&facets, sql, append(q_args, chronologyId)...)
+
+	return facets, err
+}
@@ -0,0 +1,389 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package rest
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	db "github.com/croll/arkeogis-server/db"
+	"github.com/croll/arkeogis-server/mapsearch"
+	"github.com/croll/arkeogis-server/webserver/routes"
+)
+
+func init() {
+	Routes := []*routes.Route{
+		&routes.Route{
+			Path:        "/api/map/heatmap",
+			Description: "Compute a kernel density raster of the sites of a map search, as a GeoTIFF or a PNG with a world file",
+			Func:        MapHeatmap,
+			Method:      "POST",
+			Json:        reflect.TypeOf(MapHeatmapParams{}),
+			Permissions: []string{
+				"request map",
+			},
+		},
+	}
+	routes.RegisterMultiple(Routes)
+}
+
+// mapHeatmapMaxCells is the maximum number of cells of a heatmap raster
+const mapHeatmapMaxCells = 4000000
+
+// mapHeatmapMaxOperations is the maximum number of kernel values computed for a heatmap: the number of
+// cells containing sites, multiplied by the number of cells covered by the kernel
+const mapHeatmapMaxOperations = 200000000
+
+// MapHeatmapParams are the map search filters, and the heatmap settings.
+// Bandwidth and Cell_size are in metres (EPSG:3857).
+type MapHeatmapParams struct {
+	mapsearch.Params
+	Bandwidth float64 `json:"bandwidth" min:"1" max:"1000000" default:"20000" error:"MAP.FIELD_HEATMAP_BANDWIDTH.T_CHECK_INCORRECT"`
+	Cell_size float64 `json:"cell_size" min:"1" max:"1000000" default:"1000" error:"MAP.FIELD_HEATMAP_CELL_SIZE.T_CHECK_INCORRECT"`
+	Weighted  bool    `json:"weighted"`
+	Format    string  `json:"format" enum:"geotiff,png" default:"geotiff" error:"MAP.FIELD_HEATMAP_FORMAT.T_CHECK_INCORRECT"`
+}
+
+// mapHeatmapGrid is a density raster, origin is the top left corner, values are stored row by row from the top
+type mapHeatmapGrid struct {
+	MinX, MaxY float64
+	CellSize   float64
+	Width      int
+	Height     int
+	Values     []float32
+}
+
+// MapHeatmap compute a kernel density surface of the sites of a map search,
+// using a quartic kernel. Sites can be weighted by their number of site ranges.
+// Sites are summed by cell in PostgreSQL, and the size of the raster and the number
+// of kernel values to compute are bounded.
+func MapHeatmap(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	params := proute.Json.(*MapHeatmapParams)
+
+	filters, errors := mapsearch.Compile(&params.Params)
+	if len(errors) > 0 {
+		routes.Errors(w, errors)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Println("can't start transaction")
+		userSqlError(w, err)
+		return
+	}
+
+	q, q_args, err := filters.BuildQuery()
+	if err != nil {
+		log.Println("can't build the search query : ", err)
+		routes.ServerError(w, 500, "INTERNAL ERROR")
+		_ = tx.Rollback()
+		return
+	}
+
+	weight := "1"
+	if params.Weighted {
+		weight = "(SELECT count(*) FROM site_range sr WHERE sr.site_id = s.id)"
+	}
+
+	// Sites are aggregated on the centers of the cells of the raster, so the number of points is bounded by the
+	// number of cells. Cells are aligned on the origin of EPSG:3857.
+	args := append(append([]interface{}{}, q_args...), params.Cell_size/2, params.Cell_size)
+	half, size := "$"+strconv.Itoa(len(args)-1), "$"+strconv.Itoa(len(args))
+	cellsQuery := "SELECT ST_X(c) AS x, ST_Y(c) AS y, sum(w) AS weight FROM (" +
+		"SELECT ST_SnapToGrid(ST_Transform(s.geom::geometry, 3857), " + half + ", " + half + ", " + size + ", " + size + ") AS c, " + weight + " AS w FROM site s WHERE s.id IN (" + q + ")" +
+		") sites GROUP BY 1, 2"
+
+	extent := struct {
+		Count                  int
+		MinX, MinY, MaxX, MaxY float64
+	}{}
+	err = tx.Get(&extent, "SELECT count(*) AS count, COALESCE(min(x), 0) AS minx, COALESCE(min(y), 0) AS miny, COALESCE(max(x), 0) AS maxx, COALESCE(max(y), 0) AS maxy FROM ("+cellsQuery+") cells", args...)
+	if err != nil {
+		log.Println("heatmap query failed : ", err)
+		userSqlError(w, err)
+		_ = tx.Rollback()
+		return
+	}
+
+	if extent.Count == 0 {
+		routes.FieldError(w, "json.bandwidth", "bandwidth", "MAP.FIELD_HEATMAP.T_NO_SITES")
+		_ = tx.Rollback()
+		return
+	}
+
+	// raster extent is the sites extent, extended by the bandwidth
+	radius := math.Ceil(params.Bandwidth / params.Cell_size)
+	width := math.Round((extent.MaxX-extent.MinX)/params.Cell_size) + 1 + 2*radius
+	height := math.Round((extent.MaxY-extent.MinY)/params.Cell_size) + 1 + 2*radius
+	if width*height > mapHeatmapMaxCells {
+		routes.FieldError(w, "json.cell_size", "cell_size", "MAP.FIELD_HEATMAP_CELL_SIZE.T_TOO_MANY_CELLS")
+		_ = tx.Rollback()
+		return
+	}
+	kernelCells := (2*radius + 1) * (2*radius + 1)
+	if float64(extent.Count)*kernelCells > mapHeatmapMaxOperations {
+		routes.FieldError(w, "json.bandwidth", "bandwidth", "MAP.FIELD_HEATMAP_BANDWIDTH.T_TOO_MANY_CELLS")
+		_ = tx.Rollback()
+		return
+	}
+
+	points := []struct {
+		X      float64
+		Y      float64
+		Weight float64
+	}{}
+	err = tx.Select(&points, cellsQuery, args...)
+	if err != nil {
+		log.Println("heatmap query failed : ", err)
+		userSqlError(w, err)
+		_ = tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("can't commit")
+		userSqlError(w, err)
+		return
+	}
+
+	grid := mapHeatmapGrid{
+		MinX:     extent.MinX - (radius+0.5)*params.Cell_size,
+		MaxY:     extent.MaxY + (radius+0.5)*params.Cell_size,
+		CellSize: params.Cell_size,
+	}
+	grid.Width, grid.Height = int(width), int(height)
+	grid.Values = make([]float32, grid.Width*grid.Height)
+
+	// quartic kernel : 3/(pi*h^2) * (1 - d^2/h^2)^2, for d < h
+	h2 := params.Bandwidth * params.Bandwidth
+	norm := 3 / (math.Pi * h2)
+	kernelRadius := int(radius)
+	for _, p := range points {
+		col := int((p.X - grid.MinX) / grid.CellSize)
+		row := int((grid.MaxY - p.Y) / grid.CellSize)
+		for j := row - kernelRadius; j <= row+kernelRadius; j++ {
+			if j < 0 || j >= grid.Height {
+				continue
+			}
+			cy := grid.MaxY - (float64(j)+0.5)*grid.CellSize
+			for i := col - kernelRadius; i <= col+kernelRadius; i++ {
+				if i < 0 || i >= grid.Width {
+					continue
+				}
+				cx := grid.MinX + (float64(i)+0.5)*grid.CellSize
+				d2 := (cx-p.X)*(cx-p.X) + (cy-p.Y)*(cy-p.Y)
+				if d2 >= h2 {
+					continue
+				}
+				k := 1 - d2/h2
+				grid.Values[j*grid.Width+i] += float32(p.Weight * norm * k * k)
+			}
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if params.Format == "png" {
+		err = mapHeatmapWritePNGZip(buf, &grid)
+		if err != nil {
+			log.Println("heatmap png failed : ", err)
+			routes.ServerError(w, 500, "INTERNAL ERROR")
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"heatmap.zip\"")
+	} else {
+		mapHeatmapWriteGeoTIFF(buf, &grid)
+		w.Header().Set("Content-Type", "image/tiff")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"heatmap.tif\"")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
+
+// mapHeatmapEPSG3857WKT is the .prj content of rasters in EPSG:3857
+const mapHeatmapEPSG3857WKT = `PROJCS["WGS_1984_Web_Mercator_Auxiliary_Sphere",GEOGCS["GCS_WGS_1984",DATUM["D_WGS_1984",SPHEROID["WGS_1984",6378137.0,298.257223563]],PRIMEM["Greenwich",0.0],UNIT["Degree",0.0174532925199433]],PROJECTION["Mercator_Auxiliary_Sphere"],PARAMETER["False_Easting",0.0],PARAMETER["False_Northing",0.0],PARAMETER["Central_Meridian",0.0],PARAMETER["Standard_Parallel_1",0.0],PARAMETER["Auxiliary_Sphere_Type",0.0],UNIT["Meter",1.0]]`
+
+// mapHeatmapWritePNGZip write a zip containing the heatmap as a colored png, its world file and its projection
+func mapHeatmapWritePNGZip(buf *bytes.Buffer, grid *mapHeatmapGrid) error {
+	var max float32
+	for _, v := range grid.Values {
+		if v > max {
+			max = v
+		}
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, grid.Width, grid.Height))
+	for j := 0; j < grid.Height; j++ {
+		for i := 0; i < grid.Width; i++ {
+			v := grid.Values[j*grid.Width+i]
+			if v <= 0 || max <= 0 {
+				continue
+			}
+			// from transparent yellow to opaque red
+			t := float64(v / max)
+			img.SetNRGBA(i, j, color.NRGBA{
+				R: 255,
+				G: uint8(255 * (1 - t)),
+				B: 0,
+				A: uint8(64 + 191*t),
+			})
+		}
+	}
+
+	pngbuf := new(bytes.Buffer)
+	err := png.Encode(pngbuf, img)
+	if err != nil {
+		return err
+	}
+
+	// world file : pixel size, rotations, and center of the top left pixel
+	world := fmt.Sprintf("%f\n0.0\n0.0\n%f\n%f\n%f\n",
+		grid.CellSize, -grid.CellSize,
+		grid.MinX+grid.CellSize/2, grid.MaxY-grid.CellSize/2)
+
+	wZip := zip.NewWriter(buf)
+	var files = []struct {
+		Name string
+		Body []byte
+	}{
+		{"heatmap.png", pngbuf.Bytes()},
+		{"heatmap.pgw", []byte(world)},
+		{"heatmap.prj", []byte(mapHeatmapEPSG3857WKT)},
+	}
+	for _, file := range files {
+		f, err := wZip.Create(file.Name)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(file.Body)
+		if err != nil {
+			return err
+		}
+	}
+	return wZip.Close()
+}
+
+// mapHeatmapWriteGeoTIFF write the heatmap as a single band float32 GeoTIFF in EPSG:3857
+func mapHeatmapWriteGeoTIFF(buf *bytes.Buffer, grid *mapHeatmapGrid) {
+	le := binary.LittleEndian
+	type ifdEntry struct {
+		tag, typ uint16
+		count    uint32
+		data     []byte
+	}
+	shorts := func(v ...uint16) []byte {
+		b := make([]byte, 2*len(v))
+		for i, s := range v {
+			le.PutUint16(b[2*i:], s)
+		}
+		return b
+	}
+	longs := func(v ...uint32) []byte {
+		b := make([]byte, 4*len(v))
+		for i, l := range v {
+			le.PutUint32(b[4*i:], l)
+		}
+		return b
+	}
+	doubles := func(v ...float64) []byte {
+		b := make([]byte, 8*len(v))
+		for i, d := range v {
+			le.PutUint64(b[8*i:], math.Float64bits(d))
+		}
+		return b
+	}
+	const (
+		tShort  = 3
+		tLong   = 4
+		tDouble = 12
+	)
+
+	pixelsSize := uint32(4 * len(grid.Values))
+	pixelsOffset := uint32(8)
+
+	geokeys := []uint16{
+		1, 1, 0, 3, // version, revision, minor revision, number of keys
+		1024, 0, 1, 1, // GTModelTypeGeoKey : projected
+		1025, 0, 1, 1, // GTRasterTypeGeoKey : pixel is area
+		3072, 0, 1, 3857, // ProjectedCSTypeGeoKey
+	}
+
+	entries := []ifdEntry{
+		{256, tLong, 1, longs(uint32(grid.Width))},
+		{257, tLong, 1, longs(uint32(grid.Height))},
+		{258, tShort, 1, shorts(32)},
+		{259, tShort, 1, shorts(1)},
+		{262, tShort, 1, shorts(1)},
+		{273, tLong, 1, longs(pixelsOffset)},
+		{277, tShort, 1, shorts(1)},
+		{278, tLong, 1, longs(uint32(grid.Height))},
+		{279, tLong, 1, longs(pixelsSize)},
+		{284, tShort, 1, shorts(1)},
+		{339, tShort, 1, shorts(3)},
+		{33550, tDouble, 3, doubles(grid.CellSize, grid.CellSize, 0)},
+		{33922, tDouble, 6, doubles(0, 0, 0, grid.MinX, grid.MaxY, 0)},
+		{34735, tShort, uint32(len(geokeys)), shorts(geokeys...)},
+	}
+
+	// header, then pixels, then the IFD, then the values which don't fit in the IFD
+	ifdOffset := pixelsOffset + pixelsSize
+	ifdOffset += ifdOffset % 2
+	extraOffset := ifdOffset + 2 + uint32(12*len(entries)) + 4
+
+	buf.Write([]byte("II"))
+	buf.Write(shorts(42))
+	buf.Write(longs(ifdOffset))
+	for _, v := range grid.Values {
+		buf.Write(longs(math.Float32bits(v)))
+	}
+	if uint32(buf.Len()) < ifdOffset {
+		buf.WriteByte(0)
+	}
+
+	extra := new(bytes.Buffer)
+	buf.Write(shorts(uint16(len(entries))))
+	for _, e := range entries {
+		buf.Write(shorts(e.tag, e.typ))
+		buf.Write(longs(e.count))
+		if len(e.data) <= 4 {
+			buf.Write(e.data)
+			buf.Write(make([]byte, 4-len(e.data)))
+		} else {
+			buf.Write(longs(extraOffset + uint32(extra.Len())))
+			extra.Write(e.data)
+		}
+	}
+	buf.Write(longs(0))
+	buf.Write(extra.Bytes())
+}
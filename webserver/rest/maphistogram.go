@@ -0,0 +1,215 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+
+	db "github.com/croll/arkeogis-server/db"
+	"github.com/croll/arkeogis-server/mapsearch"
+	"github.com/croll/arkeogis-server/webserver/routes"
+)
+
+func init() {
+	Routes := []*routes.Route{
+		&routes.Route{
+			Path:        "/api/map/histogram",
+			Description: "Count the sites of a map search per time bin",
+			Func:        MapHistogram,
+			Method:      "POST",
+			Json:        reflect.TypeOf(MapHistogramParams{}),
+			Permissions: []string{
+				"request map",
+			},
+		},
+	}
+	routes.RegisterMultiple(Routes)
+}
+
+// MapHistogramParams are the map search filters, and how the sites are counted.
+// If Start and End are both 0, the bins cover all the dates of the sites found.
+type MapHistogramParams struct {
+	mapsearch.Params
+	BinSize int    `json:"bin_size" min:"1" error:"MAP.FIELD_HISTOGRAM_BIN_SIZE.T_CHECK_INCORRECT"`
+	Start   int    `json:"start"`
+	End     int    `json:"end"`
+	Split   string `json:"split" enum:",charac_root,database" error:"MAP.FIELD_HISTOGRAM_SPLIT.T_CHECK_INCORRECT"`
+}
+
+// MapHistogramBin is the number of sites occupied during a time bin. Certain
+// sites are surely occupied during the bin (start_date2 to end_date1),
+// potential sites may be occupied (start_date1 to end_date2) but are not certain.
+type MapHistogramBin struct {
+	Start     int `json:"start" db:"start"`
+	End       int `json:"end" db:"end"`
+	Split     int `json:"split" db:"split"`
+	Certain   int `json:"certain" db:"certain"`
+	Potential int `json:"potential" db:"potential"`
+}
+
+// MapHistogramResult is the result of an histogram request. Undetermined is
+// the number of sites without known dates, which are not counted in the bins.
+type MapHistogramResult struct {
+	BinSize      int               `json:"bin_size"`
+	Start        int               `json:"start"`
+	End          int               `json:"end"`
+	Split        string            `json:"split"`
+	Undetermined int               `json:"undetermined"`
+	Bins         []MapHistogramBin `json:"bins"`
+}
+
+// maximum number of bins of an histogram
+const mapHistogramMaxBins = 5000
+
+// MapHistogram count the sites of a map search per time bin
+func MapHistogram(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	params := proute.Json.(*MapHistogramParams)
+
+	filters, errors := mapsearch.Compile(&params.Params)
+	if len(errors) > 0 {
+		routes.Errors(w, errors)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Println("can't start transaction")
+		userSqlError(w, err)
+		return
+	}
+
+	q, q_args, err := filters.BuildQuery()
+	if err != nil {
+		log.Println("can't build the search query : ", err)
+		routes.ServerError(w, 500, "INTERNAL ERROR")
+		_ = tx.Rollback()
+		return
+	}
+
+	// site ranges of the sites found, without the undetermined dates
+	ranges := `SELECT sr.site_id, sr.start_date1, sr.start_date2, sr.end_date1, sr.end_date2, %s AS split FROM site_range sr %s` +
+		` WHERE sr.site_id IN (` + q + `) AND sr.start_date1 != -2147483648 AND sr.end_date2 != 2147483647`
+	switch params.Split {
+	case "database":
+		ranges = fmt.Sprintf(ranges, "s.database_id", "JOIN site s ON s.id = sr.site_id")
+	case "charac_root":
+		ranges = fmt.Sprintf(ranges, "roots.root_id", "JOIN site_range__charac src ON src.site_range_id = sr.id JOIN roots ON roots.id = src.charac_id")
+	default:
+		ranges = fmt.Sprintf(ranges, "0", "")
+	}
+	with := `WITH RECURSIVE roots(id, root_id) AS (SELECT id, id FROM charac WHERE parent_id = 0 UNION ALL SELECT c.id, roots.root_id FROM charac c JOIN roots ON c.parent_id = roots.id),` +
+		` ranges AS (` + ranges + `)`
+
+	res := MapHistogramResult{
+		BinSize: params.BinSize,
+		Start:   params.Start,
+		End:     params.End,
+		Split:   params.Split,
+		Bins:    []MapHistogramBin{},
+	}
+
+	err = tx.Get(&res.Undetermined, `SELECT count(*) FROM (`+q+`) f WHERE NOT EXISTS (SELECT 1 FROM site_range sr WHERE sr.site_id = f.id AND sr.start_date1 != -2147483648 AND sr.end_date2 != 2147483647)`, q_args...)
+	if err != nil {
+		log.Println("histogram undetermined query failed : ", err)
+		userSqlError(w, err)
+		_ = tx.Rollback()
+		return
+	}
+
+	if res.Start == 0 && res.End == 0 {
+		bounds := struct {
+			Start *int
+			End   *int
+		}{}
+		err = tx.Get(&bounds, with+` SELECT min(start_date1) AS start, max(end_date2) AS end FROM ranges`, q_args...)
+		if err != nil {
+			log.Println("histogram bounds query failed : ", err)
+			userSqlError(w, err)
+			_ = tx.Rollback()
+			return
+		}
+		if bounds.Start == nil || bounds.End == nil {
+			// no dated sites
+			_ = tx.Rollback()
+			mapHistogramWrite(w, &res)
+			return
+		}
+		// align the bins on the bin size
+		res.Start = floorDiv(*bounds.Start, res.BinSize) * res.BinSize
+		res.End = *bounds.End
+	}
+
+	if res.End < res.Start || (res.End-res.Start)/res.BinSize >= mapHistogramMaxBins {
+		routes.FieldError(w, "bin_size", "bin_size", "MAP.FIELD_HISTOGRAM_BIN_SIZE.T_CHECK_TOO_MANY_BINS")
+		_ = tx.Rollback()
+		return
+	}
+
+	startArg := fmt.Sprintf("$%d", len(q_args)+1)
+	endArg := fmt.Sprintf("$%d", len(q_args)+2)
+	sizeArg := fmt.Sprintf("$%d", len(q_args)+3)
+	args := append(q_args, res.Start, res.End, res.BinSize)
+
+	err = tx.Select(&res.Bins, with+`, bins AS (SELECT generate_series(`+startArg+`::integer, `+endArg+`::integer, `+sizeArg+`::integer) AS bin)`+
+		` SELECT b.bin AS start, b.bin + `+sizeArg+` - 1 AS end, COALESCE(r.split, 0) AS split,`+
+		` count(DISTINCT r.site_id) FILTER (WHERE r.start_date2 <= b.bin + `+sizeArg+` - 1 AND r.end_date1 >= b.bin) AS certain,`+
+		` count(DISTINCT r.site_id) - count(DISTINCT r.site_id) FILTER (WHERE r.start_date2 <= b.bin + `+sizeArg+` - 1 AND r.end_date1 >= b.bin) AS potential`+
+		` FROM bins b LEFT JOIN ranges r ON r.start_date1 <= b.bin + `+sizeArg+` - 1 AND r.end_date2 >= b.bin`+
+		` GROUP BY b.bin, r.split ORDER BY b.bin, r.split`, args...)
+	if err != nil {
+		log.Println("histogram query failed : ", err)
+		userSqlError(w, err)
+		_ = tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("can't commit")
+		userSqlError(w, err)
+		return
+	}
+
+	mapHistogramWrite(w, &res)
+}
+
+func mapHistogramWrite(w http.ResponseWriter, res *MapHistogramResult) {
+	j, err := json.Marshal(res)
+	if err != nil {
+		log.Println("marshal failed: ", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// floorDiv is the integer division of a by b, rounded toward negative infinity
+func floorDiv(a int, b int) int {
+	if a%b != 0 && (a < 0) != (b < 0) {
+		return a/b - 1
+	}
+	return a / b
+}
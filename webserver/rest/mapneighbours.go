@@ -0,0 +1,204 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package rest
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	db "github.com/croll/arkeogis-server/db"
+	"github.com/croll/arkeogis-server/mapsearch"
+	"github.com/croll/arkeogis-server/webserver/routes"
+)
+
+func init() {
+	Routes := []*routes.Route{
+		&routes.Route{
+			Path:        "/api/map/neighbours",
+			Description: "Get the nearest neighbours of sites, and the nearest neighbour index of a map search",
+			Func:        MapNeighbours,
+			Method:      "POST",
+			Json:        reflect.TypeOf(MapNeighboursParams{}),
+			Permissions: []string{
+				"request map",
+			},
+		},
+	}
+	routes.RegisterMultiple(Routes)
+}
+
+// MapNeighboursParams : neighbours are searched in the sites found by the map
+// search, optionally only those having Charac_id, or existing between
+// Start_date and End_date. If Site_id is set, only the neighbours of this site
+// are returned, else the neighbours of every site found.
+type MapNeighboursParams struct {
+	mapsearch.Params
+	Site_id    int `json:"site_id" min:"0"`
+	K          int `json:"k" min:"1" max:"100" default:"1" error:"MAP.FIELD_NEIGHBOURS_K.T_CHECK_INCORRECT"`
+	Charac_id  int `json:"charac_id" min:"0"`
+	Start_date int `json:"start_date"`
+	End_date   int `json:"end_date"`
+}
+
+// MapNeighbour is a neighbour of a site, distance is in metres
+type MapNeighbour struct {
+	Site_id  int     `json:"site_id" db:"site_id"`
+	Distance float64 `json:"distance" db:"distance"`
+}
+
+// MapNeighboursSite is a site with its K nearest neighbours
+type MapNeighboursSite struct {
+	Site_id    int            `json:"site_id"`
+	Neighbours []MapNeighbour `json:"neighbours"`
+}
+
+// MapNeighboursIndex is the Clark and Evans nearest neighbour index of the
+// sites, using the area of their convex hull. An index below 1 means sites are
+// clustered, above 1 means they are dispersed.
+type MapNeighboursIndex struct {
+	Count             int     `json:"count"`
+	Area              float64 `json:"area"`
+	Mean_distance     float64 `json:"mean_distance"`
+	Expected_distance float64 `json:"expected_distance"`
+	Index             float64 `json:"index"`
+	Z_score           float64 `json:"z_score"`
+}
+
+type MapNeighboursResult struct {
+	Sites []MapNeighboursSite `json:"sites"`
+	Index *MapNeighboursIndex `json:"index"`
+}
+
+// MapNeighbours returns the K nearest neighbours of sites, using the KNN index on site.geom
+func MapNeighbours(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	params := proute.Json.(*MapNeighboursParams)
+
+	filters, errors := mapsearch.Compile(&params.Params)
+	if len(errors) > 0 {
+		routes.Errors(w, errors)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Println("can't start transaction")
+		userSqlError(w, err)
+		return
+	}
+
+	q, args, err := filters.BuildQuery()
+	if err != nil {
+		log.Println("can't build the search query : ", err)
+		routes.ServerError(w, 500, "INTERNAL ERROR")
+		_ = tx.Rollback()
+		return
+	}
+	nextArg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	candidates := `SELECT c.id FROM site c WHERE c.id IN (` + q + `)`
+	if params.Charac_id > 0 {
+		candidates += ` AND EXISTS (SELECT 1 FROM site_range sr JOIN site_range__charac src ON src.site_range_id = sr.id WHERE sr.site_id = c.id AND src.charac_id = ` + nextArg(params.Charac_id) + `)`
+	}
+	if params.Start_date != 0 || params.End_date != 0 {
+		candidates += ` AND c.start_date1 <= ` + nextArg(params.End_date) + ` AND c.end_date2 >= ` + nextArg(params.Start_date)
+	}
+
+	candidatesArgs := args
+
+	origins := `SELECT id FROM candidates`
+	if params.Site_id > 0 {
+		origins = `SELECT ` + nextArg(params.Site_id) + `::integer AS id`
+	}
+
+	// nearest neighbours of each origin, KNN ordering use the gist index of site.geom
+	knn := func(k string) string {
+		return `SELECT o.id AS origin_id, n.id AS site_id, ST_Distance(os.geom, n.geom) AS distance` +
+			` FROM origins o JOIN site os ON os.id = o.id` +
+			` CROSS JOIN LATERAL (SELECT c.id, c.geom FROM site c WHERE c.id IN (SELECT id FROM candidates) AND c.id != o.id ORDER BY c.geom <-> os.geom LIMIT ` + k + `) n`
+	}
+	with := `WITH candidates AS (` + candidates + `), origins AS (` + origins + `)`
+
+	rows := []struct {
+		Origin_id int
+		MapNeighbour
+	}{}
+	err = tx.Select(&rows, with+` `+knn(nextArg(params.K))+` ORDER BY origin_id, distance`, args...)
+	if err != nil {
+		log.Println("neighbours query failed : ", err)
+		userSqlError(w, err)
+		_ = tx.Rollback()
+		return
+	}
+
+	res := MapNeighboursResult{
+		Sites: []MapNeighboursSite{},
+	}
+	for _, row := range rows {
+		if len(res.Sites) == 0 || res.Sites[len(res.Sites)-1].Site_id != row.Origin_id {
+			res.Sites = append(res.Sites, MapNeighboursSite{Site_id: row.Origin_id, Neighbours: []MapNeighbour{}})
+		}
+		site := &res.Sites[len(res.Sites)-1]
+		site.Neighbours = append(site.Neighbours, row.MapNeighbour)
+	}
+
+	// nearest neighbour index of all the candidates
+	index := MapNeighboursIndex{}
+	err = tx.Get(&index, `WITH candidates AS (`+candidates+`), origins AS (SELECT id FROM candidates)`+
+		` SELECT (SELECT count(*) FROM candidates) AS count,`+
+		` COALESCE((SELECT ST_Area(ST_ConvexHull(ST_Collect(s.geom::geometry))::geography) FROM site s WHERE s.id IN (SELECT id FROM candidates)), 0) AS area,`+
+		` COALESCE((SELECT avg(distance) FROM (`+knn("1")+`) nn), 0) AS mean_distance`, candidatesArgs...)
+	if err != nil {
+		log.Println("neighbours index query failed : ", err)
+		userSqlError(w, err)
+		_ = tx.Rollback()
+		return
+	}
+	if index.Count > 1 && index.Area > 0 {
+		density := float64(index.Count) / index.Area
+		index.Expected_distance = 0.5 / math.Sqrt(density)
+		index.Index = index.Mean_distance / index.Expected_distance
+		index.Z_score = (index.Mean_distance - index.Expected_distance) / (0.26136 / math.Sqrt(float64(index.Count)*density))
+		res.Index = &index
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("can't commit")
+		userSqlError(w, err)
+		return
+	}
+
+	j, err := json.Marshal(res)
+	if err != nil {
+		log.Println("marshal failed: ", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
@@ -0,0 +1,212 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package rest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/croll/arkeogis-server/mapsearch"
+	"github.com/jmoiron/sqlx"
+)
+
+// MapSearchParamsPage configure the sorting and the cursor based pagination of search results.
+// When Limit is 0 and Sort is empty, all sites are returned as usual.
+type MapSearchParamsPage struct {
+	Limit  int    `json:"limit" min:"0" max:"10000" error:"MAP.FIELD_PAGE_LIMIT.T_CHECK_INCORRECT"`
+	Cursor string `json:"cursor"`
+	Sort   string `json:"sort" enum:",name,code,database,start_date,distance,relevance" error:"MAP.FIELD_PAGE_SORT.T_CHECK_INCORRECT"`
+	Order  string `json:"order" enum:",asc,desc" error:"MAP.FIELD_PAGE_ORDER.T_CHECK_INCORRECT"`
+	// Lng and Lat are the position the sites are sorted from, they are required by the distance sort.
+	// They are checked by mapSearchSitesPage, the sanitizer does not handle pointers to values
+	Lng *float64 `json:"lng" ignore:"true"`
+	Lat *float64 `json:"lat" ignore:"true"`
+}
+
+// IsWanted returns true if the search results have to be sorted or paginated
+func (p MapSearchParamsPage) IsWanted() bool {
+	return p.Limit > 0 || p.Sort != ""
+}
+
+// mapSearchCursor is the position of the last site of a page, encoded in the next cursor
+type mapSearchCursor struct {
+	Value string `json:"v"`
+	Id    int    `json:"id"`
+}
+
+// mapSearchPage is one page of a map search
+type mapSearchPage struct {
+	Sites      []int
+	Total      int
+	NextCursor string
+}
+
+// errMapSearchBadCursor is returned when the cursor of a page can't be decoded
+var errMapSearchBadCursor = errors.New("bad map search cursor")
+
+// errMapSearchNoPosition is returned when sites are sorted by distance without a valid position
+var errMapSearchNoPosition = errors.New("map search sorted by distance without a position")
+
+// sortNullValues replaces NULL sort keys, like the rank of a site only matched by its city name,
+// so they can be compared with the cursor
+var sortNullValues = map[string]string{
+	"text":             `''`,
+	"integer":          `0`,
+	"real":             `0`,
+	"double precision": `0`,
+}
+
+// checkCursorValue returns errMapSearchBadCursor if the cursor value can't be cast to the sql type of the sort
+func checkCursorValue(value string, exprType string) error {
+	var err error
+	switch exprType {
+	case "integer":
+		_, err = strconv.ParseInt(value, 10, 32)
+	case "real", "double precision":
+		_, err = strconv.ParseFloat(value, 64)
+	}
+	if err != nil {
+		return errMapSearchBadCursor
+	}
+	return nil
+}
+
+// sortExpr returns the sql expression used to sort the sites, and its sql type.
+// "s" is the site table and "d" the database table, rank is the relevance expression
+func (p MapSearchParamsPage) sortExpr(lngArg, latArg string, rank string) (string, string) {
+	switch p.Sort {
+	case "relevance":
+		if rank != "" {
+			return rank, "real"
+		}
+		return `s.id`, "integer"
+	case "name":
+		return `s.name`, "text"
+	case "code":
+		return `s.code`, "text"
+	case "database":
+		return `d.name`, "text"
+	case "start_date":
+		return `s.start_date1`, "integer"
+	case "distance":
+		return `ST_Distance(s.geom, ST_SetSRID(ST_MakePoint(` + lngArg + `, ` + latArg + `), 4326)::geography)`, "double precision"
+	default:
+		return `s.id`, "integer"
+	}
+}
+
+// mapSearchSitesPage returns the ids of one page of the sites matched by the filters, sorted, with the total count of sites
+func mapSearchSitesPage(page MapSearchParamsPage, filters *mapsearch.MapSqlQuery, rank string, rankArgs []interface{}, tx *sqlx.Tx) (*mapSearchPage, error) {
+	res := &mapSearchPage{}
+
+	if page.Sort == "distance" && (page.Lng == nil || page.Lat == nil ||
+		*page.Lng < -180 || *page.Lng > 180 || *page.Lat < -90 || *page.Lat > 90) {
+		return nil, errMapSearchNoPosition
+	}
+
+	q, q_args, err := filters.BuildQuery()
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Get(&res.Total, `SELECT count(*) FROM (`+q+`) f`, q_args...)
+	if err != nil {
+		return nil, err
+	}
+
+	args := append([]interface{}{}, q_args...)
+	nextArg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	lngArg, latArg := "", ""
+	if page.Sort == "distance" {
+		lngArg, latArg = nextArg(*page.Lng), nextArg(*page.Lat)
+	}
+	if page.Sort == "relevance" && rank != "" {
+		rank = mapsearch.NumberArgs(rank, len(args)+1)
+		args = append(args, rankArgs...)
+	}
+	expr, exprType := page.sortExpr(lngArg, latArg, rank)
+	expr = `COALESCE(` + expr + `, ` + sortNullValues[exprType] + `)`
+
+	// most relevant sites first, unless asked otherwise
+	order, cmp := "ASC", ">"
+	if page.Order == "desc" || (page.Order == "" && page.Sort == "relevance") {
+		order, cmp = "DESC", "<"
+	}
+
+	where := ""
+	if page.Cursor != "" {
+		cursor := mapSearchCursor{}
+		b, err := base64.RawURLEncoding.DecodeString(page.Cursor)
+		if err == nil {
+			err = json.Unmarshal(b, &cursor)
+		}
+		if err != nil {
+			return nil, errMapSearchBadCursor
+		}
+		if err = checkCursorValue(cursor.Value, exprType); err != nil {
+			return nil, err
+		}
+		where = ` AND (` + expr + `, s.id) ` + cmp + ` (` + nextArg(cursor.Value) + `::` + exprType + `, ` + nextArg(cursor.Id) + `::integer)`
+	}
+
+	limit := ""
+	if page.Limit > 0 {
+		// one more row to know if there is a next page
+		limit = ` LIMIT ` + strconv.Itoa(page.Limit+1)
+	}
+
+	type row struct {
+		Id      int
+		Sortkey string
+	}
+	rows := []row{}
+	err = tx.Select(&rows, `SELECT s.id, (`+expr+`)::text AS sortkey`+
+		` FROM site s LEFT JOIN database d ON d.id = s.database_id`+
+		` WHERE s.id IN (`+q+`)`+where+
+		` ORDER BY `+expr+` `+order+`, s.id `+order+limit, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if page.Limit > 0 && len(rows) > page.Limit {
+		rows = rows[:page.Limit]
+		last := rows[len(rows)-1]
+		b, err := json.Marshal(mapSearchCursor{Value: last.Sortkey, Id: last.Id})
+		if err != nil {
+			return nil, err
+		}
+		res.NextCursor = base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	res.Sites = make([]int, len(rows))
+	for i, r := range rows {
+		res.Sites[i] = r.Id
+	}
+
+	return res, nil
+}
@@ -0,0 +1,196 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+
+	db "github.com/croll/arkeogis-server/db"
+	"github.com/croll/arkeogis-server/mapsearch"
+	"github.com/croll/arkeogis-server/model"
+	"github.com/croll/arkeogis-server/webserver/routes"
+	"github.com/jmoiron/sqlx"
+)
+
+func init() {
+	Routes := []*routes.Route{
+		&routes.Route{
+			Path:        "/api/map/tiles/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.mvt",
+			Description: "Get sites of a map search and features of a published shapefile as a Mapbox Vector Tile",
+			Func:        MapTile,
+			Method:      "GET",
+			Params:      reflect.TypeOf(MapTileParams{}),
+			Permissions: []string{
+				"request map",
+			},
+		},
+	}
+	routes.RegisterMultiple(Routes)
+}
+
+// MapTileParams are the params of a vector tile request. Sites are searched
+// using a saved query (Query_id) or an inline json MapSearchParams (Params).
+type MapTileParams struct {
+	Z            int `min:"0" max:"22"`
+	X            int `min:"0"`
+	Y            int `min:"0"`
+	Query_id     int
+	Params       string
+	Shapefile_id int
+}
+
+// Extent of the vector tiles, in tile coordinates
+const mapTileExtent = 4096
+
+// MapTile render a Mapbox Vector Tile of the sites matched by a search and of a published shapefile
+func MapTile(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	params := proute.Params.(*MapTileParams)
+
+	if params.X >= 1<<uint(params.Z) || params.Y >= 1<<uint(params.Z) {
+		routes.FieldError(w, "x", "x", "MAP.TILE.T_ERROR_OUT_OF_BOUNDS")
+		return
+	}
+
+	if params.Query_id == 0 && params.Params == "" && params.Shapefile_id == 0 {
+		routes.FieldError(w, "params", "params", "MAP.TILE.T_ERROR_NOTHING_TO_RENDER")
+		return
+	}
+
+	_user, _ := proute.Session.Get("user")
+	user := _user.(model.User)
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Println("can't start transaction")
+		userSqlError(w, err)
+		return
+	}
+
+	tile := []byte{}
+
+	if params.Query_id != 0 || params.Params != "" {
+		searchParams := mapsearch.Params{}
+
+		if params.Query_id != 0 {
+			// the saved query must be visible by the user
+			query, ok := queryGetVisible(w, params.Query_id, user)
+			if !ok {
+				_ = tx.Rollback()
+				return
+			}
+			params.Params = query.Params
+		}
+
+		err = json.Unmarshal([]byte(params.Params), &searchParams)
+		if err != nil {
+			routes.FieldError(w, "params", "params", "MAP.TILE.T_ERROR_BAD_PARAMS")
+			_ = tx.Rollback()
+			return
+		}
+
+		filters, errors := mapsearch.Compile(&searchParams)
+		if len(errors) > 0 {
+			routes.Errors(w, errors)
+			_ = tx.Rollback()
+			return
+		}
+
+		layer, err := mapTileSites(params, filters, tx)
+		if err != nil {
+			log.Println("sites tile query failed : ", err)
+			userSqlError(w, err)
+			_ = tx.Rollback()
+			return
+		}
+		tile = append(tile, layer...)
+	}
+
+	if params.Shapefile_id > 0 {
+		layer, err := mapTileShapefile(params, tx)
+		if err != nil {
+			log.Println("shapefile tile query failed : ", err)
+			userSqlError(w, err)
+			_ = tx.Rollback()
+			return
+		}
+		tile = append(tile, layer...)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("can't commit")
+		userSqlError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	w.Write(tile)
+}
+
+// mapTileEnvelope returns the sql expression of the tile envelope in web mercator.
+// Values are sanitized integers, so they can be embedded in the query
+func mapTileEnvelope(params *MapTileParams) string {
+	return fmt.Sprintf("ST_TileEnvelope(%d, %d, %d)", params.Z, params.X, params.Y)
+}
+
+// mapTileSites returns the "sites" layer of a tile, using the map search filters
+func mapTileSites(params *MapTileParams, filters *mapsearch.MapSqlQuery, tx *sqlx.Tx) ([]byte, error) {
+	q, q_args, err := filters.BuildQuery()
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := mapTileEnvelope(params)
+	q = `SELECT ST_AsMVT(t, 'sites', ` + fmt.Sprint(mapTileExtent) + `, 'geom') FROM (
+	 SELECT s.id, s.code, s.name, s.database_id, s.centroid, s.occupation, s.start_date1, s.end_date2,
+	  ST_AsMVTGeom(ST_Transform(s.geom::geometry, 3857), ` + envelope + `, ` + fmt.Sprint(mapTileExtent) + `, 64, true) AS geom
+	 FROM site s
+	 WHERE s.id IN (` + q + `)
+	  AND s.geom && ST_Transform(` + envelope + `, 4326)::geography
+	) t WHERE t.geom IS NOT NULL`
+
+	layer := []byte{}
+	err = tx.Get(&layer, q, q_args...)
+	return layer, err
+}
+
+// mapTileShapefile returns the "shapefile" layer of a tile, only if the shapefile is published
+func mapTileShapefile(params *MapTileParams, tx *sqlx.Tx) ([]byte, error) {
+	envelope := mapTileEnvelope(params)
+	q := `SELECT ST_AsMVT(t, 'shapefile', ` + fmt.Sprint(mapTileExtent) + `, 'geom') FROM (
+	 SELECT f.id, f.shapefile_id, f.properties::jsonb AS properties,
+	  ST_AsMVTGeom(ST_Transform(f.geom::geometry, 3857), ` + envelope + `, ` + fmt.Sprint(mapTileExtent) + `, 64, true) AS geom
+	 FROM shapefile_feature f
+	 LEFT JOIN shapefile sh ON sh.id = f.shapefile_id
+	 WHERE f.shapefile_id = $1
+	  AND sh.published = true
+	  AND f.geom && ST_Transform(` + envelope + `, 4326)::geography
+	) t WHERE t.geom IS NOT NULL`
+
+	layer := []byte{}
+	err := tx.Get(&layer, q, params.Shapefile_id)
+	return layer, err
+}
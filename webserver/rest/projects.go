@@ -133,6 +133,11 @@ type SaveProjectParams struct {
 	Layers       []model.LayerFullInfos `json:"layers"`
 	Databases    []int                  `json:"databases"`
 	Characs      []int                  `json:"characs"`
+	// Collaborators are the users who can see the saved queries of the project
+	Collaborators []int `json:"collaborators"`
+	// Geom_extent, if set, replace Geom by the extent of the sites of the project databases
+	Geom_extent        string  `json:"geom_extent" enum:",bbox,convex_hull,concave_hull" error:"PROJECT.FIELD_GEOM_EXTENT.T_CHECK_INCORRECT"`
+	Geom_concave_ratio float64 `json:"geom_concave_ratio" min:"0" max:"1" default:"0.8"`
 }
 
 func SaveProject(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
@@ -157,6 +162,20 @@ func SaveProject(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
 		return
 	}
 
+	if params.Geom_extent != "" && len(params.Databases) > 0 {
+		var geom *string
+		err = tx.Get(&geom, "SELECT ST_AsGeoJSON(("+model.ExtentQuery(params.Geom_extent, params.Geom_concave_ratio, "SELECT id FROM site WHERE database_id IN ("+model.IntJoin(params.Databases, true)+")")+"))")
+		if err != nil {
+			log.Println("Save Project: error computing project extent", err)
+			_ = tx.Rollback()
+			userSqlError(w, err)
+			return
+		}
+		if geom != nil {
+			params.Geom = *geom
+		}
+	}
+
 	// Insert or update project
 	var stmtProject *sqlx.NamedStmt
 
@@ -220,6 +239,13 @@ func SaveProject(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
 			userSqlError(w, err)
 			return
 		}
+		_, err = tx.NamedExec("DELETE FROM \"project__collaborators\" WHERE project_id=:id", params)
+		if err != nil {
+			log.Println("Save Project: Error deleting project__collaborators", err)
+			_ = tx.Rollback()
+			userSqlError(w, err)
+			return
+		}
 	}
 	// Insert chronologies
 
@@ -328,6 +354,33 @@ func SaveProject(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
 		}
 
 	}
+
+	// Insert collaborators
+
+	stmtCollaborators, err := tx.PrepareNamed("INSERT INTO \"project__collaborators\" (project_id, user_id) VALUES (:project_id, :id)")
+	if err != nil {
+		log.Println("Save Project: Error inserting collaborators", err)
+		_ = tx.Rollback()
+		userSqlError(w, err)
+		return
+	}
+
+	for _, userId := range params.Collaborators {
+		if userId == params.User_id {
+			continue
+		}
+		_, err = stmtCollaborators.Exec(struct {
+			Id         int
+			Project_id int
+		}{Id: userId, Project_id: params.Id})
+		if err != nil {
+			log.Println(err)
+			_ = tx.Rollback()
+			userSqlError(w, err)
+			return
+		}
+	}
+
 	// Commit
 	err = tx.Commit()
 	if err != nil {
@@ -22,6 +22,8 @@
 package rest
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -55,6 +57,24 @@ func init() {
 			//"request map",
 			},
 		},
+		&routes.Route{
+			Path:        "/api/query/{id:[0-9]+}/run",
+			Func:        QueryRun,
+			Description: "Execute a saved query and get the sites found in any export format",
+			Method:      "GET",
+			Params:      reflect.TypeOf(QueryRunParams{}),
+			Permissions: []string{
+				"request map",
+			},
+		},
+		&routes.Route{
+			Path:        "/api/query/public/{token:[0-9a-f]+}/run",
+			Func:        QueryRunPublic,
+			Description: "Execute a public saved query and get the sites found in any export format",
+			Method:      "GET",
+			Params:      reflect.TypeOf(QueryRunPublicParams{}),
+			Permissions: []string{},
+		},
 		&routes.Route{
 			Path:        "/api/query",
 			Func:        QueryDelete,
@@ -74,9 +94,20 @@ type QueryGetParams struct {
 }
 
 type QuerySaveParams struct {
-	ProjectId int    `json:"project_id" min:"1"`
-	Name      string `json:"name" min:"1"`
-	Params    string `json:"params" min:"1"`
+	ProjectId  int    `json:"project_id" min:"1"`
+	Name       string `json:"name" min:"1"`
+	Params     string `json:"params" min:"1"`
+	Visibility string `json:"visibility" enum:",private,project,public" error:"QUERY.FIELD_VISIBILITY.T_CHECK_INCORRECT"`
+}
+
+type QueryRunParams struct {
+	Id     int
+	Format string `enum:",json,csv,geojson" error:"QUERY.FIELD_FORMAT.T_CHECK_INCORRECT"`
+}
+
+type QueryRunPublicParams struct {
+	Token  string
+	Format string `enum:",json,csv,geojson" error:"QUERY.FIELD_FORMAT.T_CHECK_INCORRECT"`
 }
 
 type QueryDeleteParams struct {
@@ -123,8 +154,12 @@ func QuerySave(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
 		_ = tx.Rollback()
 		return
 	}
+	if params.Visibility == "" {
+		params.Visibility = "private"
+	}
+
 	if c == 1 { // update
-		_, err = tx.Exec(`UPDATE "saved_query" SET "params"=$3 WHERE "project_id"=$1 AND "name"=$2`, params.ProjectId, params.Name, params.Params)
+		_, err = tx.Exec(`UPDATE "saved_query" SET "params"=$3, "visibility"=$4, "updated_at"=now() WHERE "project_id"=$1 AND "name"=$2`, params.ProjectId, params.Name, params.Params, params.Visibility)
 		if err != nil {
 			fmt.Println("update saved_query failed : ", err)
 			userSqlError(w, err)
@@ -132,7 +167,14 @@ func QuerySave(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
 			return
 		}
 	} else {
-		_, err = tx.Exec(`INSERT INTO "saved_query" ("project_id", "name", "params") VALUES ($1, $2, $3)`, params.ProjectId, params.Name, params.Params)
+		token, err := queryNewPublicToken()
+		if err != nil {
+			log.Println("can't generate public token")
+			routes.ServerError(w, 500, "INTERNAL ERROR")
+			_ = tx.Rollback()
+			return
+		}
+		_, err = tx.Exec(`INSERT INTO "saved_query" ("project_id", "name", "params", "owner_user_id", "visibility", "public_token", "created_at", "updated_at") VALUES ($1, $2, $3, $4, $5, $6, now(), now())`, params.ProjectId, params.Name, params.Params, user.Id, params.Visibility, token)
 		if err != nil {
 			fmt.Println("insert saved_query failed : ", err)
 			userSqlError(w, err)
@@ -141,6 +183,15 @@ func QuerySave(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
 		}
 	}
 
+	res := model.Saved_query{}
+	err = tx.Get(&res, `SELECT * FROM "saved_query" WHERE "project_id"=$1 AND "name"=$2`, params.ProjectId, params.Name)
+	if err != nil {
+		fmt.Println("search saved_query failed : ", err)
+		userSqlError(w, err)
+		_ = tx.Rollback()
+		return
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		log.Println("can't commit")
@@ -148,7 +199,7 @@ func QuerySave(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
 		return
 	}
 
-	j, err := json.Marshal(params)
+	j, err := json.Marshal(res)
 	if err != nil {
 		log.Println("marshal failed: ", err)
 		return
@@ -280,3 +331,78 @@ func QueryDelete(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
 	w.Write(j)
 
 }
+
+// queryNewPublicToken returns a random token used in the public link of a saved query
+func queryNewPublicToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// QueryRun execute a saved query. The query must be owned by the user, or
+// be visible by the owner and the collaborators of its project, or be public.
+func QueryRun(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	params := proute.Params.(*QueryRunParams)
+
+	// get the user
+	_user, _ := proute.Session.Get("user")
+	user := _user.(model.User)
+
+	query, ok := queryGetVisible(w, params.Id, user)
+	if !ok {
+		return
+	}
+
+	queryRun(w, query, user, params.Format)
+}
+
+// queryGetVisible returns the saved query if the user can see it, or writes an error
+func queryGetVisible(w http.ResponseWriter, id int, user model.User) (*model.Saved_query, bool) {
+	query := model.Saved_query{}
+	err := db.DB.Get(&query, `SELECT q.* FROM "saved_query" q JOIN "project" p ON p.id = q.project_id WHERE q."id"=$1 AND (`+
+		`q.owner_user_id = $2 OR q.visibility = 'public' OR q.visibility = 'project' AND (`+
+		`p.user_id = $2 OR EXISTS (SELECT 1 FROM "project__collaborators" pc WHERE pc.project_id = p.id AND pc.user_id = $2)))`, id, user.Id)
+	if err != nil {
+		fmt.Println("saved query not found : ", id, err)
+		routes.FieldError(w, "id", "id", "QUERY.RUN.T_ERROR_QUERY_NOT_FOUND")
+		return nil, false
+	}
+	return &query, true
+}
+
+// QueryRunPublic execute a public saved query, using its public token
+func QueryRunPublic(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	params := proute.Params.(*QueryRunPublicParams)
+
+	// get the user
+	_user, _ := proute.Session.Get("user")
+	user := _user.(model.User)
+
+	query := model.Saved_query{}
+	err := db.DB.Get(&query, `SELECT * FROM "saved_query" WHERE "public_token"=$1 AND "visibility"='public'`, params.Token)
+	if err != nil {
+		fmt.Println("public saved query not found : ", params, err)
+		routes.FieldError(w, "token", "token", "QUERY.RUN.T_ERROR_QUERY_NOT_FOUND")
+		return
+	}
+
+	queryRun(w, &query, user, params.Format)
+}
+
+func queryRun(w http.ResponseWriter, query *model.Saved_query, user model.User, format string) {
+	search := MapSearchParams{}
+	err := json.Unmarshal([]byte(query.Params), &search)
+	if err != nil {
+		log.Println("saved query params unmarshal failed: ", err)
+		routes.FieldError(w, "params", "params", "QUERY.RUN.T_ERROR_BAD_PARAMS")
+		return
+	}
+
+	if format == "" {
+		format = mapSearchOutputJSON
+	}
+	mapSearchRun(w, &search, user, format)
+}
@@ -0,0 +1,314 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	db "github.com/croll/arkeogis-server/db"
+	"github.com/croll/arkeogis-server/mapsearch"
+	"github.com/croll/arkeogis-server/model"
+	"github.com/croll/arkeogis-server/webserver/routes"
+	"github.com/jmoiron/sqlx"
+)
+
+func init() {
+	Routes := []*routes.Route{
+		&routes.Route{
+			Path:        "/api/query/{id:[0-9]+}/snapshot",
+			Func:        QuerySnapshot,
+			Description: "Store a snapshot of the sites found by a saved query",
+			Method:      "POST",
+			Params:      reflect.TypeOf(QuerySnapshotParams{}),
+			Permissions: []string{
+				"request map",
+			},
+		},
+		&routes.Route{
+			Path:        "/api/query/{id:[0-9]+}/diff",
+			Func:        QueryDiff,
+			Description: "Compare the sites found by a saved query to a snapshot",
+			Method:      "GET",
+			Params:      reflect.TypeOf(QueryDiffParams{}),
+			Permissions: []string{
+				"request map",
+			},
+		},
+	}
+	routes.RegisterMultiple(Routes)
+}
+
+type QuerySnapshotParams struct {
+	Id int
+}
+
+// QueryDiffParams : the latest snapshot is used if Snapshot_id is 0
+type QueryDiffParams struct {
+	Id          int
+	Snapshot_id int
+}
+
+// QueryDiffSite is a site added or removed since the snapshot, or changed
+type QueryDiffSite struct {
+	Id          int                       `json:"id"`
+	Code        string                    `json:"code"`
+	Database_id int                       `json:"database_id"`
+	Changes     map[string][2]interface{} `json:"changes,omitempty"`
+}
+
+// QueryDiffResult is the result of a diff. Changes are [old, new] values of the changed fields
+type QueryDiffResult struct {
+	Snapshot_id         int             `json:"snapshot_id"`
+	Snapshot_created_at time.Time       `json:"snapshot_created_at"`
+	Added               []QueryDiffSite `json:"added"`
+	Removed             []QueryDiffSite `json:"removed"`
+	Changed             []QueryDiffSite `json:"changed"`
+}
+
+// querySitesState returns the compared state of the sites found by the saved
+// query, as a json object. Sites are identified by their database and code, so
+// they are still matched after a database is imported again.
+func querySitesState(query *model.Saved_query, tx *sqlx.Tx) (string, error) {
+	search := MapSearchParams{}
+	err := json.Unmarshal([]byte(query.Params), &search)
+	if err != nil {
+		return "", err
+	}
+
+	filters, errors := mapsearch.Compile(&search.Params)
+	if len(errors) > 0 {
+		return "", fmt.Errorf("saved query params are invalid: %v", errors)
+	}
+	q, q_args, err := filters.BuildQuery()
+	if err != nil {
+		return "", err
+	}
+
+	state := ""
+	err = tx.Get(&state, `SELECT COALESCE(json_object_agg(s.database_id || ':' || s.code, json_build_object(`+
+		` 'id', s.id, 'code', s.code, 'database_id', s.database_id, 'name', s.name, 'city_name', s.city_name, 'city_geonameid', s.city_geonameid,`+
+		` 'geom', ST_AsText(s.geom), 'centroid', s.centroid, 'occupation', s.occupation,`+
+		` 'start_date1', s.start_date1, 'start_date2', s.start_date2, 'end_date1', s.end_date1, 'end_date2', s.end_date2,`+
+		` 'characs', (SELECT json_agg(DISTINCT src.charac_id) FROM site_range sr JOIN site_range__charac src ON src.site_range_id = sr.id WHERE sr.site_id = s.id)`+
+		`) ORDER BY s.database_id, s.code), '{}')::text FROM site s WHERE s.id IN (`+q+`)`, q_args...)
+	return state, err
+}
+
+// QuerySnapshot store the current result of a saved query, only its owner can do that
+func QuerySnapshot(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	params := proute.Params.(*QuerySnapshotParams)
+
+	// get the user
+	_user, _ := proute.Session.Get("user")
+	user := _user.(model.User)
+
+	query, ok := queryGetVisible(w, params.Id, user)
+	if !ok {
+		return
+	}
+	if query.Owner_user_id != user.Id {
+		routes.FieldError(w, "id", "id", "QUERY.SNAPSHOT.T_ERROR_NOT_OWNER")
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Println("can't start transaction")
+		userSqlError(w, err)
+		return
+	}
+
+	state, err := querySitesState(query, tx)
+	if err != nil {
+		log.Println("saved query execution failed : ", err)
+		userSqlError(w, err)
+		_ = tx.Rollback()
+		return
+	}
+
+	snapshot := model.Saved_query_snapshot{}
+	err = tx.Get(&snapshot, `INSERT INTO "saved_query_snapshot" ("saved_query_id", "sites", "created_at") VALUES ($1, $2, now()) RETURNING *`, query.Id, state)
+	if err != nil {
+		log.Println("insert saved_query_snapshot failed : ", err)
+		userSqlError(w, err)
+		_ = tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("can't commit")
+		userSqlError(w, err)
+		return
+	}
+
+	j, err := json.Marshal(struct {
+		Id         int       `json:"id"`
+		Created_at time.Time `json:"created_at"`
+	}{snapshot.Id, snapshot.Created_at})
+	if err != nil {
+		log.Println("marshal failed: ", err)
+		return
+	}
+	w.Write(j)
+}
+
+// QueryDiff compare the current result of a saved query to a snapshot
+func QueryDiff(w http.ResponseWriter, r *http.Request, proute routes.Proute) {
+	params := proute.Params.(*QueryDiffParams)
+
+	// get the user
+	_user, _ := proute.Session.Get("user")
+	user := _user.(model.User)
+
+	query, ok := queryGetVisible(w, params.Id, user)
+	if !ok {
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Println("can't start transaction")
+		userSqlError(w, err)
+		return
+	}
+
+	snapshot := model.Saved_query_snapshot{}
+	if params.Snapshot_id > 0 {
+		err = tx.Get(&snapshot, `SELECT * FROM "saved_query_snapshot" WHERE "id"=$1 AND "saved_query_id"=$2`, params.Snapshot_id, query.Id)
+	} else {
+		err = tx.Get(&snapshot, `SELECT * FROM "saved_query_snapshot" WHERE "saved_query_id"=$1 ORDER BY "created_at" DESC, "id" DESC LIMIT 1`, query.Id)
+	}
+	if err != nil {
+		fmt.Println("snapshot not found : ", params, err)
+		routes.FieldError(w, "snapshot_id", "snapshot_id", "QUERY.DIFF.T_ERROR_SNAPSHOT_NOT_FOUND")
+		_ = tx.Rollback()
+		return
+	}
+
+	state, err := querySitesState(query, tx)
+	if err != nil {
+		log.Println("saved query execution failed : ", err)
+		userSqlError(w, err)
+		_ = tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("can't commit")
+		userSqlError(w, err)
+		return
+	}
+
+	res, err := queryDiffStates(snapshot.Sites, state)
+	if err != nil {
+		log.Println("diff failed: ", err)
+		routes.ServerError(w, 500, "INTERNAL ERROR")
+		return
+	}
+	res.Snapshot_id = snapshot.Id
+	res.Snapshot_created_at = snapshot.Created_at
+
+	j, err := json.Marshal(res)
+	if err != nil {
+		log.Println("marshal failed: ", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// queryDiffStates compare two states returned by querySitesState
+func queryDiffStates(oldState string, newState string) (*QueryDiffResult, error) {
+	olds := map[string]map[string]interface{}{}
+	news := map[string]map[string]interface{}{}
+	if err := json.Unmarshal([]byte(oldState), &olds); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(newState), &news); err != nil {
+		return nil, err
+	}
+
+	res := &QueryDiffResult{
+		Added:   []QueryDiffSite{},
+		Removed: []QueryDiffSite{},
+		Changed: []QueryDiffSite{},
+	}
+
+	keys := []string{}
+	for key := range olds {
+		keys = append(keys, key)
+	}
+	for key := range news {
+		if _, ok := olds[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		o, inOld := olds[key]
+		n, inNew := news[key]
+		switch {
+		case !inOld:
+			res.Added = append(res.Added, queryDiffSite(n))
+		case !inNew:
+			res.Removed = append(res.Removed, queryDiffSite(o))
+		default:
+			changes := map[string][2]interface{}{}
+			for field, value := range n {
+				if field == "id" {
+					continue
+				}
+				if !reflect.DeepEqual(o[field], value) {
+					changes[field] = [2]interface{}{o[field], value}
+				}
+			}
+			if len(changes) > 0 {
+				site := queryDiffSite(n)
+				site.Changes = changes
+				res.Changed = append(res.Changed, site)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func queryDiffSite(state map[string]interface{}) QueryDiffSite {
+	site := QueryDiffSite{}
+	if id, ok := state["id"].(float64); ok {
+		site.Id = int(id)
+	}
+	if database_id, ok := state["database_id"].(float64); ok {
+		site.Database_id = int(database_id)
+	}
+	site.Code, _ = state["code"].(string)
+	return site
+}
@@ -0,0 +1,138 @@
+/* ArkeoGIS - The Geographic Information System for Archaeologists
+ * Copyright (C) 2015-2016 CROLL SAS
+ *
+ * Authors :
+ *  Nicolas Dimitrijevic <nicolas@croll.fr>
+ *  Christophe Beveraggi <beve@croll.fr>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package rest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQueryDiffStates(t *testing.T) {
+	const snapshot = `{
+		"1:A": {"id": 10, "code": "A", "database_id": 1, "name": "Site A", "centroid": false, "characs": [1, 2]},
+		"1:B": {"id": 11, "code": "B", "database_id": 1, "name": "Site B", "centroid": false, "characs": [3]},
+		"2:C": {"id": 20, "code": "C", "database_id": 2, "name": "Site C", "centroid": true, "characs": null}
+	}`
+
+	tests := []struct {
+		name    string
+		state   string
+		added   []QueryDiffSite
+		removed []QueryDiffSite
+		changed []QueryDiffSite
+	}{
+		{
+			name:    "same sites",
+			state:   snapshot,
+			added:   []QueryDiffSite{},
+			removed: []QueryDiffSite{},
+			changed: []QueryDiffSite{},
+		},
+		{
+			name: "added site",
+			state: `{
+				"1:A": {"id": 10, "code": "A", "database_id": 1, "name": "Site A", "centroid": false, "characs": [1, 2]},
+				"1:B": {"id": 11, "code": "B", "database_id": 1, "name": "Site B", "centroid": false, "characs": [3]},
+				"1:D": {"id": 12, "code": "D", "database_id": 1, "name": "Site D", "centroid": false, "characs": null},
+				"2:C": {"id": 20, "code": "C", "database_id": 2, "name": "Site C", "centroid": true, "characs": null}
+			}`,
+			added:   []QueryDiffSite{{Id: 12, Code: "D", Database_id: 1}},
+			removed: []QueryDiffSite{},
+			changed: []QueryDiffSite{},
+		},
+		{
+			name: "removed site",
+			state: `{
+				"1:A": {"id": 10, "code": "A", "database_id": 1, "name": "Site A", "centroid": false, "characs": [1, 2]},
+				"2:C": {"id": 20, "code": "C", "database_id": 2, "name": "Site C", "centroid": true, "characs": null}
+			}`,
+			added:   []QueryDiffSite{},
+			removed: []QueryDiffSite{{Id: 11, Code: "B", Database_id: 1}},
+			changed: []QueryDiffSite{},
+		},
+		{
+			// the database was imported again, the id of the site changed but not its code
+			name: "changed sites",
+			state: `{
+				"1:A": {"id": 30, "code": "A", "database_id": 1, "name": "Site A", "centroid": false, "characs": [1, 2]},
+				"1:B": {"id": 11, "code": "B", "database_id": 1, "name": "Site B2", "centroid": false, "characs": [3, 4]},
+				"2:C": {"id": 20, "code": "C", "database_id": 2, "name": "Site C", "centroid": false, "characs": null}
+			}`,
+			added:   []QueryDiffSite{},
+			removed: []QueryDiffSite{},
+			changed: []QueryDiffSite{
+				{Id: 11, Code: "B", Database_id: 1, Changes: map[string][2]interface{}{
+					"name":    {"Site B", "Site B2"},
+					"characs": {[]interface{}{float64(3)}, []interface{}{float64(3), float64(4)}},
+				}},
+				{Id: 20, Code: "C", Database_id: 2, Changes: map[string][2]interface{}{
+					"centroid": {true, false},
+				}},
+			},
+		},
+		{
+			name: "added, removed and changed sites",
+			state: `{
+				"1:B": {"id": 11, "code": "B", "database_id": 1, "name": "Site B", "centroid": false, "characs": [3]},
+				"2:C": {"id": 20, "code": "C", "database_id": 2, "name": "Site C", "centroid": true, "characs": [5]},
+				"2:E": {"id": 21, "code": "E", "database_id": 2, "name": "Site E", "centroid": true, "characs": null}
+			}`,
+			added:   []QueryDiffSite{{Id: 21, Code: "E", Database_id: 2}},
+			removed: []QueryDiffSite{{Id: 10, Code: "A", Database_id: 1}},
+			changed: []QueryDiffSite{
+				{Id: 20, Code: "C", Database_id: 2, Changes: map[string][2]interface{}{
+					"characs": {nil, []interface{}{float64(5)}},
+				}},
+			},
+		},
+		{
+			name:    "no sites anymore",
+			state:   `{}`,
+			added:   []QueryDiffSite{},
+			removed: []QueryDiffSite{{Id: 10, Code: "A", Database_id: 1}, {Id: 11, Code: "B", Database_id: 1}, {Id: 20, Code: "C", Database_id: 2}},
+			changed: []QueryDiffSite{},
+		},
+	}
+
+	for _, test := range tests {
+		res, err := queryDiffStates(snapshot, test.state)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(res.Added, test.added) {
+			t.Errorf("%s: added %v, want %v", test.name, res.Added, test.added)
+		}
+		if !reflect.DeepEqual(res.Removed, test.removed) {
+			t.Errorf("%s: removed %v, want %v", test.name, res.Removed, test.removed)
+		}
+		if !reflect.DeepEqual(res.Changed, test.changed) {
+			t.Errorf("%s: changed %v, want %v", test.name, res.Changed, test.changed)
+		}
+	}
+}
+
+func TestQueryDiffStatesInvalid(t *testing.T) {
+	if _, err := queryDiffStates(`{}`, `[`); err == nil {
+		t.Error("an invalid state must fail")
+	}
+}